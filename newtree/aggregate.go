@@ -0,0 +1,96 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+package newtree
+
+import "context"
+import "errors"
+
+var ENoAggregate = errors.New("ENoAggregate")
+
+// Optional extension to TreeOps, required by .Aggregate().
+//
+// Contains(p,q) reports, whether every element covered by p (a leaf value or
+// a union) matches q. Summary(p) returns the aggregate of all elements covered
+// by p, or nil, if p can't be decoded, and Merge(a,b) combines two non-nil
+// aggregates. If Contains(p,q) is true, Consistent(p,q) must be true as well.
+type AggregateOps interface{
+	Contains(p []byte, q interface{}) bool
+	Summary(p []byte) interface{}
+	Merge(a, b interface{}) interface{}
+}
+
+func (t *Tree) aggregate(
+	ctx context.Context,
+	a AggregateOps,
+	id int64,
+	plsn uint64,
+	ver uint16,
+	q interface{},
+	acc interface{}) (interface{},error) {
+	b,node,lsn,err := t.readPage(id,ver)
+	defer freeElements(node)
+	defer b.Free()
+	if err!=nil { return acc,err }
+	
+	for _,e := range node {
+		err = t.resolveElement(id,&e)
+		if err!=nil { return acc,err }
+		if a.Contains(e.Val,q) {
+			/* The whole subtree matches, its summary is the answer. */
+			s := a.Summary(e.Val)
+			if s==nil { continue }
+			if acc==nil { acc = s } else { acc = a.Merge(acc,s) }
+			continue
+		}
+		if e.Ptr==0 || !t.Ops.Consistent(e.Val,q) { continue }
+		err = ctx.Err()
+		if err!=nil { return acc,err }
+		acc,err = t.aggregate(ctx,a,e.Ptr,lsn,ver,q,acc)
+		if err!=nil { return acc,err }
+	}
+	for _,sib := range t.movedFrom(id,plsn,lsn) {
+		acc,err = t.aggregate(ctx,a,sib,plsn,ver,q,acc)
+		if err!=nil { return acc,err }
+	}
+	return acc,nil
+}
+
+/*
+Returns the aggregate of all leaf-elements matching q, or nil, if there are
+none. Subtrees, whose union is contained in q, are answered from the union
+alone, without reading them. This requires .Ops to implement AggregateOps,
+otherwise ENoAggregate is returned.
+*/
+func (t *Tree) Aggregate(
+	ctx context.Context,
+	obj int64,
+	q interface{}) (interface{},error) {
+	a,ok := t.Ops.(AggregateOps)
+	if !ok { return nil,ENoAggregate }
+	defer t.endRead(t.beginRead())
+	rr,lsn,err := t.readRoot(obj)
+	if err!=nil || rr.Ptr==0 { return nil,err }
+	return t.aggregate(ctx,a,rr.Ptr,lsn,rr.Version,q,nil)
+}
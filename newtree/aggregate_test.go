@@ -0,0 +1,106 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+
+
+package newtree_test
+
+import "github.com/maxymania/gonbase/newtree"
+import "github.com/maxymania/gonbase/ntops"
+import "context"
+import "sync/atomic"
+import "testing"
+
+/* Computes the aggregate of q by a full Search. */
+func scanAggregate(t testing.TB, tr *newtree.Tree, obj int64, q interface{}) (r *ntops.GroupAggregate) {
+	ops := ntops.GroupOps{}
+	err := tr.Search(context.Background(),obj,q,func(b []byte) {
+		if !ops.Contains(b,q) { return }
+		s := ops.Summary(b).(*ntops.GroupAggregate)
+		if r==nil { r = s } else { r = ops.Merge(r,s).(*ntops.GroupAggregate) }
+	})
+	if err!=nil { t.Fatal(err) }
+	return
+}
+
+func TestAggregate(t *testing.T) {
+	var reads int64
+	tr := &newtree.Tree{IBase:countBase{newtree.NewMemBase(256),&reads},Ops:ntops.GroupOps{}}
+	obj,_ := tr.NewRoot()
+	queries := []interface{}{
+		&ntops.GroupQuery{GroupID:1,ArticleLow:1,ArticleHigh:0},
+		&ntops.GroupQuery{GroupID:2,ArticleLow:450,ArticleHigh:520},
+		&ntops.GroupQuery{GroupID:0,ArticleLow:150,ArticleHigh:10000},
+		&ntops.GroupQuery{GroupID:7,ArticleLow:1,ArticleHigh:0},
+		&ntops.GroupExpired{Timestamp:50},
+		&ntops.GroupEntry{GroupID:1,Article:301},
+	}
+	check := func(stage string) {
+		for i,q := range queries {
+			got,err := tr.Aggregate(context.Background(),obj,q)
+			if err!=nil { t.Fatal(err) }
+			want := scanAggregate(t,tr,obj,q)
+			if want==nil {
+				if got!=nil { t.Errorf("%s: query %d: %v, want nil",stage,i,got) }
+				continue
+			}
+			if g,_ := got.(*ntops.GroupAggregate); g==nil || *g!=*want {
+				t.Errorf("%s: query %d: %v, want %v",stage,i,got,*want)
+			}
+		}
+	}
+	for i := uint64(0); i<600; i++ {
+		g := &ntops.GroupEntry{GroupID:i/200,Article:i,Expires:i*7%100,Value:[]byte("v")}
+		if err := tr.Insert(obj,g.Marshal()); err!=nil { t.Fatal(err) }
+	}
+	if st := verify(t,tr,obj); st.Depth<3 { t.Fatalf("depth %d, the tree has not been split enough",st.Depth) }
+	check("insert")
+	
+	/* The subtrees within group 1 are answered from their unions. */
+	atomic.StoreInt64(&reads,0)
+	scanAggregate(t,tr,obj,queries[0])
+	scan := atomic.SwapInt64(&reads,0)
+	if _,err := tr.Aggregate(context.Background(),obj,queries[0]); err!=nil { t.Fatal(err) }
+	if n := atomic.LoadInt64(&reads); n*2>scan { t.Fatalf("Aggregate read %d pages, Search %d",n,scan) }
+	
+	_,err := tr.Delete(context.Background(),obj,&ntops.GroupQuery{GroupID:2,ArticleLow:420,ArticleHigh:480},func(b []byte) bool { return true })
+	if err!=nil { t.Fatal(err) }
+	verify(t,tr,obj)
+	check("delete")
+	
+	for i := uint64(600); i<900; i++ {
+		g := &ntops.GroupEntry{GroupID:i%3,Article:i-400,Expires:i*11%100,Value:[]byte("w")}
+		if err := tr.Insert(obj,g.Marshal()); err!=nil { t.Fatal(err) }
+	}
+	verify(t,tr,obj)
+	check("reinsert")
+}
+
+/* Undecodable keys have no summary. */
+func TestGroupOpsSummary(t *testing.T) {
+	ops := ntops.GroupOps{}
+	if s := ops.Summary([]byte{0xc1}); s!=nil { t.Fatal(s) }
+	a := ops.Summary((&ntops.GroupEntry{GroupID:1,Article:10,Expires:5}).Marshal())
+	if m := ops.Merge(a,ops.Summary(nil)); m!=a { t.Fatal(m) }
+}
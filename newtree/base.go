@@ -45,3 +45,15 @@ type IBase interface{
 	HeadFree(id int64) error
 }
 
+
+/*
+An IBase, that can apply the writes of an operation atomically. The Tree
+encloses every writing operation (.Insert(), .Delete() ...) in OpBegin() and
+OpEnd(). OpEnd(false) discards all writes, allocations and frees since the
+corresponding OpBegin(). OpBegin() blocks, while another operation is active.
+*/
+type AtomicBase interface{
+	IBase
+	OpBegin() error
+	OpEnd(commit bool) error
+}
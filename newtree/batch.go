@@ -0,0 +1,268 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+package newtree
+
+import "github.com/byte-mug/golibs/bufferex"
+import "context"
+import "errors"
+import "sort"
+import "sync"
+
+var EBatchBase = errors.New("EBatchBase")
+
+/* Serializes the commits of all Batches, so that they can't deadlock. */
+var batchMu sync.Mutex
+
+const (
+	batchInsert = iota
+	batchDelete
+	batchUpsert
+	batchUnique
+)
+
+type batchOp struct{
+	t    *Tree
+	obj  int64
+	kind int
+	val  []byte
+	q    interface{}
+	chk  func([]byte) bool
+}
+
+/*
+A Batch collects .Insert(), .Delete(), .Upsert() and .InsertUnique()
+operations on one or more trees, and
+applies them together on .Commit(). All Trees must share the same IBase.
+
+The operations are performed on an overlay, that buffers all page and head
+writes, in CopyOnWrite-mode. Only if all of them succeed, the buffered pages
+are written, and then the Roots. So readers see the old or the new state of
+each tree, but never a partial one. If the IBase is an AtomicBase (such as a
+WALBase), the whole Batch is a single operation, which is durable as a whole.
+Otherwise a crash during .Commit() may leave a part of the Roots updated.
+
+The zero value is an empty Batch.
+*/
+type Batch struct{
+	ops []batchOp
+}
+
+/* Adds an insert of nitem into the tree obj of t. */
+func (b *Batch) Insert(t *Tree, obj int64, nitem []byte) {
+	b.ops = append(b.ops,batchOp{t:t,obj:obj,val:append([]byte(nil),nitem...)})
+}
+
+/* Adds a delete (see Tree.Delete()). chk is called during .Commit(). */
+func (b *Batch) Delete(t *Tree, obj int64, q interface{}, chk func([]byte) bool) {
+	b.ops = append(b.ops,batchOp{t:t,obj:obj,kind:batchDelete,q:q,chk:chk})
+}
+
+/* Adds an upsert (see Tree.Upsert()). match is called during .Commit(). */
+func (b *Batch) Upsert(t *Tree, obj int64, q interface{}, newVal []byte, match func([]byte) bool) {
+	b.ops = append(b.ops,batchOp{t:t,obj:obj,kind:batchUpsert,val:append([]byte(nil),newVal...),q:q,chk:match})
+}
+
+/*
+Adds an insert-if-absent (see Tree.InsertUnique()). If there is a match, the
+.Commit() fails with EExists.
+*/
+func (b *Batch) InsertUnique(t *Tree, obj int64, q interface{}, nitem []byte, match func([]byte) bool) {
+	b.ops = append(b.ops,batchOp{t:t,obj:obj,kind:batchUnique,val:append([]byte(nil),nitem...),q:q,chk:match})
+}
+
+// Discards all collected operations.
+func (b *Batch) Rollback() { b.ops = nil }
+
+/*
+Performs and applies all collected operations. If one of them fails (or a
+Delete is aborted by ctx), nothing is applied. The Batch is empty afterwards.
+*/
+func (b *Batch) Commit(ctx context.Context) (err error) {
+	ops := b.ops
+	b.ops = nil
+	if len(ops)==0 { return nil }
+	base := ops[0].t.IBase
+	var trees []*Tree
+	for _,op := range ops {
+		if op.t.IBase!=base { return EBatchBase }
+		found := false
+		for _,t := range trees { found = found || t==op.t }
+		if !found { trees = append(trees,op.t) }
+	}
+	
+	batchMu.Lock(); defer batchMu.Unlock()
+	for _,t := range trees {
+		t.cc.writer.Lock()
+		defer t.cc.writer.Unlock()
+	}
+	ab,atomic := base.(AtomicBase)
+	if atomic {
+		if err = ab.OpBegin(); err!=nil { return }
+	}
+	
+	ov := &batchBase{IBase:base,pages:make(map[int64][]byte),heads:make(map[int64]*batchHead),allocs:make(map[int64]bool)}
+	err = ov.run(ctx,ops)
+	applied := false
+	if err==nil {
+		applied = true
+		err = ov.apply()
+	}
+	
+	var rel []int64
+	for _,t := range trees { rel = append(rel,t.settle(atomic && err!=nil)...) }
+	for _,id := range rel {
+		e := base.PageFree(id)
+		if err==nil { err = e }
+	}
+	/* After a partial apply, the new pages may be reachable. */
+	if err!=nil && !atomic && !applied { ov.abort() }
+	if atomic {
+		e := ab.OpEnd(err==nil)
+		if err==nil { err = e }
+	}
+	return
+}
+
+/* -------------------------------------------------------------------------------- */
+
+type batchHead struct{
+	t    *Tree
+	data []byte
+}
+type batchFree struct{
+	t  *Tree
+	id int64
+}
+
+/* The overlay of a Batch. */
+type batchBase struct{
+	IBase
+	pages  map[int64][]byte
+	heads  map[int64]*batchHead
+	allocs map[int64]bool
+	frees  []batchFree
+}
+
+/* The view of one Tree on the overlay. */
+type batchTree struct{
+	*batchBase
+	t *Tree
+}
+
+func (o *batchBase) run(ctx context.Context, ops []batchOp) (err error) {
+	shadows := make(map[*Tree]*Tree)
+	for _,op := range ops {
+		s := shadows[op.t]
+		if s==nil {
+			s = &Tree{IBase:batchTree{o,op.t},Ops:op.t.Ops,CopyOnWrite:true,Split:op.t.Split,MinFill:op.t.MinFill}
+			shadows[op.t] = s
+		}
+		switch op.kind {
+		case batchDelete:
+			var abort error
+			abort,err = s.Delete(ctx,op.obj,op.q,op.chk)
+			if err==nil { err = abort }
+		case batchUpsert:
+			_,err = s.Upsert(op.obj,op.q,op.val,op.chk)
+		case batchUnique:
+			err = s.InsertUnique(op.obj,op.q,op.val,op.chk)
+		default:
+			err = s.Insert(op.obj,op.val)
+		}
+		if err!=nil { return }
+	}
+	return
+}
+
+/*
+Writes the new pages (unreachable so far), then the Roots. The old pages are
+freed by their Trees, once no reader can reach them anymore.
+*/
+func (o *batchBase) apply() error {
+	ids := make([]int64,0,len(o.pages))
+	for id := range o.pages { ids = append(ids,id) }
+	sort.Slice(ids,func(i,j int) bool { return ids[i]<ids[j] })
+	for _,id := range ids {
+		err := o.IBase.PageWrite(id,o.pages[id])
+		if err!=nil { return err }
+	}
+	ids = ids[:0]
+	for id := range o.heads { ids = append(ids,id) }
+	sort.Slice(ids,func(i,j int) bool { return ids[i]<ids[j] })
+	for _,id := range ids {
+		h := o.heads[id]
+		err := h.t.writeHeadLatched(id,h.data)
+		if err!=nil { return err }
+	}
+	for _,f := range o.frees {
+		err := f.t.freePage(f.id)
+		if err!=nil { return err }
+	}
+	return nil
+}
+
+/* Releases the pages allocated by a failed Batch. */
+func (o *batchBase) abort() {
+	for id := range o.allocs { o.IBase.PageFree(id) }
+}
+
+func (o *batchBase) PageAlloc() (int64,error) {
+	id,err := o.IBase.PageAlloc()
+	if err==nil { o.allocs[id] = true }
+	return id,err
+}
+func (o *batchBase) PageRead(id int64) (bufferex.Binary,error) {
+	p,ok := o.pages[id]
+	if !ok { return o.IBase.PageRead(id) }
+	b := bufferex.AllocBinary(len(p))
+	copy(b.Bytes(),p)
+	return b,nil
+}
+func (o *batchBase) PageWrite(id int64,b []byte) error {
+	o.pages[id] = append(o.pages[id][:0],b...)
+	return nil
+}
+func (o *batchBase) HeadRead(id int64) (bufferex.Binary,error) {
+	h,ok := o.heads[id]
+	if !ok { return o.IBase.HeadRead(id) }
+	b := bufferex.AllocBinary(HeadSize)
+	copy(b.Bytes(),h.data)
+	return b,nil
+}
+
+/* Pages allocated by the Batch are not visible to anyone, so they are released at once. */
+func (o batchTree) PageFree(id int64) error {
+	if o.allocs[id] {
+		delete(o.allocs,id)
+		delete(o.pages,id)
+		return o.IBase.PageFree(id)
+	}
+	o.frees = append(o.frees,batchFree{o.t,id})
+	return nil
+}
+func (o batchTree) HeadWrite(id int64,b []byte) error {
+	o.heads[id] = &batchHead{o.t,append([]byte(nil),b[:HeadSize]...)}
+	return nil
+}
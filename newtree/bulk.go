@@ -0,0 +1,161 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+package newtree
+
+import "errors"
+
+var ENotEmpty = errors.New("ENotEmpty")
+
+/*
+A stream of leaf-values, as consumed by .BulkLoad(). A *Cursor is a Source.
+*/
+type Source interface{
+	Next() bool
+	Value() []byte
+	Err() error
+}
+
+type bulkLoader struct{
+	t      *Tree
+	levels []Elements
+	pages  []int64 // The pages written so far.
+	ovf    []int64 // The overflow chains written so far.
+}
+
+/*
+Writes out packed pages of level lv. If all is false, it keeps at least one
+page worth of elements, so that the last pages of a level can still be split evenly.
+*/
+func (bl *bulkLoader) flush(lv int, all bool) error {
+	max := bl.t.pageCap()
+	P := bl.levels[lv]
+	for len(P)>0 {
+		if !all && P.Length() <= 2*max { break }
+		bl.t.Ops.Sort(P)
+		cur,rest := bl.lastSplit(P)
+		if cur==nil { cur,rest = bl.t.firstSplit(P) }
+		id,err := bl.t.insertPage(cur)
+		if err!=nil { return err }
+		bl.pages = append(bl.pages,id)
+		e := Element{Ptr:id,Val:bl.t.Ops.Union(cur)}
+		
+		n := copy(P,rest)
+		for i := range P[n:] { P[n+i] = Element{} }
+		P = P[:n]
+		
+		if lv+1 == len(bl.levels) { bl.levels = append(bl.levels,nil) }
+		bl.levels[lv+1] = append(bl.levels[lv+1],e)
+		bl.levels[lv] = P
+		if !all { err = bl.flush(lv+1,false) }
+		if err!=nil { return err }
+	}
+	bl.levels[lv] = P
+	return nil
+}
+/*
+If P fits into two pages, it splits P into two halves, so that the last page
+of a level is not left underfull. Returns nil, if this is not possible.
+*/
+func (bl *bulkLoader) lastSplit(P Elements) (Elements,Elements) {
+	max := bl.t.pageCap()
+	size := P.Length()
+	if size<=max || size>2*max { return nil,nil }
+	cur,rest := bl.t.splitAt(P,(size+4)/2)
+	if len(cur)==0 || len(rest)==0 || cur.Length()>max || rest.Length()>max { return nil,nil }
+	return cur,rest
+}
+func (bl *bulkLoader) push(val []byte) error {
+	e,err := bl.t.leafElement(val)
+	if err!=nil { return err }
+	if e.Ovf!=0 { bl.ovf = append(bl.ovf,e.Ovf) }
+	bl.levels[0] = append(bl.levels[0],e)
+	return bl.flush(0,false)
+}
+func (bl *bulkLoader) finish() (rr Root,err error) {
+	for lv := 0; lv<len(bl.levels); lv++ {
+		P := bl.levels[lv]
+		if lv+1 == len(bl.levels) && P.Length() <= bl.t.pageCap() {
+			if len(P)==0 { return }
+			bl.t.Ops.Sort(P)
+			rr.Ptr,err = bl.t.insertPage(P)
+			if err!=nil { return }
+			bl.pages = append(bl.pages,rr.Ptr)
+			rr.Depth = uint32(lv+1)
+			rr.Version = FormatVersion
+			return
+		}
+		err = bl.flush(lv,true)
+		if err!=nil { return }
+	}
+	return
+}
+
+/* Frees the pages and overflow chains written so far, after a failure. */
+func (bl *bulkLoader) release() error {
+	for _,id := range bl.ovf {
+		err := bl.t.freeOverflow(id)
+		if err!=nil { return err }
+	}
+	for _,id := range bl.pages {
+		err := bl.t.freePage(id)
+		if err!=nil { return err }
+	}
+	return nil
+}
+
+/*
+Builds the tree obj bottom-up from a stream of leaf-values, which should be
+sorted according to .Ops.Sort(). Unlike repeated .Insert() calls, this fills
+the pages densely and writes the Root only once. The tree must be empty,
+otherwise ENotEmpty is returned.
+
+If src.Err() or writing fails, the pages written so far are freed and the tree
+remains empty.
+*/
+func (t *Tree) BulkLoad(obj int64, src Source) (err error) {
+	if err = t.beginWrite(); err!=nil { return }
+	defer t.endWrite(&err)
+	rr,err := t.getRoot(obj)
+	if err!=nil { return err }
+	if rr.Ptr!=0 { return ENotEmpty }
+	
+	bl := &bulkLoader{t:t,levels:make([]Elements,1)}
+	defer func() {
+		if err==nil { return }
+		/* The first error is more relevant, than a failure to clean up. */
+		bl.release()
+	}()
+	for src.Next() {
+		err = bl.push(append([]byte(nil),src.Value()...))
+		if err!=nil { return err }
+	}
+	err = src.Err()
+	if err!=nil { return err }
+	
+	rr,err = bl.finish()
+	if err!=nil || rr.Ptr==0 { return err }
+	return t.putRoot(obj,rr)
+}
+
@@ -0,0 +1,70 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+
+
+package newtree_test
+
+import "github.com/maxymania/gonbase/newtree"
+import "fmt"
+import "testing"
+
+/* A Source of the elements of the keys from 0 to n-1. */
+type rangeSource struct{
+	k,n int64
+	val []byte
+}
+func (s *rangeSource) Next() bool {
+	if s.k>=s.n { return false }
+	s.val = ivElem(s.k)
+	s.k++
+	return true
+}
+func (s *rangeSource) Value() []byte { return s.val }
+func (s *rangeSource) Err() error { return nil }
+
+func TestBulkLoad(t *testing.T) {
+	const page = 512
+	for _,sp := range []newtree.SplitStrategy{nil,newtree.QuadraticSplit{},newtree.RStarSplit{}} {
+		for _,n := range []int64{1,13,14,15,27,100,1000,3001} {
+			name := fmt.Sprintf("%T/%d",sp,n)
+			tr := ivTree(newtree.NewMemBase(page))
+			tr.Split = sp
+			obj,_ := tr.NewRoot()
+			if err := tr.BulkLoad(obj,&rangeSource{n:n}); err!=nil { t.Fatal(name,err) }
+			st := verify(t,tr,obj)
+			if st.LeafEntries!=int(n) { t.Fatalf("%s: %d leaf entries",name,st.LeafEntries) }
+			got := keys(t,tr,obj,all)
+			for i,k := range got {
+				if k!=int64(i) { t.Fatalf("%s: key %d at %d",name,k,i) }
+			}
+			
+			/* The last page of a level shares the elements with the one before it. */
+			for lv,l := range st.Levels {
+				if l.Pages>1 && l.MinBytes*2<page-100 { t.Fatalf("%s: level %d: %d pages, the least filled holds %d bytes",name,lv,l.Pages,l.MinBytes) }
+			}
+			if err := tr.BulkLoad(obj,&rangeSource{n:1}); err!=newtree.ENotEmpty { t.Fatalf("%s: %v",name,err) }
+		}
+	}
+}
@@ -0,0 +1,306 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+package newtree
+
+import "github.com/byte-mug/golibs/bufferex"
+import "container/list"
+import "sort"
+import "sync"
+
+/*
+A caching IBase. Pages and heads are kept in memory up to a budget of bytes and
+evicted in LRU order. Writes are cached as well (write-back), dirty entries are
+written to the underlying IBase, when they are evicted or by .Flush().
+
+Pinned pages are never evicted. If all entries are pinned, the budget may be
+exceeded. If the write-back of an evicted entry fails, the entry stays dirty in
+the cache, and the error is reported by .Flush().
+
+An entry is inserted, before it is read from the underlying IBase, so that a
+concurrent write or free of it supersedes the read, rather than being
+overwritten by stale data.
+
+If used together with a WALBase, the CacheBase must be below the WALBase, so
+that a checkpoint flushes the cache (by calling .Sync()).
+*/
+type CacheBase struct{
+	IBase
+	
+	mu      sync.Mutex
+	budget  int64
+	used    int64
+	entries map[cacheKey]*cacheEntry
+	lru     list.List
+	stats   CacheStats
+}
+
+/* Pages and heads may have the same ids. */
+type cacheKey struct{
+	id   int64
+	head bool
+}
+
+type cacheEntry struct{
+	cacheKey
+	dirty bool
+	pins  int
+	data  []byte
+	elem  *list.Element
+	
+	// Not nil, while the entry is read from the underlying IBase. It is closed,
+	// once the entry is loaded, written or dropped.
+	loading chan struct{}
+}
+
+/* Counters of a CacheBase. */
+type CacheStats struct{
+	Hits       uint64
+	Misses     uint64
+	Evictions  uint64
+	WriteBacks uint64
+	
+	Entries int
+	Dirty   int
+	Bytes   int64
+}
+
+// Creates a CacheBase on top of base with a budget of budget bytes.
+func NewCacheBase(base IBase, budget int64) *CacheBase {
+	return &CacheBase{IBase:base,budget:budget,entries:make(map[cacheKey]*cacheEntry)}
+}
+
+func (c *CacheBase) Stats() CacheStats {
+	c.mu.Lock(); defer c.mu.Unlock()
+	s := c.stats
+	s.Entries = len(c.entries)
+	s.Bytes = c.used
+	for _,e := range c.entries {
+		if e.dirty { s.Dirty++ }
+	}
+	return s
+}
+
+/* Must be called with c.mu held. */
+func (c *CacheBase) writeBack(e *cacheEntry) (err error) {
+	if !e.dirty { return }
+	if e.head {
+		err = c.IBase.HeadWrite(e.id,e.data)
+	} else {
+		err = c.IBase.PageWrite(e.id,e.data)
+	}
+	if err==nil {
+		e.dirty = false
+		c.stats.WriteBacks++
+	}
+	return
+}
+
+/*
+Must be called with c.mu held. Entries, that are loading or pinned, or whose
+write-back fails, are skipped.
+*/
+func (c *CacheBase) evict() {
+	for el := c.lru.Back(); el!=nil && c.used>c.budget; {
+		e := el.Value.(*cacheEntry)
+		el = el.Prev()
+		if e.pins>0 || e.loading!=nil { continue }
+		if c.writeBack(e)!=nil { continue }
+		c.drop(e)
+		c.stats.Evictions++
+	}
+}
+
+/* Must be called with c.mu held. */
+func (c *CacheBase) drop(e *cacheEntry) {
+	c.lru.Remove(e.elem)
+	delete(c.entries,e.cacheKey)
+	c.used -= int64(len(e.data))
+	c.loaded(e)
+}
+
+/* Must be called with c.mu held. Wakes up the readers waiting for e. */
+func (c *CacheBase) loaded(e *cacheEntry) {
+	if e.loading!=nil {
+		close(e.loading)
+		e.loading = nil
+	}
+}
+
+/* Must be called with c.mu held. The caller must call .evict() afterwards. */
+func (c *CacheBase) insert(k cacheKey, data []byte) *cacheEntry {
+	e := &cacheEntry{cacheKey:k,data:data}
+	e.elem = c.lru.PushFront(e)
+	c.entries[k] = e
+	c.used += int64(len(data))
+	return e
+}
+
+/*
+Returns a copy of the entry k, reading it from the underlying IBase on a miss.
+If pin is true, the entry is pinned as well.
+*/
+func (c *CacheBase) read(k cacheKey, pin bool) (bufferex.Binary,error) {
+	c.mu.Lock()
+	e := c.entries[k]
+	for e!=nil && e.loading!=nil {
+		ch := e.loading
+		c.mu.Unlock()
+		<-ch
+		c.mu.Lock()
+		e = c.entries[k]
+	}
+	if e!=nil {
+		c.stats.Hits++
+		if pin { e.pins++ }
+		c.lru.MoveToFront(e.elem)
+		b := bufferex.AllocBinary(len(e.data))
+		copy(b.Bytes(),e.data)
+		c.mu.Unlock()
+		return b,nil
+	}
+	c.stats.Misses++
+	e = c.insert(k,nil)
+	e.loading = make(chan struct{})
+	c.mu.Unlock()
+	
+	var b bufferex.Binary
+	var err error
+	if k.head {
+		b,err = c.IBase.HeadRead(k.id)
+	} else {
+		b,err = c.IBase.PageRead(k.id)
+	}
+	
+	c.mu.Lock()
+	if e.loading==nil {
+		/* A write or free in the meantime has superseded the read. */
+		c.mu.Unlock()
+		if err==nil { b.Free() }
+		return c.read(k,pin)
+	}
+	defer c.mu.Unlock()
+	if err!=nil {
+		c.drop(e)
+		return b,err
+	}
+	e.data = append([]byte(nil),b.Bytes()...)
+	c.used += int64(len(e.data))
+	if pin { e.pins++ }
+	c.loaded(e)
+	c.evict()
+	return b,nil
+}
+
+func (c *CacheBase) write(k cacheKey, b []byte) error {
+	c.mu.Lock(); defer c.mu.Unlock()
+	e := c.entries[k]
+	if e==nil {
+		e = c.insert(k,append([]byte(nil),b...))
+	} else {
+		c.used += int64(len(b)-len(e.data))
+		e.data = append(e.data[:0],b...)
+		c.loaded(e)
+	}
+	e.dirty = true
+	c.lru.MoveToFront(e.elem)
+	c.evict()
+	return nil
+}
+
+func (c *CacheBase) forget(k cacheKey) {
+	c.mu.Lock(); defer c.mu.Unlock()
+	if e := c.entries[k]; e!=nil { c.drop(e) }
+}
+
+/*
+Loads page id into the cache and pins it, so it is not evicted until .Unpin()
+is called as often as .Pin().
+*/
+func (c *CacheBase) Pin(id int64) error {
+	b,err := c.read(cacheKey{id,false},true)
+	if err!=nil { return err }
+	b.Free()
+	return nil
+}
+func (c *CacheBase) Unpin(id int64) {
+	c.mu.Lock(); defer c.mu.Unlock()
+	if e := c.entries[cacheKey{id,false}]; e!=nil && e.pins>0 { e.pins-- }
+}
+
+/* Writes all dirty entries to the underlying IBase. */
+func (c *CacheBase) Flush() error {
+	c.mu.Lock(); defer c.mu.Unlock()
+	var dirty []*cacheEntry
+	for _,e := range c.entries {
+		if e.dirty { dirty = append(dirty,e) }
+	}
+	sort.Slice(dirty,func(i,j int) bool { return dirty[i].id<dirty[j].id })
+	for _,e := range dirty {
+		err := c.writeBack(e)
+		if err!=nil { return err }
+	}
+	return nil
+}
+
+/* Flushes the cache and syncs the underlying IBase, if it supports it. */
+func (c *CacheBase) Sync() error {
+	err := c.Flush()
+	if err!=nil { return err }
+	if s,ok := c.IBase.(interface{ Sync() error }); ok { return s.Sync() }
+	return nil
+}
+
+func (c *CacheBase) PageRead(id int64) (bufferex.Binary,error) { return c.read(cacheKey{id,false},false) }
+func (c *CacheBase) PageWrite(id int64,b []byte) error { return c.write(cacheKey{id,false},b) }
+func (c *CacheBase) PageFree(id int64) error {
+	c.forget(cacheKey{id,false})
+	return c.IBase.PageFree(id)
+}
+func (c *CacheBase) HeadRead(id int64) (bufferex.Binary,error) { return c.read(cacheKey{id,true},false) }
+func (c *CacheBase) HeadWrite(id int64,b []byte) error { return c.write(cacheKey{id,true},b) }
+func (c *CacheBase) HeadFree(id int64) error {
+	c.forget(cacheKey{id,true})
+	return c.IBase.HeadFree(id)
+}
+
+/* Returns the head reserved by the underlying IBase, see CatalogBase. */
+func (c *CacheBase) CatalogHead() (int64,error) {
+	if cb,ok := c.IBase.(CatalogBase); ok { return cb.CatalogHead() }
+	return 0,ENoCatalog
+}
+
+/* Passed through to the underlying IBase, see VacuumBase. */
+func (c *CacheBase) SortFree() error {
+	if vb,ok := c.IBase.(VacuumBase); ok { return vb.SortFree() }
+	return ENoVacuum
+}
+func (c *CacheBase) PageAllocBelow(id int64) (int64,error) {
+	if vb,ok := c.IBase.(VacuumBase); ok { return vb.PageAllocBelow(id) }
+	return 0,ENoVacuum
+}
+func (c *CacheBase) Shrink() (int64,error) {
+	if vb,ok := c.IBase.(VacuumBase); ok { return vb.Shrink() }
+	return 0,ENoVacuum
+}
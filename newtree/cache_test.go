@@ -0,0 +1,230 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+
+
+package newtree_test
+
+import "github.com/maxymania/gonbase/newtree"
+import "github.com/byte-mug/golibs/bufferex"
+import "bytes"
+import "sync"
+import "testing"
+
+/* Blocks the next PageRead between reading and returning, once armed. */
+type blockBase struct{
+	*newtree.MemBase
+	mu      sync.Mutex
+	read    chan struct{}
+	release chan struct{}
+}
+func (b *blockBase) arm() (read,release chan struct{}) {
+	b.mu.Lock(); defer b.mu.Unlock()
+	b.read = make(chan struct{})
+	b.release = make(chan struct{})
+	return b.read,b.release
+}
+func (b *blockBase) PageRead(id int64) (bufferex.Binary,error) {
+	r,err := b.MemBase.PageRead(id)
+	b.mu.Lock()
+	read,release := b.read,b.release
+	b.read,b.release = nil,nil
+	b.mu.Unlock()
+	if read!=nil {
+		close(read)
+		<-release
+	}
+	return r,err
+}
+
+func page(mb *newtree.MemBase, c byte) []byte {
+	return bytes.Repeat([]byte{c},mb.Page())
+}
+
+func pageIs(t *testing.T, b newtree.IBase, id int64, c byte) {
+	t.Helper()
+	r,err := b.PageRead(id)
+	if err!=nil { t.Fatal(err) }
+	defer r.Free()
+	if r.Bytes()[0]!=c { t.Fatalf("page %d: got %q, want %q",id,r.Bytes()[0],c) }
+}
+
+func TestCacheBase(t *testing.T) {
+	mb := newtree.NewMemBase(256)
+	var ids []int64
+	for i := 0; i<8; i++ {
+		id,_ := mb.PageAlloc()
+		mb.PageWrite(id,page(mb,'a'))
+		ids = append(ids,id)
+	}
+	/* Room for four pages. */
+	cb := newtree.NewCacheBase(mb,4*256)
+	
+	pageIs(t,cb,ids[0],'a')
+	pageIs(t,cb,ids[0],'a')
+	if st := cb.Stats(); st.Hits!=1 || st.Misses!=1 || st.Entries!=1 { t.Fatalf("%+v",st) }
+	
+	/* Writes stay in the cache, until they are evicted. */
+	for _,id := range ids[:4] {
+		if err := cb.PageWrite(id,page(mb,'b')); err!=nil { t.Fatal(err) }
+	}
+	pageIs(t,mb,ids[0],'a')
+	if st := cb.Stats(); st.Dirty!=4 || st.Evictions!=0 { t.Fatalf("%+v",st) }
+	for _,id := range ids[4:] { pageIs(t,cb,id,'a') }
+	st := cb.Stats()
+	if st.Evictions!=4 || st.WriteBacks!=4 || st.Dirty!=0 || st.Bytes>4*256 { t.Fatalf("%+v",st) }
+	for _,id := range ids[:4] { pageIs(t,mb,id,'b') }
+	
+	/* Flush writes the dirty entries without evicting them. */
+	for _,id := range ids[4:] { cb.PageWrite(id,page(mb,'c')) }
+	pageIs(t,mb,ids[4],'a')
+	if err := cb.Flush(); err!=nil { t.Fatal(err) }
+	st = cb.Stats()
+	if st.Dirty!=0 || st.Entries!=4 { t.Fatalf("%+v",st) }
+	for _,id := range ids[4:] { pageIs(t,mb,id,'c') }
+	
+	/* Pages and heads with the same id do not mix. */
+	hid,_ := mb.HeadAlloc()
+	if _,err := cb.PageRead(hid); err!=newtree.ENoPage { t.Fatalf("page %d: %v",hid,err) }
+}
+
+func TestCacheBasePin(t *testing.T) {
+	mb := newtree.NewMemBase(256)
+	a,_ := mb.PageAlloc()
+	b,_ := mb.PageAlloc()
+	/* Nothing, but pinned pages, stays in the cache. */
+	cb := newtree.NewCacheBase(mb,0)
+	if err := cb.Pin(a); err!=nil { t.Fatal(err) }
+	cb.PageWrite(a,page(mb,'x'))
+	pageIs(t,cb,b,0)
+	if st := cb.Stats(); st.Entries!=1 || st.Dirty!=1 { t.Fatalf("%+v",st) }
+	pageIs(t,mb,a,0)
+	
+	cb.Unpin(a)
+	pageIs(t,cb,b,0)
+	if st := cb.Stats(); st.Entries!=0 { t.Fatalf("%+v",st) }
+	pageIs(t,mb,a,'x')
+	if err := cb.Pin(b+1); err!=newtree.ENoPage { t.Fatalf("unallocated page: %v",err) }
+}
+
+func TestCacheBaseFailedWriteBack(t *testing.T) {
+	mb := newtree.NewMemBase(256)
+	fail := -1
+	cb := newtree.NewCacheBase(failBase{mb,&fail},256)
+	a,_ := mb.PageAlloc()
+	b,_ := mb.PageAlloc()
+	cb.PageWrite(a,page(mb,'x'))
+	
+	/* The write back of a fails, but the write of b succeeds, and b is evicted instead. */
+	fail = 1
+	if err := cb.PageWrite(b,page(mb,'y')); err!=nil { t.Fatal(err) }
+	if st := cb.Stats(); st.Dirty!=1 || st.Evictions!=1 { t.Fatalf("%+v",st) }
+	pageIs(t,mb,a,0)
+	pageIs(t,mb,b,'y')
+	pageIs(t,cb,a,'x')
+	
+	fail = 1
+	if err := cb.Flush(); err!=errCrash { t.Fatalf("flush: %v",err) }
+	fail = -1
+	if err := cb.Flush(); err!=nil { t.Fatal(err) }
+	pageIs(t,mb,a,'x')
+	pageIs(t,mb,b,'y')
+}
+
+func TestCacheBaseReadRace(t *testing.T) {
+	bb := &blockBase{MemBase:newtree.NewMemBase(256)}
+	mb := bb.MemBase
+	cb := newtree.NewCacheBase(bb,256)
+	a,_ := mb.PageAlloc()
+	b,_ := mb.PageAlloc()
+	mb.PageWrite(a,page(mb,'a'))
+	
+	/* A write, that is evicted, while a is read. */
+	read,release := bb.arm()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r,err := cb.PageRead(a)
+		if err==nil { r.Free() }
+	}()
+	<-read
+	if err := cb.PageWrite(a,page(mb,'b')); err!=nil { t.Fatal(err) }
+	if err := cb.PageWrite(b,page(mb,'x')); err!=nil { t.Fatal(err) }
+	close(release)
+	<-done
+	pageIs(t,cb,a,'b')
+	pageIs(t,mb,a,'b')
+	
+	/* A free, while a is read. */
+	cb.Flush()
+	read,release = bb.arm()
+	done = make(chan struct{})
+	go func() {
+		defer close(done)
+		r,err := cb.PageRead(b)
+		if err==nil { r.Free() }
+	}()
+	<-read
+	if err := cb.PageFree(b); err!=nil { t.Fatal(err) }
+	close(release)
+	<-done
+	if _,err := cb.PageRead(b); err!=newtree.ENoPage { t.Fatalf("freed page: %v",err) }
+}
+
+func TestCacheBaseConcurrent(t *testing.T) {
+	mb := newtree.NewMemBase(256)
+	var ids []int64
+	for i := 0; i<16; i++ {
+		id,_ := mb.PageAlloc()
+		ids = append(ids,id)
+	}
+	cb := newtree.NewCacheBase(mb,4*256)
+	
+	/* Each page has a single writer, that counts up; readers never see a value go back. */
+	var wg sync.WaitGroup
+	for _,id := range ids {
+		wg.Add(2)
+		go func(id int64) {
+			defer wg.Done()
+			for c := 1; c<100; c++ {
+				if err := cb.PageWrite(id,page(mb,byte(c))); err!=nil { t.Error(err); return }
+			}
+		}(id)
+		go func(id int64) {
+			defer wg.Done()
+			last := byte(0)
+			for i := 0; i<200; i++ {
+				r,err := cb.PageRead(id)
+				if err!=nil { t.Error(err); return }
+				c := r.Bytes()[0]
+				r.Free()
+				if c<last { t.Errorf("page %d: %d after %d",id,c,last); return }
+				last = c
+			}
+		}(id)
+	}
+	wg.Wait()
+	if err := cb.Flush(); err!=nil { t.Fatal(err) }
+	for _,id := range ids { pageIs(t,mb,id,99) }
+}
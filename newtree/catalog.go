@@ -0,0 +1,303 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+package newtree
+
+import "context"
+import "errors"
+import "bytes"
+import "sort"
+import "sync"
+
+var ENoCatalog = errors.New("ENoCatalog")
+var ECatalogExists = errors.New("ECatalogExists")
+var ECatalogNotFound = errors.New("ECatalogNotFound")
+var ECatalogName = errors.New("ECatalogName")
+var EUnknownOps = errors.New("EUnknownOps")
+
+/*
+An IBase, that reserves a head for the Catalog. The reserved head is never
+returned by HeadAlloc().
+*/
+type CatalogBase interface{
+	IBase
+	CatalogHead() (int64,error)
+}
+
+/*
+The keys of the catalog tree. Leaf entries and union keys start with a kind byte:
+
+	catEntry: uint16 len | name | int64 head | uint16 len | ops name
+	catRange: uint16 len | lowest name | uint16 len | highest name
+*/
+const (
+	catEntry = 1
+	catRange = 2
+)
+
+func catString(b []byte) ([]byte,[]byte) {
+	if len(b)<2 { return nil,nil }
+	n := int(frm.Uint16(b))
+	if n>len(b)-2 { return nil,nil }
+	return b[2:2+n],b[2+n:]
+}
+
+/* Returns the lowest and highest name of a key. */
+func catBounds(p []byte) (low,high []byte) {
+	if len(p)==0 { return }
+	switch p[0] {
+	case catEntry:
+		low,_ = catString(p[1:])
+		high = low
+	case catRange:
+		var rest []byte
+		low,rest = catString(p[1:])
+		high,_ = catString(rest)
+	}
+	return
+}
+
+func catEncode(e CatalogEntry) []byte {
+	b := make([]byte,1+2+len(e.Name)+8+2+len(e.Ops))
+	b[0] = catEntry
+	frm.PutUint16(b[1:],uint16(len(e.Name)))
+	n := 3+copy(b[3:],e.Name)
+	frm.PutUint64(b[n:],uint64(e.Root))
+	frm.PutUint16(b[n+8:],uint16(len(e.Ops)))
+	copy(b[n+10:],e.Ops)
+	return b
+}
+func catDecode(p []byte) (e CatalogEntry, ok bool) {
+	if len(p)==0 || p[0]!=catEntry { return }
+	name,rest := catString(p[1:])
+	if len(rest)<10 { return }
+	e.Name = string(name)
+	e.Root = int64(frm.Uint64(rest))
+	ops,_ := catString(rest[8:])
+	e.Ops = string(ops)
+	return e,true
+}
+
+/* TreeOps of the catalog tree. Queries are either a name (string) or nil (all). */
+type catalogOps struct{}
+
+func (catalogOps) Consistent(p []byte, q interface{}) bool {
+	if q==nil { return true }
+	name := []byte(q.(string))
+	low,high := catBounds(p)
+	return bytes.Compare(low,name)<=0 && bytes.Compare(name,high)<=0
+}
+func (catalogOps) Union(P Elements) []byte {
+	var low,high []byte
+	for i,e := range P {
+		l,h := catBounds(e.Val)
+		if i==0 || bytes.Compare(l,low)<0 { low = l }
+		if i==0 || bytes.Compare(h,high)>0 { high = h }
+	}
+	b := make([]byte,1+2+len(low)+2+len(high))
+	b[0] = catRange
+	frm.PutUint16(b[1:],uint16(len(low)))
+	n := 3+copy(b[3:],low)
+	frm.PutUint16(b[n:],uint16(len(high)))
+	copy(b[n+2:],high)
+	return b
+}
+func (catalogOps) Overlap(p,q []byte) bool {
+	pl,ph := catBounds(p)
+	ql,qh := catBounds(q)
+	return bytes.Compare(pl,qh)<=0 && bytes.Compare(ql,ph)<=0
+}
+func commonPrefix(a,b []byte) (i int) {
+	for i<len(a) && i<len(b) && a[i]==b[i] { i++ }
+	return
+}
+func (catalogOps) Penalty(E1,E2 []byte) float64 {
+	low,high := catBounds(E1)
+	name,_ := catBounds(E2)
+	if bytes.Compare(low,name)<=0 && bytes.Compare(name,high)<=0 { return 0 }
+	c := commonPrefix(low,name)
+	if d := commonPrefix(high,name); d>c { c = d }
+	return 1/float64(1+c)
+}
+func (catalogOps) FirstSplit(P Elements,maxsize int) (Elements,Elements) {
+	if P.Length()<=maxsize { return P,nil }
+	z,half := 4,P.Length()>>1
+	for i,e := range P {
+		if z>half || z+e.Length()>maxsize {
+			if i==0 { i = 1 }
+			return P[:i],P[i:]
+		}
+		z += e.Length()
+	}
+	return P,nil
+}
+func (catalogOps) Sort(E Elements) {
+	sort.SliceStable(E,func(i,j int) bool {
+		a,_ := catBounds(E[i].Val)
+		b,_ := catBounds(E[j].Val)
+		return bytes.Compare(a,b)<0
+	})
+}
+
+/* -------------------------------------------------------------------------------- */
+
+type CatalogEntry struct{
+	Name string
+	Ops  string // The name, the TreeOps are registered under. See RegisterOps().
+	Root int64  // The head of the tree.
+}
+
+/*
+A set of named trees within one IBase. The catalog itself is a tree, that maps
+the names to the heads of the trees, and to the names of their TreeOps. Each
+entry has a Tree of its own, which is returned by Create() and Open().
+
+Create() and Drop() are not atomic, unless the IBase is an AtomicBase and both
+steps are made within one operation: a crash between them may leak the head
+of a new tree or the pages of a dropped one, but never leaves an entry without
+its tree.
+*/
+type Catalog struct{
+	base IBase
+	head int64
+	
+	// If true, the Trees returned by the Catalog use CopyOnWrite. It must be
+	// set before the Catalog is used.
+	CopyOnWrite bool
+	
+	ddl   sync.Mutex
+	mu    sync.Mutex
+	trees map[string]*Tree
+}
+
+/* Opens the catalog in the head reserved by base (see CatalogBase). */
+func OpenCatalog(base IBase) (*Catalog,error) {
+	cb,ok := base.(CatalogBase)
+	if !ok { return nil,ENoCatalog }
+	head,err := cb.CatalogHead()
+	if err!=nil { return nil,err }
+	return OpenCatalogAt(base,head),nil
+}
+
+/* Opens the catalog stored in the tree head (see Tree.NewRoot()). */
+func OpenCatalogAt(base IBase, head int64) *Catalog {
+	return &Catalog{base:base,head:head,trees:make(map[string]*Tree)}
+}
+
+/*
+Returns the Tree of the entry name. Each entry has a Tree of its own, so that
+writes to different trees are not serialized by one Tree.
+*/
+func (c *Catalog) tree(name, opsName string, ops TreeOps) *Tree {
+	c.mu.Lock(); defer c.mu.Unlock()
+	t := c.trees[name]
+	if t==nil {
+		t = &Tree{IBase:c.base,Ops:ops,OpsName:opsName,CopyOnWrite:c.CopyOnWrite}
+		c.trees[name] = t
+	}
+	return t
+}
+func (c *Catalog) catalog() *Tree {
+	/* The registry can't contain the empty name, so it is used for the catalog. */
+	return c.tree("","",catalogOps{})
+}
+func (c *Catalog) entryTree(e CatalogEntry) (*Tree,error) {
+	ops,ok := LookupOps(e.Ops)
+	if !ok { return nil,EUnknownOps }
+	return c.tree(e.Name,e.Ops,ops),nil
+}
+
+func (c *Catalog) lookup(name string) (e CatalogEntry, ok bool, err error) {
+	err = c.catalog().Search(context.Background(),c.head,name,func(p []byte) {
+		if ok { return }
+		e,ok = catDecode(p)
+		ok = ok && e.Name==name
+	})
+	return
+}
+
+/*
+Creates the tree name using the TreeOps registered under ops. Returns the Tree
+and the head of the new tree.
+*/
+func (c *Catalog) Create(name, ops string) (*Tree,int64,error) {
+	if name=="" || len(name)>0xffff || len(ops)>0xffff { return nil,0,ECatalogName }
+	e := CatalogEntry{name,ops,0}
+	t,err := c.entryTree(e)
+	if err!=nil { return nil,0,err }
+	c.ddl.Lock(); defer c.ddl.Unlock()
+	_,ok,err := c.lookup(name)
+	if err!=nil { return nil,0,err }
+	if ok { return nil,0,ECatalogExists }
+	e.Root,err = t.NewRoot()
+	if err!=nil { return nil,0,err }
+	err = c.catalog().Insert(c.head,catEncode(e))
+	if err!=nil { return nil,0,err }
+	return t,e.Root,nil
+}
+
+/* Returns the Tree and the head of the tree name. */
+func (c *Catalog) Open(name string) (*Tree,int64,error) {
+	e,ok,err := c.lookup(name)
+	if err!=nil { return nil,0,err }
+	if !ok { return nil,0,ECatalogNotFound }
+	t,err := c.entryTree(e)
+	if err!=nil { return nil,0,err }
+	return t,e.Root,nil
+}
+
+/*
+Removes the tree name from the catalog and frees all its pages. The tree must
+not be used anymore (see Tree.Drop()).
+*/
+func (c *Catalog) Drop(name string) error {
+	c.ddl.Lock(); defer c.ddl.Unlock()
+	e,ok,err := c.lookup(name)
+	if err!=nil { return err }
+	if !ok { return ECatalogNotFound }
+	_,err = c.catalog().Delete(context.Background(),c.head,name,func(p []byte) bool {
+		d,ok := catDecode(p)
+		return ok && d.Name==name
+	})
+	if err!=nil { return err }
+	
+	/* Tree.Drop() doesn't use the TreeOps, but it must be serialized with the users of the tree. */
+	t,err := c.entryTree(e)
+	if err!=nil { t = c.catalog() }
+	err = t.Drop(e.Root)
+	c.mu.Lock()
+	delete(c.trees,name)
+	c.mu.Unlock()
+	return err
+}
+
+/* Returns all entries of the catalog, sorted by name. */
+func (c *Catalog) List(ctx context.Context) ([]CatalogEntry,error) {
+	var list []CatalogEntry
+	err := c.catalog().Search(ctx,c.head,nil,func(p []byte) {
+		if e,ok := catDecode(p); ok { list = append(list,e) }
+	})
+	sort.Slice(list,func(i,j int) bool { return list[i].Name<list[j].Name })
+	return list,err
+}
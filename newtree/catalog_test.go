@@ -0,0 +1,107 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+
+
+package newtree_test
+
+import "github.com/maxymania/gonbase/newtree"
+import "context"
+import "reflect"
+import "strings"
+import "testing"
+
+/* The name, IntervalOps are registered under. */
+const ivOps = "ntops.IntervalOps"
+
+func TestCatalog(t *testing.T) {
+	mb := newtree.NewMemBase(256)
+	c,err := newtree.OpenCatalog(mb)
+	if err!=nil { t.Fatal(err) }
+	
+	if _,_,err = c.Create("",ivOps); err!=newtree.ECatalogName { t.Fatal(err) }
+	if _,_,err = c.Create(strings.Repeat("x",0x10000),ivOps); err!=newtree.ECatalogName { t.Fatal(err) }
+	if _,_,err = c.Create("x",strings.Repeat("x",0x10000)); err!=newtree.ECatalogName { t.Fatal(err) }
+	if _,_,err = c.Create("x","no.Ops"); err!=newtree.EUnknownOps { t.Fatal(err) }
+	
+	/* Enough trees to split the catalog. */
+	var want []newtree.CatalogEntry
+	trees := make(map[string]*newtree.Tree)
+	for i := 0; i<40; i++ {
+		name := strings.Repeat("t",i%5+1)+string(rune('a'+i%26))+string(rune('0'+i/26))
+		tr,obj,err := c.Create(name,ivOps)
+		if err!=nil { t.Fatal(err) }
+		insertRange(t,tr,obj,0,int64(i))
+		want = append(want,newtree.CatalogEntry{name,ivOps,obj})
+		trees[name] = tr
+	}
+	if _,_,err = c.Create(want[3].Name,ivOps); err!=newtree.ECatalogExists { t.Fatal(err) }
+	
+	list,err := c.List(context.Background())
+	if err!=nil { t.Fatal(err) }
+	if len(list)!=len(want) { t.Fatalf("%d entries, want %d",len(list),len(want)) }
+	for i := 1; i<len(list); i++ {
+		if list[i-1].Name>=list[i].Name { t.Fatalf("%q before %q",list[i-1].Name,list[i].Name) }
+	}
+	
+	/* The trees are found by name, each with a Tree of its own. */
+	for i,e := range want {
+		tr,obj,err := c.Open(e.Name)
+		if err!=nil { t.Fatal(err) }
+		if obj!=e.Root || tr!=trees[e.Name] { t.Fatalf("%q: head %d, want %d",e.Name,obj,e.Root) }
+		if got := keys(t,tr,obj,all); len(got)!=i { t.Fatalf("%q: %d keys, want %d",e.Name,len(got),i) }
+	}
+	if trees[want[0].Name]==trees[want[1].Name] { t.Fatal("two entries share a Tree") }
+	if _,_,err = c.Open("none"); err!=newtree.ECatalogNotFound { t.Fatal(err) }
+	
+	/* Reopening the catalog finds the same entries. */
+	c,err = newtree.OpenCatalog(mb)
+	if err!=nil { t.Fatal(err) }
+	again,err := c.List(context.Background())
+	if err!=nil || !reflect.DeepEqual(again,list) { t.Fatal(err) }
+}
+
+/* Drop frees the pages and the head of a tree. */
+func TestCatalogDrop(t *testing.T) {
+	mb := newtree.NewMemBase(256)
+	c,err := newtree.OpenCatalog(mb)
+	if err!=nil { t.Fatal(err) }
+	if _,_,err = c.Create("a",ivOps); err!=nil { t.Fatal(err) }
+	st := mb.Stats()
+	
+	tr,obj,err := c.Create("b",ivOps)
+	if err!=nil { t.Fatal(err) }
+	insertRange(t,tr,obj,0,300)
+	if err = tr.Insert(obj,bigElem(1000,2000)); err!=nil { t.Fatal(err) }
+	if err = c.Drop("b"); err!=nil { t.Fatal(err) }
+	if err = c.Drop("b"); err!=newtree.ECatalogNotFound { t.Fatal(err) }
+	if n := mb.Stats(); n.Pages!=st.Pages || n.Heads!=st.Heads { t.Fatalf("%d pages and %d heads, want %d and %d",n.Pages,n.Heads,st.Pages,st.Heads) }
+	
+	/* The name can be used again, with a new Tree. */
+	tr2,_,err := c.Create("b",ivOps)
+	if err!=nil { t.Fatal(err) }
+	if tr2==tr { t.Fatal("the Tree of the dropped entry is reused") }
+	list,err := c.List(context.Background())
+	if err!=nil || len(list)!=2 { t.Fatal(list,err) }
+}
@@ -27,34 +27,75 @@ import "errors"
 import "fmt"
 import "bytes"
 import "sync"
+import "hash/crc32"
 var EShort = errors.New("Too short")
 
+/*
+If Ovf is not 0, the value is stored in a chain of overflow pages starting at
+page Ovf, and only a prefix of it is stored inline. After decoding, Val is the
+inline prefix, until the value is resolved (see Tree.resolveElement()).
+
+Encoding: uint32 len | Val | int64 Ptr
+Overflow: uint32 len|ovfFlag | Val[:len] | int64 Ptr | int64 Ovf
+*/
 type Element struct{
 	Val []byte
 	Ptr int64
+	Ovf int64
 	Tmp interface{}
 }
+
+const ovfFlag = 0x80000000
+const ovfPrefix = 16
+
 func (e *Element) clear() { e.Tmp = nil }
-func (e *Element) cleanse() { e.Tmp = nil; e.Ptr = 0 }
-func (e Element) Length() int { return len(e.Val)+12 }
+func (e *Element) cleanse() { e.Tmp = nil; e.Ptr = 0; e.Ovf = 0 }
+func (e Element) Length() int {
+	if e.Ovf!=0 { return len(e.prefix())+20 }
+	return len(e.Val)+12
+}
+func (e Element) prefix() []byte {
+	if len(e.Val)>ovfPrefix { return e.Val[:ovfPrefix] }
+	return e.Val
+}
 func (e *Element) BinDecode(b []byte) ([]byte,error) {
 	if len(b)<4 { return nil,EShort }
 	l := frm.Uint32(b)
+	e.Tmp = nil
+	e.Ovf = 0
+	if (l&ovfFlag)!=0 {
+		l &^= ovfFlag
+		if len(b)<(int(l)+20) { return nil,EShort }
+		e.Val = b[4:l+4]
+		e.Ptr = int64(frm.Uint64(b[l+4:]))
+		e.Ovf = int64(frm.Uint64(b[l+12:]))
+		return b[l+20:],nil
+	}
 	if len(b)<(int(l)+12) { return nil,EShort }
 	e.Val = b[4:l+4]
 	e.Ptr = int64(frm.Uint64(b[l+4:]))
-	e.Tmp = nil
 	return b[l+12:],nil
 }
 func (e Element) BinEncode(b []byte) (int,error) {
-	lng := len(e.Val)+12
+	lng := e.Length()
 	if lng > len(b) { return 0,EShort }
+	if e.Ovf!=0 {
+		p := e.prefix()
+		frm.PutUint32(b,uint32(len(p))|ovfFlag)
+		copy(b[4:],p)
+		frm.PutUint64(b[lng-16:],uint64(e.Ptr))
+		frm.PutUint64(b[lng-8:],uint64(e.Ovf))
+		return lng,nil
+	}
 	frm.PutUint32(b,uint32(len(e.Val)))
 	copy(b[4:],e.Val)
 	frm.PutUint64(b[lng-8:],uint64(e.Ptr))
 	return lng,nil
 }
-func (e Element) String() string { return fmt.Sprintf("{%q %d}",e.Val,e.Ptr) }
+func (e Element) String() string {
+	if e.Ovf!=0 { return fmt.Sprintf("{%q %d ovf:%d}",e.prefix(),e.Ptr,e.Ovf) }
+	return fmt.Sprintf("{%q %d}",e.Val,e.Ptr)
+}
 
 type Elements []Element
 func (e Elements) clear() {
@@ -82,6 +123,7 @@ func (e *Elements) resize32(l uint32) {
 func (e *Elements) BinDecode(b []byte) ([]byte,error) {
 	if len(b)<4 { return nil,EShort }
 	l := frm.Uint32(b)
+	if uint64(l)*12 > uint64(len(b)-4) { return nil,EShort }
 	e.resize32(l)
 	b = b[4:]
 	var err error
@@ -120,20 +162,46 @@ func (e Elements) String() string {
 	return buf.String()
 }
 
+const rootMarker = 1<<31
+
+/*
+The Root of a tree, stored in a head.
+
+	[0:8]   Ptr
+	[8:12]  Depth, with the highest bit set (rootMarker)
+	[12:14] Version
+	[14:16] lower 16 bits of the CRC32C of [0:14]
+
+Legacy heads have no Version and random bytes in [12:16]. Their Depth never
+has the highest bit set, so they are read with Version 0. A head with the
+marker, that fails the check, is corrupt.
+*/
 type Root struct{
 	Ptr    int64
 	Depth uint32
+	
+	// The format version of the pages of the tree. 0 means, that the tree may
+	// contain legacy pages. See Tree.Migrate().
+	Version uint16
 }
 func (r *Root) BinDecode(b []byte) error {
 	if len(b)<16 { return EShort }
 	r.Ptr = int64(frm.Uint64(b))
 	r.Depth = frm.Uint32(b[8:])
+	r.Version = 0
+	if r.Depth&rootMarker==0 { return nil }
+	if frm.Uint16(b[14:])!=uint16(crc32.Checksum(b[:14],crcTable)) { return ECorrupt }
+	r.Depth &^= rootMarker
+	r.Version = frm.Uint16(b[12:])
+	if r.Version>FormatVersion { return EVersion }
 	return  nil
 }
 func (r Root) BinEncode(b []byte) error {
 	if len(b)<16 { return EShort }
 	frm.PutUint64(b,uint64(r.Ptr))
-	frm.PutUint32(b[8:],r.Depth)
+	frm.PutUint32(b[8:],r.Depth|rootMarker)
+	frm.PutUint16(b[12:],r.Version)
+	frm.PutUint16(b[14:],uint16(crc32.Checksum(b[:14],crcTable)))
 	return  nil
 }
 
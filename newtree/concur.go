@@ -0,0 +1,329 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+package newtree
+
+import "github.com/byte-mug/golibs/bufferex"
+import "sync"
+
+/*
+Concurrency control.
+
+Writers (.Insert(), .Delete(), .BulkLoad() ...) are serialized per Tree, but
+readers (.Search(), .GSearch(), Cursors ...) run concurrently with them and
+with each other.
+
+Every page-write is performed under a page-latch and is stamped with a sequence
+number (the LSN of the page). If a write moves elements out of a page into new
+pages (a split), the new pages are recorded in a split-log under the same
+sequence number (the NSN of the split). The new pages are written before the
+split becomes visible and the parent is updated after it.
+
+A reader remembers the LSN of the parent page it got a pointer from. If a
+split of the child has an NSN greater than that LSN, the reader saw the parent
+before it was updated, and additionally visits the new pages. This is similar
+to the right-links of the B-link tree and the NSN-approach of GiST-trees in
+PostgreSQL, except that the split-log is kept in memory only.
+
+Pages freed by writers are not released while readers, that started earlier,
+are still active, so a reader never sees a page being reused.
+*/
+type concurrency struct{
+	writer sync.Mutex
+	
+	mu      sync.Mutex
+	seq     uint64
+	stable  uint64
+	latches map[int64]*latch
+	lsn     map[int64]uint64
+	splits  map[int64][]splitRec
+	readers map[uint64]int
+	freed   []freedPage
+}
+
+type latch struct{
+	sync.RWMutex
+	refs int
+}
+
+type splitRec struct{
+	nsn   uint64
+	pages []int64
+}
+
+type freedPage struct{
+	id  int64
+	seq uint64
+}
+
+func (c *concurrency) latch(id int64) *latch {
+	c.mu.Lock(); defer c.mu.Unlock()
+	if c.latches==nil { c.latches = make(map[int64]*latch) }
+	l := c.latches[id]
+	if l==nil {
+		l = new(latch)
+		c.latches[id] = l
+	}
+	l.refs++
+	return l
+}
+func (c *concurrency) unlatch(id int64,l *latch) {
+	c.mu.Lock(); defer c.mu.Unlock()
+	l.refs--
+	if l.refs==0 { delete(c.latches,id) }
+}
+
+/* Must be called with c.mu held. */
+func (c *concurrency) stamp(id int64, moved []int64) {
+	c.seq++
+	if c.lsn==nil { c.lsn = make(map[int64]uint64) }
+	c.lsn[id] = c.seq
+	if len(moved)==0 { return }
+	if c.splits==nil { c.splits = make(map[int64][]splitRec) }
+	c.splits[id] = append(c.splits[id],splitRec{c.seq,moved})
+}
+
+/* Must be called with c.mu held. */
+func (c *concurrency) threshold() uint64 {
+	min := c.stable
+	for s := range c.readers {
+		if min > s { min = s }
+	}
+	return min
+}
+
+/*
+Removes all split-log entries and LSNs, that no active reader can depend on,
+and returns the freed pages, that are safe to release.
+
+Must be called with c.mu held.
+*/
+func (c *concurrency) gc() (rel []int64) {
+	th := c.threshold()
+	for id,l := range c.lsn {
+		if l<=th { delete(c.lsn,id) }
+	}
+	for id,recs := range c.splits {
+		i := 0
+		for _,r := range recs {
+			if r.nsn>th { recs[i] = r; i++ }
+		}
+		if i==0 {
+			delete(c.splits,id)
+		} else {
+			c.splits[id] = recs[:i]
+		}
+	}
+	i := 0
+	for _,f := range c.freed {
+		if f.seq<=th {
+			rel = append(rel,f.id)
+			delete(c.lsn,f.id)
+			delete(c.splits,f.id)
+		} else {
+			c.freed[i] = f
+			i++
+		}
+	}
+	for j := range c.freed[i:] { c.freed[i+j] = freedPage{} }
+	c.freed = c.freed[:i]
+	return
+}
+
+/*
+Forgets the LSNs, split-log entries and freed pages of a failed operation,
+whose writes were discarded by the AtomicBase.
+
+Must be called with c.mu held.
+*/
+func (c *concurrency) rollback() {
+	s := c.stable
+	for id,l := range c.lsn {
+		if l>s { c.lsn[id] = s }
+	}
+	for id,recs := range c.splits {
+		i := 0
+		for _,r := range recs {
+			if r.nsn<=s { recs[i] = r; i++ }
+		}
+		if i==0 {
+			delete(c.splits,id)
+		} else {
+			c.splits[id] = recs[:i]
+		}
+	}
+	i := 0
+	for _,f := range c.freed {
+		if f.seq<=s { c.freed[i] = f; i++ }
+	}
+	for j := range c.freed[i:] { c.freed[i+j] = freedPage{} }
+	c.freed = c.freed[:i]
+	c.stable = c.seq
+}
+
+/* -------------------------------------------------------------------------------- */
+
+/*
+Starts a writing operation. If the IBase is an AtomicBase, the operation is
+enclosed in OpBegin() and OpEnd(), and if it fails, it is rolled back.
+*/
+func (t *Tree) beginWrite() error {
+	t.cc.writer.Lock()
+	if ab,ok := t.IBase.(AtomicBase); ok {
+		err := ab.OpBegin()
+		if err!=nil { t.cc.writer.Unlock() }
+		return err
+	}
+	return nil
+}
+func (t *Tree) endWrite(err *error) {
+	ab,atomic := t.IBase.(AtomicBase)
+	rel := t.settle(atomic && *err!=nil)
+	for _,id := range rel {
+		e := t.PageFree(id)
+		if *err==nil { *err = e }
+	}
+	if atomic {
+		e := ab.OpEnd(*err==nil)
+		if *err==nil { *err = e }
+	}
+	t.cc.writer.Unlock()
+}
+
+/*
+Makes the writes of the current operation visible to new readers, or forgets
+them, if it failed. Returns the freed pages, that are safe to release.
+*/
+func (t *Tree) settle(failed bool) (rel []int64) {
+	t.cc.mu.Lock(); defer t.cc.mu.Unlock()
+	if failed {
+		t.cc.rollback()
+	} else {
+		t.cc.stable = t.cc.seq
+		rel = t.cc.gc()
+	}
+	return
+}
+
+/* Defers the release of a page, until no reader can reach it anymore. */
+func (t *Tree) freePage(id int64) error {
+	t.cc.mu.Lock(); defer t.cc.mu.Unlock()
+	t.cc.seq++
+	t.cc.freed = append(t.cc.freed,freedPage{id,t.cc.seq})
+	return nil
+}
+
+func (t *Tree) writeLatched(id int64, b []byte, moved []int64) error {
+	l := t.cc.latch(id)
+	l.Lock()
+	err := t.PageWrite(id,b)
+	if err==nil {
+		t.cc.mu.Lock()
+		t.cc.stamp(id,moved)
+		t.cc.mu.Unlock()
+	}
+	l.Unlock()
+	t.cc.unlatch(id,l)
+	return err
+}
+func (t *Tree) writeHeadLatched(id int64, b []byte) error {
+	l := t.cc.latch(id)
+	l.Lock()
+	err := t.HeadWrite(id,b)
+	if err==nil {
+		t.cc.mu.Lock()
+		t.cc.stamp(id,nil)
+		t.cc.mu.Unlock()
+	}
+	l.Unlock()
+	t.cc.unlatch(id,l)
+	return err
+}
+
+/* -------------------------------------------------------------------------------- */
+
+func (t *Tree) beginRead() uint64 {
+	t.cc.mu.Lock(); defer t.cc.mu.Unlock()
+	return t.cc.register(t.cc.stable)
+}
+
+/* Registers a reader, that is allowed to reach the same pages as reader s. */
+func (t *Tree) beginReadAt(s uint64) uint64 {
+	t.cc.mu.Lock(); defer t.cc.mu.Unlock()
+	return t.cc.register(s)
+}
+
+/* Must be called with c.mu held. */
+func (c *concurrency) register(s uint64) uint64 {
+	if c.readers==nil { c.readers = make(map[uint64]int) }
+	c.readers[s]++
+	return s
+}
+func (t *Tree) endRead(s uint64) {
+	t.cc.mu.Lock(); defer t.cc.mu.Unlock()
+	t.cc.readers[s]--
+	if t.cc.readers[s]==0 { delete(t.cc.readers,s) }
+}
+
+/*
+Reads page id for a reader. Overflowed values are not resolved, the reader
+resolves the elements, it visits (see .resolveElement()).
+*/
+func (t *Tree) readPage(id int64, ver uint16) (b bufferex.Binary, e Elements, lsn uint64, err error) {
+	l := t.cc.latch(id)
+	l.RLock()
+	b,e,_,err = t.rawNode(id,ver)
+	t.cc.mu.Lock()
+	lsn = t.cc.lsn[id]
+	t.cc.mu.Unlock()
+	l.RUnlock()
+	t.cc.unlatch(id,l)
+	return
+}
+func (t *Tree) readRoot(obj int64) (rr Root, lsn uint64, err error) {
+	l := t.cc.latch(obj)
+	l.RLock()
+	rr,err = t.getRoot(obj)
+	t.cc.mu.Lock()
+	lsn = t.cc.lsn[obj]
+	t.cc.mu.Unlock()
+	l.RUnlock()
+	t.cc.unlatch(obj,l)
+	return
+}
+
+/*
+Returns the pages, elements of page id were moved into, after the parent was
+read (plsn) but before page id was read (lsn).
+*/
+func (t *Tree) movedFrom(id int64, plsn, lsn uint64) (pages []int64) {
+	t.cc.mu.Lock(); defer t.cc.mu.Unlock()
+	for _,r := range t.cc.splits[id] {
+		if plsn < r.nsn && r.nsn <= lsn {
+			pages = append(pages,r.pages...)
+		}
+	}
+	return
+}
+
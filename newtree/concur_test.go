@@ -0,0 +1,143 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+package newtree_test
+
+import "github.com/maxymania/gonbase/newtree"
+import "github.com/maxymania/gonbase/ntops"
+import "context"
+import "fmt"
+import "sync"
+import "testing"
+
+/*
+Runs inserts and deletes on two writers, while readers search and iterate.
+Keys below stable are never deleted, so every reader must see each of them
+exactly once. Keys are inserted only once, so no reader may see a key twice.
+Run with -race.
+*/
+func TestConcurrentStress(t *testing.T) {
+	for _,cow := range []bool{false,true} {
+		t.Run(fmt.Sprint("cow=",cow),func(t *testing.T) { concurrentStress(t,cow) })
+	}
+}
+
+func concurrentStress(t *testing.T, cow bool) {
+	const stable, total = 500, 2500
+	ctx := context.Background()
+	mb := newtree.NewMemBase(256)
+	tr := ivTree(mb)
+	tr.CopyOnWrite = cow
+	obj,_ := tr.NewRoot()
+	insertRange(t,tr,obj,0,stable)
+	
+	var writers, readers sync.WaitGroup
+	done := make(chan struct{})
+	errs := make(chan error,16)
+	
+	/* Inserts stable..total. */
+	writers.Add(1)
+	go func() {
+		defer writers.Done()
+		for k := int64(stable); k<total; k++ {
+			if err := tr.Insert(obj,ivElem(k)); err!=nil { errs <- err; return }
+		}
+	}()
+	/* Deletes the odd keys above stable, in blocks. */
+	writers.Add(1)
+	go func() {
+		defer writers.Done()
+		for lo := int64(stable); lo<total; lo += 50 {
+			hi := lo+49
+			_,err := tr.Delete(ctx,obj,ntops.IntervalOverlap[int64]{Low:lo,High:hi},func(b []byte) bool {
+				k := ivKey(t,b)
+				return k>=lo && k<=hi && k%2==1
+			})
+			if err!=nil { errs <- err; return }
+		}
+	}()
+	
+	check := func(seen map[int64]int) error {
+		for k,n := range seen {
+			if n>1 { return fmt.Errorf("key %d seen %d times",k,n) }
+		}
+		for k := int64(0); k<stable; k++ {
+			if seen[k]!=1 { return fmt.Errorf("stable key %d missing",k) }
+		}
+		return nil
+	}
+	for i := 0; i<4; i++ {
+		readers.Add(1)
+		go func(i int) {
+			defer readers.Done()
+			for {
+				select {
+				case <-done: return
+				default:
+				}
+				seen := make(map[int64]int)
+				var err error
+				if i%2==0 {
+					err = tr.Search(ctx,obj,all,func(b []byte) { seen[ivKey(t,b)]++ })
+				} else {
+					var c *newtree.Cursor
+					c,err = tr.Cursor(ctx,obj,all)
+					if err==nil {
+						for c.Next() { seen[ivKey(t,c.Value())]++ }
+						err = c.Err()
+						c.Close()
+					}
+				}
+				if err==nil { err = check(seen) }
+				if err!=nil { errs <- err; return }
+			}
+		}(i)
+	}
+	
+	writers.Wait()
+	close(done)
+	readers.Wait()
+	close(errs)
+	for err := range errs { t.Fatal(err) }
+	
+	/* Odd keys of blocks deleted before they were inserted may remain. */
+	got := keys(t,tr,obj,all)
+	have := make(map[int64]bool)
+	for i,k := range got {
+		if i>0 && got[i-1]==k { t.Fatal("duplicate",k) }
+		have[k] = true
+	}
+	for k := int64(0); k<total; k++ {
+		if (k<stable || k%2==0) && !have[k] { t.Fatal("missing",k) }
+	}
+	/* Delete the rest, now without concurrency, and check for leaks. */
+	_,err := tr.Delete(ctx,obj,all,func(b []byte) bool { k := ivKey(t,b); return k>=stable && k%2==1 })
+	if err!=nil { t.Fatal(err) }
+	verify(t,tr,obj)
+	if err = tr.Reclaim(); err!=nil { t.Fatal(err) }
+	leaks,err := mb.Leaks(ctx,tr,obj)
+	if err!=nil { t.Fatal(err) }
+	if len(leaks)>0 { t.Fatal("leaked pages",len(leaks)) }
+	if n := len(keys(t,tr,obj,all)); n!=stable+(total-stable)/2 { t.Fatal(n) }
+}
@@ -0,0 +1,187 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+package newtree
+
+import "sort"
+
+/*
+State of a .Delete(), for condensing underfull pages. See Tree.MinFill.
+*/
+type condenseState struct{
+	min     int
+	root    int
+	ver     uint16
+	under   map[int64]bool
+	orphans []pendingElement
+}
+
+/* Records, that page id has been written with node, if node is underfull. */
+func (cs *condenseState) check(id int64, node Elements) {
+	if cs.under==nil || node.Length()>=cs.min { return }
+	cs.under[id] = true
+}
+
+/*
+Writes P into newly allocated pages, as many as needed, and returns the
+elements for the parent page.
+*/
+func (t *Tree) storeNew(P Elements) (r_elems Elements, err error) {
+	for len(P)>0 {
+		var cur Elements
+		cur,P = t.firstSplit(P)
+		var e Element
+		e.Ptr,err = t.insertPage(cur)
+		if err!=nil { return }
+		e.Val = t.Ops.Union(cur)
+		r_elems = append(r_elems,e)
+	}
+	return
+}
+
+/*
+Moves the elements of the pages a and b into new pages, one if they fit,
+otherwise they are redistributed. The pages a and b are freed. If the new
+page is still underfull, it is recorded in cs.
+
+New pages are used, so that a concurrent reader sees either the old pages or
+the new ones, but never an element twice or not at all.
+*/
+func (t *Tree) mergePages(a, b int64, cs *condenseState) (Elements,error) {
+	ba,ea,err := t.getPage(a,cs.ver)
+	defer freeElements(ea)
+	defer ba.Free()
+	if err!=nil { return nil,err }
+	bb,eb,err := t.getPage(b,cs.ver)
+	defer freeElements(eb)
+	defer bb.Free()
+	if err!=nil { return nil,err }
+	
+	all := make(Elements,0,len(ea)+len(eb))
+	all = append(append(all,ea...),eb...)
+	t.Ops.Sort(all)
+	res,err := t.storeNew(all)
+	if err!=nil { return nil,err }
+	if len(res)==1 { cs.check(res[0].Ptr,all) }
+	err = t.freePage(a)
+	if err==nil { err = t.freePage(b) }
+	return res,err
+}
+
+/* Removes page id at level lvl, its elements are reinserted after the .Delete(). */
+func (t *Tree) orphan(id int64, lvl int, cs *condenseState) error {
+	b,node,err := t.getPage(id,cs.ver)
+	defer freeElements(node)
+	defer b.Free()
+	if err!=nil { return err }
+	for _,e := range node {
+		e.Val = append([]byte(nil),e.Val...)
+		cs.orphans = append(cs.orphans,pendingElement{e,lvl})
+	}
+	return t.freePage(id)
+}
+
+func (e Elements) index(ptr int64) int {
+	for i := range e { if e[i].Ptr==ptr { return i } }
+	return -1
+}
+
+/*
+Condenses the underfull children of node, which is at level lvl: each of them
+is merged with the sibling, that is the cheapest to extend (see TreeOps.Penalty()),
+or the elements of both are redistributed, if they don't fit into one page.
+A child without siblings is removed and its elements are reinserted, unless
+node is the root. Merged pages, that are still underfull, are merged again.
+*/
+func (t *Tree) condense(node Elements, lvl int, cs *condenseState) (Elements,error) {
+	var under []int64
+	for _,e := range node {
+		if cs.under[e.Ptr] {
+			under = append(under,e.Ptr)
+			delete(cs.under,e.Ptr)
+		}
+	}
+	for len(under)>0 {
+		id := under[0]
+		under = under[1:]
+		i := node.index(id)
+		if i<0 { continue }
+		if len(node)<2 {
+			if lvl>=cs.root { break }
+			err := t.orphan(id,lvl-1,cs)
+			if err!=nil { return node,err }
+			node = append(node[:i],node[i+1:]...)
+			continue
+		}
+		j := -1
+		jc := float64(0)
+		for k,e := range node {
+			if k==i { continue }
+			c := t.Ops.Penalty(e.Val,node[i].Val)
+			if j<0 || c<jc { j,jc = k,c }
+		}
+		res,err := t.mergePages(node[j].Ptr,id,cs)
+		if err!=nil { return node,err }
+		if i<j { i,j = j,i }
+		node = append(node[:i],node[i+1:]...)
+		node = append(node[:j],node[j+1:]...)
+		node = append(node,res...)
+		for _,e := range res {
+			if cs.under[e.Ptr] {
+				under = append(under,e.Ptr)
+				delete(cs.under,e.Ptr)
+			}
+		}
+	}
+	return node,nil
+}
+
+/*
+Reinserts the orphans of a .Delete() into the tree rr. ver is the format
+version of the tree, the orphans were taken from.
+*/
+func (t *Tree) reinsertOrphans(rr Root, orphans []pendingElement, ver uint16) (_ Root, err error) {
+	/* Higher levels first, so that an empty tree can be seeded with them. */
+	sort.SliceStable(orphans,func(i,j int) bool { return orphans[i].level>orphans[j].level })
+	if rr.Ptr==0 {
+		lvl := orphans[0].level
+		var P Elements
+		for len(orphans)>0 && orphans[0].level==lvl {
+			P = append(P,orphans[0].e)
+			orphans = orphans[1:]
+		}
+		for {
+			t.Ops.Sort(P)
+			P,err = t.storeNew(P)
+			if err!=nil { return }
+			if len(P)==1 { break }
+			lvl++
+		}
+		/* The orphans may point to legacy pages. */
+		rr = Root{Ptr:P[0].Ptr,Depth:uint32(lvl),Version:ver}
+	}
+	st := t.newInsertState()
+	st.pending = orphans
+	return t.insertPending(rr,st)
+}
@@ -0,0 +1,109 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+
+
+package newtree_test
+
+import "github.com/maxymania/gonbase/newtree"
+import "github.com/maxymania/gonbase/ntops"
+import "context"
+import "testing"
+
+/* Deletes the keys in lo..hi, that are not multiples of keep, or all, if keep is 0. */
+func thinOut(t testing.TB, tr *newtree.Tree, obj int64, lo, hi, keep int64) {
+	_,err := tr.Delete(context.Background(),obj,ntops.IntervalOverlap[int64]{Low:lo,High:hi},func(b []byte) bool {
+		k := ivKey(t,b)
+		return k>=lo && k<=hi && (keep==0 || k%keep!=0)
+	})
+	if err!=nil { t.Fatal(err) }
+}
+
+func noLeaks(t testing.TB, mb *newtree.MemBase, tr *newtree.Tree, obj int64) {
+	t.Helper()
+	if err := tr.Reclaim(); err!=nil { t.Fatal(err) }
+	leaks,err := mb.Leaks(context.Background(),tr,obj)
+	if err!=nil { t.Fatal(err) }
+	if len(leaks)>0 { t.Fatalf("%d leaked pages",len(leaks)) }
+}
+
+func TestCondense(t *testing.T) {
+	const n = 3000
+	for _,cow := range []bool{false,true} {
+		var leaves [2]int
+		for i,fill := range []float64{0,0.4} {
+			mb := newtree.NewMemBase(512)
+			tr := ivTree(mb)
+			tr.CopyOnWrite = cow
+			tr.MinFill = fill
+			obj,_ := tr.NewRoot()
+			insertRange(t,tr,obj,0,n)
+			
+			/* Pages become underfull one window after the other. */
+			for lo := int64(0); lo<n; lo += 250 {
+				thinOut(t,tr,obj,lo,lo+249,10)
+				verify(t,tr,obj)
+			}
+			got := keys(t,tr,obj,all)
+			if len(got)!=n/10 { t.Fatalf("cow=%v fill=%v: %d keys",cow,fill,len(got)) }
+			for j,k := range got {
+				if k!=int64(j*10) { t.Fatalf("cow=%v fill=%v: key %d at %d",cow,fill,k,j) }
+			}
+			st := verify(t,tr,obj)
+			leaves[i] = st.Levels[len(st.Levels)-1].Pages
+			if fill>0 {
+				min := int64(fill*float64(mb.Page()-12))
+				for lv,l := range st.Levels[1:] {
+					if l.MinBytes<min { t.Errorf("cow=%v: level %d has a page of %d bytes",cow,lv+1,l.MinBytes) }
+				}
+			}
+			noLeaks(t,mb,tr,obj)
+		}
+		if leaves[1]*2>leaves[0] { t.Errorf("cow=%v: %d leaves with MinFill, %d without",cow,leaves[1],leaves[0]) }
+	}
+}
+
+/* Pages without siblings are removed and their elements reinserted. */
+func TestCondenseOrphans(t *testing.T) {
+	for _,cow := range []bool{false,true} {
+		mb := newtree.NewMemBase(512)
+		tr := ivTree(mb)
+		tr.CopyOnWrite = cow
+		tr.MinFill = 0.4
+		obj,_ := tr.NewRoot()
+		insertRange(t,tr,obj,0,3000)
+		
+		/* Shrink the tree from both ends, down to a few keys, then to none. */
+		for lo,hi := int64(0),int64(2999); lo<hi; lo,hi = lo+100,hi-100 {
+			thinOut(t,tr,obj,lo,lo+99,0)
+			thinOut(t,tr,obj,hi-99,hi,0)
+			st := verify(t,tr,obj)
+			if got := keys(t,tr,obj,all); len(got)!=int(hi-lo-199) { t.Fatalf("cow=%v: %d keys in %d..%d, %v",cow,len(got),lo+100,hi-100,st) }
+		}
+		noLeaks(t,mb,tr,obj)
+		thinOut(t,tr,obj,0,3000,0)
+		if rr := rootOf(t,mb,obj); rr.Ptr!=0 { t.Fatalf("cow=%v: %+v",cow,rr) }
+		noLeaks(t,mb,tr,obj)
+	}
+}
@@ -0,0 +1,157 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+package newtree
+
+import "github.com/byte-mug/golibs/bufferex"
+import "context"
+
+type cursorFrame struct{
+	b    bufferex.Binary
+	node Elements
+	pos  int
+	id   int64
+	up   int // The index of the parent frame, or -1.
+	plsn uint64
+	lsn  uint64
+}
+
+/*
+A Cursor walks the leaf-elements of a tree, that are consistent with a query,
+in the same order as .Search() would report them. Unlike .Search(), the
+caller pulls the results and can stop at any time.
+
+	c,err := tree.Cursor(ctx,obj,q)
+	if err!=nil { return err }
+	defer c.Close()
+	for c.Next() {
+		use(c.Value())
+	}
+	return c.Err()
+
+An open Cursor counts as an active reader, so pages freed by writers in the
+meantime are not released until it is closed.
+*/
+type Cursor struct{
+	t     *Tree
+	obj   int64
+	ctx   context.Context
+	q     interface{}
+	stack []cursorFrame
+	depth uint32
+	ver   uint16
+	val   []byte
+	err   error
+	start uint64
+	open  bool
+}
+
+func (t *Tree) Cursor(ctx context.Context, obj int64, q interface{}) (*Cursor,error) {
+	start := t.beginRead()
+	rr,lsn,err := t.readRoot(obj)
+	if err!=nil {
+		t.endRead(start)
+		return nil,err
+	}
+	return t.newCursor(ctx,obj,q,start,rr,lsn)
+}
+
+/* Takes over the reader-registration start. */
+func (t *Tree) newCursor(ctx context.Context, obj int64, q interface{}, start uint64, rr Root, lsn uint64) (*Cursor,error) {
+	c := &Cursor{t:t,obj:obj,ctx:ctx,q:q,start:start,depth:rr.Depth,ver:rr.Version,open:true}
+	if rr.Ptr!=0 {
+		err := c.push(rr.Ptr,-1,lsn)
+		if err!=nil {
+			c.Close()
+			return nil,err
+		}
+	}
+	return c,nil
+}
+
+func (c *Cursor) push(id int64, up int, plsn uint64) error {
+	b,node,lsn,err := c.t.readPage(id,c.ver)
+	if err!=nil {
+		freeElements(node)
+		b.Free()
+		return err
+	}
+	c.stack = append(c.stack,cursorFrame{b:b,node:node,id:id,up:up,plsn:plsn,lsn:lsn})
+	return nil
+}
+func (c *Cursor) pop() {
+	i := len(c.stack)-1
+	freeElements(c.stack[i].node)
+	c.stack[i].b.Free()
+	c.stack[i] = cursorFrame{}
+	c.stack = c.stack[:i]
+}
+
+// Advances the cursor to the next consistent leaf-element. Returns false,
+// if there are no more elements or an error occurred.
+func (c *Cursor) Next() bool {
+	c.val = nil
+	for c.err==nil && len(c.stack)>0 {
+		f := &c.stack[len(c.stack)-1]
+		if f.pos >= len(f.node) {
+			id,up,plsn := f.id,f.up,f.plsn
+			moved := c.t.movedFrom(id,f.plsn,f.lsn)
+			c.pop()
+			for i := len(moved)-1; i>=0 && c.err==nil; i-- {
+				c.err = c.push(moved[i],up,plsn)
+			}
+			continue
+		}
+		c.err = c.t.resolveElement(f.id,&f.node[f.pos])
+		if c.err!=nil { break }
+		e := f.node[f.pos]
+		f.pos++
+		if !c.t.Ops.Consistent(e.Val,c.q) { continue }
+		c.err = c.ctx.Err()
+		if c.err!=nil { break }
+		if e.Ptr==0 {
+			c.val = e.Val
+			return true
+		}
+		c.err = c.push(e.Ptr,len(c.stack)-1,f.lsn)
+	}
+	return false
+}
+
+// Returns the current element. The slice is only valid until the next call
+// to .Next() or .Close().
+func (c *Cursor) Value() []byte { return c.val }
+
+func (c *Cursor) Err() error { return c.err }
+
+// Releases all page-buffers held by the cursor.
+func (c *Cursor) Close() {
+	for len(c.stack)>0 { c.pop() }
+	c.val = nil
+	if c.open {
+		c.open = false
+		c.t.endRead(c.start)
+	}
+}
+
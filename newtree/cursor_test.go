@@ -0,0 +1,109 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+
+
+package newtree_test
+
+import "github.com/maxymania/gonbase/newtree"
+import "github.com/maxymania/gonbase/ntops"
+import "bytes"
+import "context"
+import "testing"
+
+/* Returns the values, that c walks. */
+func walk(t testing.TB, c *newtree.Cursor) (r [][]byte) {
+	defer c.Close()
+	for c.Next() { r = append(r,append([]byte(nil),c.Value()...)) }
+	if err := c.Err(); err!=nil { t.Fatal(err) }
+	return
+}
+
+/* The Cursor reports the same elements in the same order as Search. */
+func TestCursor(t *testing.T) {
+	tr := ivTree(newtree.NewMemBase(256))
+	obj,_ := tr.NewRoot()
+	if c,err := tr.Cursor(context.Background(),obj,all); err!=nil || len(walk(t,c))!=0 { t.Fatal(err) }
+	insertRange(t,tr,obj,0,500)
+	for k := int64(0); k<500; k += 37 {
+		if err := tr.Insert(obj,bigElem(k,700)); err!=nil { t.Fatal(err) }
+	}
+	for _,q := range []interface{}{
+		all,
+		ntops.IntervalStab[int64]{At:74},
+		ntops.IntervalOverlap[int64]{Low:100,High:180},
+		ntops.IntervalOverlap[int64]{Low:1000,High:2000},
+	} {
+		var want [][]byte
+		err := tr.Search(context.Background(),obj,q,func(b []byte) { want = append(want,append([]byte(nil),b...)) })
+		if err!=nil { t.Fatal(err) }
+		c,err := tr.Cursor(context.Background(),obj,q)
+		if err!=nil { t.Fatal(err) }
+		got := walk(t,c)
+		if len(got)!=len(want) { t.Fatalf("%v: %d elements, want %d",q,len(got),len(want)) }
+		for i := range got {
+			if !bytes.Equal(got[i],want[i]) { t.Fatalf("%v: element %d differs",q,i) }
+		}
+	}
+}
+
+/* A Cursor, that is closed early, releases the pages pinned by it. */
+func TestCursorClose(t *testing.T) {
+	mb := newtree.NewMemBase(256)
+	tr := ivTree(mb)
+	tr.CopyOnWrite = true
+	obj,_ := tr.NewRoot()
+	insertRange(t,tr,obj,0,300)
+	
+	c,err := tr.Cursor(context.Background(),obj,all)
+	if err!=nil { t.Fatal(err) }
+	for i := 0; i<10; i++ {
+		if !c.Next() { t.Fatal(c.Err()) }
+	}
+	_,err = tr.Delete(context.Background(),obj,all,func([]byte) bool { return true })
+	if err!=nil { t.Fatal(err) }
+	if err = tr.Reclaim(); err!=nil { t.Fatal(err) }
+	leaks,err := mb.Leaks(context.Background(),tr,obj)
+	if err!=nil { t.Fatal(err) }
+	if len(leaks)==0 { t.Fatal("no pages are pinned by the Cursor") }
+	
+	/* It still walks the old state. */
+	if !c.Next() || ivKey(t,c.Value())!=10 { t.Fatal(c.Err()) }
+	c.Close()
+	if c.Next() || c.Value()!=nil || c.Err()!=nil { t.Fatal("Next after Close") }
+	c.Close()
+	noLeaks(t,mb,tr,obj)
+	
+	/* A canceled context ends the walk with its error. */
+	insertRange(t,tr,obj,0,300)
+	ctx,cancel := context.WithCancel(context.Background())
+	c,err = tr.Cursor(ctx,obj,all)
+	if err!=nil { t.Fatal(err) }
+	if !c.Next() { t.Fatal(c.Err()) }
+	cancel()
+	for c.Next() {}
+	if c.Err()!=context.Canceled { t.Fatal(c.Err()) }
+	c.Close()
+	noLeaks(t,mb,tr,obj)
+}
@@ -0,0 +1,242 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+package newtree
+
+import "context"
+import "reflect"
+import "errors"
+import "bufio"
+import "io"
+
+var EDumpOps = errors.New("EDumpOps")
+
+const dumpMagic = "GiSTDMP1"
+
+const (
+	dumpEnd   = 0
+	dumpValue = 1
+)
+
+/*
+The header of a dump, see Tree.Dump().
+*/
+type DumpHeader struct{
+	Ops      string // The name, the TreeOps are registered under, or "".
+	PageSize int    // The page size of the dumped tree.
+	Version  uint16 // The FormatVersion of the dumping code.
+}
+
+/*
+Returns .OpsName, or else the name, the type of .Ops is registered under, or "".
+If several names are registered for that type, EDumpOps is returned.
+*/
+func (t *Tree) opsName() (string,error) {
+	if t.OpsName!="" { return t.OpsName,nil }
+	opsRegistry.RLock(); defer opsRegistry.RUnlock()
+	typ := reflect.TypeOf(t.Ops)
+	found := ""
+	for name,o := range opsRegistry.m {
+		if reflect.TypeOf(o)!=typ { continue }
+		if found!="" { return "",EDumpOps }
+		found = name
+	}
+	return found,nil
+}
+
+/* Reports every leaf-element below page id, regardless of the TreeOps. */
+func (t *Tree) scan(
+	ctx context.Context,
+	id int64,
+	plsn uint64,
+	ver uint16,
+	consumer func([]byte) error) error {
+	b,node,lsn,err := t.readPage(id,ver)
+	defer freeElements(node)
+	defer b.Free()
+	if err!=nil { return err }
+	
+	for _,e := range node {
+		err = ctx.Err()
+		if err!=nil { return err }
+		if e.Ptr == 0 {
+			err = t.resolveElement(id,&e)
+			if err==nil { err = consumer(e.Val) }
+		} else {
+			err = t.scan(ctx,e.Ptr,lsn,ver,consumer)
+		}
+		if err!=nil { return err }
+	}
+	for _,sib := range t.movedFrom(id,plsn,lsn) {
+		err = t.scan(ctx,sib,plsn,ver,consumer)
+		if err!=nil { return err }
+	}
+	return nil
+}
+
+/*
+Writes all leaf-values of the tree obj to w, in a format, that is independent
+of the page size and the IBase:
+
+	magic "GiSTDMP1" | uint32 page size | uint16 version | uint16 len | ops name
+	n * (byte 1 | uint32 len | value)
+	byte 0 | uint64 n | uint32 CRC32C of all preceding bytes
+
+All numbers are little endian. The values are written in the order of the
+leaf pages, which is usually close to the order of .Ops.Sort(). See .Restore().
+
+The ops name is .OpsName, or the name, .Ops are registered under. If .OpsName
+is empty and several names are registered for the type of .Ops, EDumpOps is
+returned.
+*/
+func (t *Tree) Dump(ctx context.Context, obj int64, w io.Writer) error {
+	cw := &crcWriter{w:bufio.NewWriter(w)}
+	var num [8]byte
+	ops,err := t.opsName()
+	if err!=nil { return err }
+	if len(ops)>0xffff { return EDumpOps }
+	cw.write([]byte(dumpMagic))
+	frm.PutUint32(num[:],uint32(t.Page()))
+	cw.write(num[:4])
+	frm.PutUint16(num[:],FormatVersion)
+	frm.PutUint16(num[2:],uint16(len(ops)))
+	cw.write(num[:4])
+	cw.write([]byte(ops))
+	
+	n := uint64(0)
+	defer t.endRead(t.beginRead())
+	rr,lsn,err := t.readRoot(obj)
+	if err==nil && rr.Ptr!=0 {
+		err = t.scan(ctx,rr.Ptr,lsn,rr.Version,func(v []byte) error {
+			num[0] = dumpValue
+			frm.PutUint32(num[1:],uint32(len(v)))
+			cw.write(num[:5])
+			cw.write(v)
+			n++
+			return cw.err
+		})
+	}
+	if err!=nil { return err }
+	num[0] = dumpEnd
+	cw.write(num[:1])
+	frm.PutUint64(num[:],n)
+	cw.write(num[:])
+	frm.PutUint32(num[:],cw.sum)
+	cw.write(num[:4])
+	if cw.err==nil { cw.err = cw.w.Flush() }
+	return cw.err
+}
+
+/*
+Reads a dump written by Tree.Dump(). A *DumpReader is a Source.
+*/
+type DumpReader struct{
+	Header DumpHeader
+	
+	cr   *crcReader
+	val  []byte
+	n    uint64
+	done bool
+}
+
+/* Reads the header of the dump in r. */
+func ReadDump(r io.Reader) (*DumpReader,error) {
+	d := &DumpReader{cr:&crcReader{r:bufio.NewReader(r)}}
+	var num [8]byte
+	magic := make([]byte,len(dumpMagic))
+	d.cr.read(magic)
+	if d.cr.err!=nil { return nil,d.cr.err }
+	if string(magic)!=dumpMagic { return nil,ECorrupt }
+	d.cr.read(num[:8])
+	d.Header.PageSize = int(frm.Uint32(num[:]))
+	d.Header.Version  = frm.Uint16(num[4:])
+	ops := make([]byte,frm.Uint16(num[6:]))
+	d.cr.read(ops)
+	if d.cr.err!=nil { return nil,d.cr.err }
+	d.Header.Ops = string(ops)
+	return d,nil
+}
+
+func (d *DumpReader) Next() bool {
+	if d.done || d.cr.err!=nil { return false }
+	var num [8]byte
+	d.cr.read(num[:1])
+	switch {
+	case d.cr.err!=nil:
+	case num[0]==dumpValue:
+		d.cr.read(num[:4])
+		l := frm.Uint32(num[:])
+		if l>1<<30 { d.cr.err = ECorrupt; break }
+		if cap(d.val)<int(l) { d.val = make([]byte,l) }
+		d.val = d.val[:l]
+		d.cr.read(d.val)
+		d.n++
+		return d.cr.err==nil
+	case num[0]==dumpEnd:
+		d.done = true
+		d.cr.read(num[:])
+		n := frm.Uint64(num[:])
+		sum := d.cr.sum
+		d.cr.read(num[:4])
+		if d.cr.err==nil && (n!=d.n || frm.Uint32(num[:])!=sum) { d.cr.err = ECorrupt }
+	default:
+		d.cr.err = ECorrupt
+	}
+	return false
+}
+
+/* The current value. It is only valid until the next call to .Next(). */
+func (d *DumpReader) Value() []byte { return d.val }
+
+func (d *DumpReader) Err() error {
+	if d.cr.err==io.EOF || d.cr.err==io.ErrUnexpectedEOF { return ECorrupt }
+	return d.cr.err
+}
+
+/*
+Rebuilds the tree obj, which must be empty, from a dump written by .Dump(),
+using .BulkLoad(). The page size of t may differ from the dumped tree. If the
+dump names TreeOps, they must be the same as .Ops, otherwise EDumpOps is
+returned: if .OpsName is set, the names must be equal, otherwise the TreeOps
+registered under the name, if any, must be of the type of .Ops.
+
+The checksum of the dump is only known at its end, so the values are written,
+while they are read. If the dump turns out to be damaged or truncated, the
+error is returned, the pages written so far are freed and the tree remains
+empty.
+*/
+func (t *Tree) Restore(obj int64, r io.Reader) error {
+	d,err := ReadDump(r)
+	if err!=nil { return err }
+	if !t.dumpOps(d.Header.Ops) { return EDumpOps }
+	return t.BulkLoad(obj,d)
+}
+
+/* Reports, whether a dump of the ops name can be restored into t. */
+func (t *Tree) dumpOps(name string) bool {
+	if name=="" { return true }
+	if t.OpsName!="" { return name==t.OpsName }
+	ops,ok := LookupOps(name)
+	return !ok || reflect.TypeOf(ops)==reflect.TypeOf(t.Ops)
+}
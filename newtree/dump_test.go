@@ -0,0 +1,127 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+package newtree_test
+
+import "github.com/maxymania/gonbase/newtree"
+import "github.com/maxymania/gonbase/ntops"
+import "bytes"
+import "context"
+import "errors"
+import "testing"
+
+/* Every tenth value goes into overflow pages. */
+func dumpElem(k int64) []byte {
+	if k%10==0 { return ntops.EncodeInterval(k,k,bytes.Repeat([]byte("x"),300)) }
+	return ivElem(k)
+}
+
+func dumpTree(t *testing.T) *bytes.Buffer {
+	tr := ivTree(newtree.NewMemBase(256))
+	obj,_ := tr.NewRoot()
+	for k := int64(0); k<1000; k++ {
+		if err := tr.Insert(obj,dumpElem(k)); err!=nil { t.Fatal(err) }
+	}
+	dump := new(bytes.Buffer)
+	if err := tr.Dump(context.Background(),obj,dump); err!=nil { t.Fatal(err) }
+	return dump
+}
+
+func TestDumpRestore(t *testing.T) {
+	dump := dumpTree(t)
+	
+	/* Restores into a tree with a different page size. */
+	tr := ivTree(newtree.NewMemBase(512))
+	obj,_ := tr.NewRoot()
+	if err := tr.Restore(obj,bytes.NewReader(dump.Bytes())); err!=nil { t.Fatal(err) }
+	got := keys(t,tr,obj,all)
+	if len(got)!=1000 || got[0]!=0 || got[999]!=999 { t.Fatalf("restored %d keys",len(got)) }
+	verify(t,tr,obj)
+	if err := tr.Restore(obj,bytes.NewReader(dump.Bytes())); err!=newtree.ENotEmpty { t.Fatal(err) }
+}
+
+/* A damaged dump leaves the tree empty and frees all pages written. */
+func TestRestoreDamaged(t *testing.T) {
+	d := dumpTree(t).Bytes()
+	flip := func(i int) []byte {
+		b := append([]byte(nil),d...)
+		b[i] ^= 1
+		return b
+	}
+	for name,b := range map[string][]byte{
+		"checksum":  flip(len(d)-1),
+		"count":     flip(len(d)-12),
+		"value":     flip(len(d)/2),
+		"truncated": d[:len(d)*2/3],
+	} {
+		mb := newtree.NewMemBase(256)
+		tr := ivTree(mb)
+		obj,_ := tr.NewRoot()
+		before := mb.Stats()
+		err := tr.Restore(obj,bytes.NewReader(b))
+		if !errors.Is(err,newtree.ECorrupt) { t.Fatalf("%s: got %v, want ECorrupt",name,err) }
+		if rr := rootOf(t,mb,obj); rr.Ptr!=0 { t.Fatalf("%s: tree not empty: %+v",name,rr) }
+		if err = tr.Reclaim(); err!=nil { t.Fatal(err) }
+		if st := mb.Stats(); st.Pages!=before.Pages { t.Fatalf("%s: %d pages leaked",name,st.Pages-before.Pages) }
+		if len(keys(t,tr,obj,all))!=0 { t.Fatalf("%s: keys left",name) }
+	}
+}
+
+/* A type, that is registered under two names. */
+type aliasOps struct{ ntops.StrOps }
+
+func init() {
+	newtree.RegisterOps("test.alias1",aliasOps{})
+	newtree.RegisterOps("test.alias2",aliasOps{})
+}
+
+func TestDumpOpsName(t *testing.T) {
+	ctx := context.Background()
+	tr := &newtree.Tree{IBase:newtree.NewMemBase(256),Ops:aliasOps{}}
+	obj,_ := tr.NewRoot()
+	for _,k := range []string{"a","b","c"} {
+		if err := tr.Insert(obj,ntops.EncodePair([]byte(k),[]byte(k))); err!=nil { t.Fatal(err) }
+	}
+	if err := tr.Dump(ctx,obj,new(bytes.Buffer)); err!=newtree.EDumpOps { t.Fatalf("ambiguous name: %v",err) }
+	
+	tr.OpsName = "test.alias2"
+	dump := new(bytes.Buffer)
+	if err := tr.Dump(ctx,obj,dump); err!=nil { t.Fatal(err) }
+	d,err := newtree.ReadDump(bytes.NewReader(dump.Bytes()))
+	if err!=nil || d.Header.Ops!="test.alias2" { t.Fatal(d.Header,err) }
+	
+	for _,x := range []struct{
+		tr   *newtree.Tree
+		err  error
+	}{
+		{&newtree.Tree{Ops:aliasOps{}},nil},
+		{&newtree.Tree{Ops:aliasOps{},OpsName:"test.alias2"},nil},
+		{&newtree.Tree{Ops:aliasOps{},OpsName:"test.alias1"},newtree.EDumpOps},
+		{&newtree.Tree{Ops:ntops.StrOps{}},newtree.EDumpOps},
+	} {
+		x.tr.IBase = newtree.NewMemBase(256)
+		obj,_ := x.tr.NewRoot()
+		if err := x.tr.Restore(obj,bytes.NewReader(dump.Bytes())); err!=x.err { t.Fatalf("%+v: got %v, want %v",x.tr,err,x.err) }
+	}
+}
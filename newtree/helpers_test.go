@@ -0,0 +1,81 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+package newtree_test
+
+import "github.com/maxymania/gonbase/newtree"
+import "github.com/maxymania/gonbase/ntops"
+import "context"
+import "math"
+import "sort"
+import "testing"
+
+/* Queries all intervals. */
+var all = ntops.IntervalOverlap[int64]{Low:math.MinInt64,High:math.MaxInt64}
+
+func ivTree(base newtree.IBase) *newtree.Tree {
+	return &newtree.Tree{IBase:base,Ops:ntops.IntervalOps{}}
+}
+
+/* The element of key k, an interval of length k%7. */
+func ivElem(k int64) []byte {
+	return ntops.EncodeInterval(k,k+k%7,[]byte("value"))
+}
+
+func ivKey(t testing.TB, b []byte) int64 {
+	k,_,_,err := ntops.DecodeInterval[int64](b)
+	if err!=nil { t.Fatal(err) }
+	return k
+}
+
+func insertRange(t testing.TB, tr *newtree.Tree, obj int64, lo, hi int64) {
+	for k := lo; k<hi; k++ {
+		if err := tr.Insert(obj,ivElem(k)); err!=nil { t.Fatal(err) }
+	}
+}
+
+/* Returns the sorted keys of all elements matching q. */
+func keys(t testing.TB, tr *newtree.Tree, obj int64, q interface{}) []int64 {
+	var r []int64
+	err := tr.Search(context.Background(),obj,q,func(b []byte) { r = append(r,ivKey(t,b)) })
+	if err!=nil { t.Fatal(err) }
+	sort.Slice(r,func(i,j int) bool { return r[i]<r[j] })
+	return r
+}
+
+/* Returns the Root of the tree obj. */
+func rootOf(t testing.TB, base newtree.IBase, obj int64) newtree.Root {
+	b,err := base.HeadRead(obj)
+	if err!=nil { t.Fatal(err) }
+	defer b.Free()
+	var rr newtree.Root
+	if err = rr.BinDecode(b.Bytes()); err!=nil { t.Fatal(err) }
+	return rr
+}
+
+func verify(t testing.TB, tr *newtree.Tree, obj int64) *newtree.Stats {
+	st,err := tr.Verify(context.Background(),obj)
+	if err!=nil { t.Fatal(err) }
+	return st
+}
@@ -0,0 +1,215 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+
+
+package newtree_test
+
+import "github.com/maxymania/gonbase/newtree"
+import "github.com/maxymania/gonbase/ntops"
+import "context"
+import "fmt"
+import "math"
+import "math/rand"
+import "sort"
+import "testing"
+
+type interval struct{ low,high int64 }
+
+/* Returns the sorted lows of the intervals of iv, that match. */
+func bruteForce(iv []interval, match func(interval) bool) []int64 {
+	r := []int64{}
+	for _,x := range iv {
+		if match(x) { r = append(r,x.low) }
+	}
+	sort.Slice(r,func(i,j int) bool { return r[i]<r[j] })
+	return r
+}
+
+func TestIntervalQueries(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	tr := ivTree(newtree.NewMemBase(256))
+	obj,_ := tr.NewRoot()
+	/* The lows are unique, so that they identify the intervals. */
+	var iv []interval
+	for _,low := range r.Perm(2000) {
+		x := interval{int64(low)*10-10000,0}
+		x.high = x.low+r.Int63n(300)
+		iv = append(iv,x)
+		if err := tr.Insert(obj,ntops.EncodeInterval(x.low,x.high,nil)); err!=nil { t.Fatal(err) }
+	}
+	if st := verify(t,tr,obj); st.Depth<3 { t.Fatal(st) }
+	
+	for i := 0; i<200; i++ {
+		a := r.Int63n(22000)-11000
+		b := a+r.Int63n(2000)
+		c := a+r.Int63n(200)
+		for _,x := range []struct{
+			q     interface{}
+			match func(interval) bool
+		}{
+			{ntops.IntervalStab[int64]{At:a},func(x interval) bool { return x.low<=a && a<=x.high }},
+			{ntops.IntervalOverlap[int64]{Low:a,High:b},func(x interval) bool { return x.low<=b && a<=x.high }},
+			{ntops.IntervalWithin[int64]{Low:a,High:b},func(x interval) bool { return a<=x.low && x.high<=b }},
+			{ntops.IntervalContains[int64]{Low:a,High:c},func(x interval) bool { return x.low<=a && c<=x.high }},
+		} {
+			got := keys(t,tr,obj,x.q)
+			if got==nil { got = []int64{} }
+			if want := bruteForce(iv,x.match); fmt.Sprint(got)!=fmt.Sprint(want) {
+				t.Fatalf("%#v: %v, want %v",x.q,got,want)
+			}
+		}
+	}
+}
+
+/*
+The Union of inner keys keeps the greatest low and the least high, so that
+IntervalWithin skips subtrees, that cover the query, but hold no interval
+within it.
+*/
+func TestIntervalWithinPruning(t *testing.T) {
+	ops := ntops.IntervalOps{}
+	u := ops.Union(newtree.Elements{
+		{Val:ntops.EncodeInterval[int64](0,100,nil)},
+		{Val:ntops.EncodeInterval[int64](50,60,nil)},
+	})
+	for _,x := range []struct{
+		low,high int64
+		want     bool
+	}{
+		{0,100,true},
+		{0,60,true},
+		{50,60,true},
+		{0,59,false},  // Every high is above 59.
+		{51,100,false}, // Every low is below 51.
+		{-10,200,true},
+		{101,200,false},
+	} {
+		if got := ops.Consistent(u,ntops.IntervalWithin[int64]{Low:x.low,High:x.high}); got!=x.want {
+			t.Errorf("within %d..%d: %v, want %v",x.low,x.high,got,x.want)
+		}
+	}
+	/* Merging keeps the bounds. */
+	u2 := ops.Union(newtree.Elements{{Val:u},{Val:ntops.EncodeInterval[int64](20,30,nil)}})
+	if ops.Consistent(u2,ntops.IntervalWithin[int64]{Low:21,High:29}) { t.Error("within 21..29 is consistent") }
+	if !ops.Consistent(u2,ntops.IntervalWithin[int64]{Low:20,High:30}) { t.Error("within 20..30 is not consistent") }
+}
+
+/* The extremes of int64 and uint64 keep their order. */
+func TestIntervalExtremes(t *testing.T) {
+	ctx := context.Background()
+	tr := ivTree(newtree.NewMemBase(256))
+	obj,_ := tr.NewRoot()
+	iv := []interval{
+		{math.MinInt64,math.MinInt64},
+		{math.MinInt64+1,-1},
+		{-1,0},
+		{0,0},
+		{1,math.MaxInt64},
+		{math.MaxInt64,math.MaxInt64},
+	}
+	for _,x := range iv {
+		if err := tr.Insert(obj,ntops.EncodeInterval(x.low,x.high,nil)); err!=nil { t.Fatal(err) }
+	}
+	for _,at := range []int64{math.MinInt64,math.MinInt64+1,-1,0,1,math.MaxInt64-1,math.MaxInt64} {
+		got := keys(t,tr,obj,ntops.IntervalStab[int64]{At:at})
+		if got==nil { got = []int64{} }
+		want := bruteForce(iv,func(x interval) bool { return x.low<=at && at<=x.high })
+		if fmt.Sprint(got)!=fmt.Sprint(want) { t.Errorf("stab %d: %v, want %v",at,got,want) }
+	}
+	got := keys(t,tr,obj,ntops.IntervalWithin[int64]{Low:math.MinInt64,High:0})
+	if fmt.Sprint(got)!=fmt.Sprint(bruteForce(iv,func(x interval) bool { return x.high<=0 })) { t.Errorf("within: %v",got) }
+	
+	/* The order of the keys is the order of the numbers. */
+	var lows []int64
+	err := tr.Search(ctx,obj,all,func(b []byte) { lows = append(lows,ivKey(t,b)) })
+	if err!=nil || len(lows)!=len(iv) { t.Fatal(lows,err) }
+	P := newtree.Elements{}
+	for i := len(iv)-1; i>=0; i-- { P = append(P,newtree.Element{Val:ntops.EncodeInterval(iv[i].low,iv[i].high,nil)}) }
+	ntops.IntervalOps{}.Sort(P)
+	for i,e := range P {
+		if k := ivKey(t,e.Val); k!=iv[i].low { t.Fatalf("sorted %d at %d",k,i) }
+	}
+	
+	utr := ivTree(newtree.NewMemBase(256))
+	uobj,_ := utr.NewRoot()
+	for _,v := range []uint64{0,1,1<<63-1,1<<63,math.MaxUint64} {
+		if err := utr.Insert(uobj,ntops.EncodeInterval(v,v,nil)); err!=nil { t.Fatal(err) }
+	}
+	var ugot []uint64
+	err = utr.Search(ctx,uobj,ntops.IntervalOverlap[uint64]{Low:1<<63-1,High:math.MaxUint64},func(b []byte) {
+		v,_,_,err := ntops.DecodeInterval[uint64](b)
+		if err!=nil { t.Fatal(err) }
+		ugot = append(ugot,v)
+	})
+	if err!=nil { t.Fatal(err) }
+	sort.Slice(ugot,func(i,j int) bool { return ugot[i]<ugot[j] })
+	if fmt.Sprint(ugot)!=fmt.Sprint([]uint64{1<<63-1,1<<63,math.MaxUint64}) { t.Errorf("uint64 overlap: %v",ugot) }
+}
+
+func TestIntervalCodec(t *testing.T) {
+	ctx := context.Background()
+	tr := ivTree(newtree.NewMemBase(512))
+	obj,_ := tr.NewRoot()
+	tt := ntops.NewIntervalTree[int64](tr,obj)
+	want := map[int64]ntops.Interval[int64]{}
+	for _,v := range []ntops.Interval[int64]{
+		{Low:math.MinInt64,High:-5,Value:[]byte("min")},
+		{Low:-5,High:5,Value:nil},
+		{Low:7,High:7,Value:[]byte{0,1,2}},
+		{Low:8,High:math.MaxInt64,Value:make([]byte,400)},
+	} {
+		if err := tt.Insert(v); err!=nil { t.Fatal(err) }
+		want[v.Low] = v
+	}
+	n := 0
+	for v,err := range tt.Search(ctx,ntops.IntervalOverlap[int64]{Low:math.MinInt64,High:math.MaxInt64}) {
+		if err!=nil { t.Fatal(err) }
+		w := want[v.Low]
+		if v.High!=w.High || string(v.Value)!=string(w.Value) { t.Errorf("%v, want %v",v,w) }
+		n++
+	}
+	if n!=len(want) { t.Fatal(n) }
+	
+	var c ntops.IntervalCodec[uint64]
+	b,err := c.Encode(ntops.Interval[uint64]{Low:3,High:math.MaxUint64,Value:[]byte("x")})
+	if err!=nil { t.Fatal(err) }
+	if v,err := c.Decode(b); err!=nil || v.Low!=3 || v.High!=math.MaxUint64 || string(v.Value)!="x" { t.Fatal(v,err) }
+	if _,err := c.Decode(b[:10]); err!=ntops.EIntervalKey { t.Fatal(err) }
+}
+
+/* Invalid keys match nothing, and can't be merged. */
+func TestIntervalInvalid(t *testing.T) {
+	ops := ntops.IntervalOps{}
+	/* Too short, an unknown kind, and an inner key of the wrong length. */
+	for _,p := range [][]byte{nil,{0},append([]byte{7},make([]byte,16)...),append([]byte{1},make([]byte,20)...)} {
+		if ops.Consistent(p,ntops.IntervalStab[int64]{At:0}) { t.Errorf("%x is consistent",p) }
+		func() {
+			defer func() {
+				if e := recover(); e!=ntops.EIntervalKey { t.Errorf("%x: Union panics with %v",p,e) }
+			}()
+			ops.Union(newtree.Elements{{Val:ntops.EncodeInterval[int64](0,0,nil)},{Val:p}})
+		}()
+	}
+}
@@ -1,5 +1,3 @@
-// +build !386,!amd64,!riscv
-
 /*
 Copyright (c) 2018 Simon Schmidt
 
@@ -28,28 +26,5 @@ package newtree
 
 import "encoding/binary"
 
+/* All integers are stored in little-endian byte order, regardless of the platform. */
 var frm = binary.LittleEndian
-
-
-/*
-import "unsafe"
-
-type format struct{}
-
-func (format) Uint64(b []byte) uint64 {
-	return *(*uint64)(unsafe.Pointer(&b[0]))
-}
-func (format) Uint32(b []byte) uint32 {
-	return *(*uint32)(unsafe.Pointer(&b[0]))
-}
-func (format) PutUint64(b []byte, u uint64) {
-	*(*uint64)(unsafe.Pointer(&b[0])) = u
-}
-func (format) PutUint32(b []byte, u uint32) {
-	*(*uint32)(unsafe.Pointer(&b[0])) = u
-}
-
-
-var frm = format{}
-*/
-
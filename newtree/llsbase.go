@@ -0,0 +1,299 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+package newtree
+
+import "github.com/maxymania/gonbase/mapfile"
+import "github.com/byte-mug/golibs/bufferex"
+import "hash/crc32"
+import "errors"
+import "sort"
+import "sync"
+
+var EPageSize = errors.New("EPageSize")
+
+/*
+Superblock, stored at the beginning of page 0:
+
+	[0:8]   magic "GiSTLLS1"
+	[8:12]  page size
+	[12:20] number of pages in the file, including page 0
+	[20:28] first free page (0 = none)
+	[28:36] first free head slot (0 = none)
+	[36:40] CRC32C of [0:36]
+	[48:64] the head of the Catalog (see .CatalogHead())
+
+Free pages and free head slots are linked lists: the first 8 bytes of a free
+page or slot hold the offset of the next one.
+*/
+const llsMagic = "GiSTLLS1"
+const llsSuper = 40
+const llsCatalog = 48
+
+/*
+An IBase on top of a mapfile.LLS with its own allocator. Page ids are byte
+offsets. Page 0 holds the superblock. Heads are HeadSize-slots inside pages,
+pages used for heads are never returned to the free list.
+
+PageRead() copies the page, unless .ZeroCopy is set.
+
+Every allocation and free rewrites the superblock (40 bytes at offset 0), so
+that the file is consistent after every call, without a recovery step. It is
+one small write, but it is not synced: .Sync() makes it durable. A WALBase
+syncs the LLSBase, before it logs an allocation, and releases the allocations
+of unfinished operations on replay (see WALBase). The superblock itself is not
+covered by the log. Without a WALBase, a crash may lose the allocations and
+frees since the last .Sync().
+*/
+type LLSBase struct{
+	S mapfile.LLS
+	
+	// If true, PageRead() uses GetInAt(), which is zero-copy on a MmapStore.
+	// Such buffers refer to the mapping, and pages are overwritten in place,
+	// unless all Trees on the LLSBase use CopyOnWrite. So it must only be set,
+	// if they do. Pages beyond the mapped area (after the file has grown) are
+	// read by copy, until the mapping is refreshed.
+	ZeroCopy bool
+	
+	mu    sync.Mutex
+	page  int64
+	pages int64
+	free  int64
+	slots int64
+}
+
+/*
+Opens the LLSBase stored in s. If s is empty, it is formatted with a page size
+of page bytes. If page is 0, the page size of s is used.
+*/
+func OpenLLS(s mapfile.LLS, page int) (*LLSBase,error) {
+	fi,err := s.Stat()
+	if err!=nil { return nil,err }
+	l := &LLSBase{S:s,page:int64(page)}
+	if fi.Size()==0 {
+		if page<llsSuper || page%HeadSize!=0 { return nil,EPageSize }
+		l.pages = 1
+		return l,l.writeSuper()
+	}
+	var sb [llsSuper]byte
+	_,err = s.ReadAt(sb[:],0)
+	if err!=nil { return nil,err }
+	if string(sb[:8])!=llsMagic || frm.Uint32(sb[36:])!=crc32.Checksum(sb[:36],crcTable) {
+		return nil,&CorruptPageError{0,"invalid superblock"}
+	}
+	ps := int64(frm.Uint32(sb[8:]))
+	if page!=0 && int64(page)!=ps { return nil,EPageSize }
+	l.page  = ps
+	l.pages = int64(frm.Uint64(sb[12:]))
+	l.free  = int64(frm.Uint64(sb[20:]))
+	l.slots = int64(frm.Uint64(sb[28:]))
+	return l,nil
+}
+
+/* Must be called with l.mu held. */
+func (l *LLSBase) writeSuper() error {
+	var sb [llsSuper]byte
+	copy(sb[:],llsMagic)
+	frm.PutUint32(sb[8:],uint32(l.page))
+	frm.PutUint64(sb[12:],uint64(l.pages))
+	frm.PutUint64(sb[20:],uint64(l.free))
+	frm.PutUint64(sb[28:],uint64(l.slots))
+	frm.PutUint32(sb[36:],crc32.Checksum(sb[:36],crcTable))
+	_,err := l.S.WriteAt(sb[:],0)
+	return err
+}
+
+/* Must be called with l.mu held. */
+func (l *LLSBase) next(id int64) (int64,error) {
+	var p [8]byte
+	_,err := l.S.ReadAt(p[:],id)
+	return int64(frm.Uint64(p[:])),err
+}
+
+/* Must be called with l.mu held. */
+func (l *LLSBase) link(id, next int64) error {
+	var p [8]byte
+	frm.PutUint64(p[:],uint64(next))
+	_,err := l.S.WriteAt(p[:],id)
+	return err
+}
+
+/* Must be called with l.mu held. */
+func (l *LLSBase) alloc() (id int64, err error) {
+	if l.free!=0 {
+		id = l.free
+		l.free,err = l.next(id)
+		if err!=nil { l.free = id; return 0,err }
+	} else {
+		id = l.pages*l.page
+		err = l.S.Truncate(id+l.page)
+		if err!=nil { return 0,err }
+		l.pages++
+	}
+	err = l.writeSuper()
+	return
+}
+
+func (l *LLSBase) Page() int { return int(l.page) }
+func (l *LLSBase) PageAlloc() (int64,error) {
+	l.mu.Lock(); defer l.mu.Unlock()
+	return l.alloc()
+}
+func (l *LLSBase) PageRead(id int64) (bufferex.Binary,error) {
+	if l.ZeroCopy { return l.S.GetInAt(int(l.page),id) }
+	b := bufferex.AllocBinary(int(l.page))
+	_,err := l.S.ReadAt(b.Bytes(),id)
+	return b,err
+}
+func (l *LLSBase) PageWrite(id int64,b []byte) error {
+	_,err := l.S.WriteAt(b,id)
+	return err
+}
+func (l *LLSBase) PageFree(id int64) error {
+	l.mu.Lock(); defer l.mu.Unlock()
+	err := l.link(id,l.free)
+	if err!=nil { return err }
+	l.free = id
+	return l.writeSuper()
+}
+func (l *LLSBase) HeadAlloc() (id int64,err error) {
+	l.mu.Lock(); defer l.mu.Unlock()
+	if l.slots==0 {
+		/* Carve a new page into free slots. */
+		var pg int64
+		pg,err = l.alloc()
+		if err!=nil { return }
+		b := make([]byte,l.page)
+		for i := int64(0); i<l.page; i += HeadSize {
+			if i+HeadSize<l.page { frm.PutUint64(b[i:],uint64(pg+i+HeadSize)) }
+		}
+		_,err = l.S.WriteAt(b,pg)
+		if err!=nil { return }
+		l.slots = pg
+	}
+	id = l.slots
+	l.slots,err = l.next(id)
+	if err!=nil { l.slots = id; return 0,err }
+	err = l.writeSuper()
+	return
+}
+func (l *LLSBase) HeadRead(id int64) (bufferex.Binary,error) {
+	b := bufferex.AllocBinary(HeadSize)
+	_,err := l.S.ReadAt(b.Bytes(),id)
+	return b,err
+}
+func (l *LLSBase) HeadWrite(id int64,b []byte) error {
+	_,err := l.S.WriteAt(b[:HeadSize],id)
+	return err
+}
+func (l *LLSBase) HeadFree(id int64) error {
+	l.mu.Lock(); defer l.mu.Unlock()
+	var b [HeadSize]byte
+	frm.PutUint64(b[:],uint64(l.slots))
+	_,err := l.S.WriteAt(b[:],id)
+	if err!=nil { return err }
+	l.slots = id
+	return l.writeSuper()
+}
+func (l *LLSBase) Sync() error { return l.S.Sync() }
+
+/* Returns the head reserved in page 0. Needs a page size of at least 64 bytes. */
+func (l *LLSBase) CatalogHead() (int64,error) {
+	if l.page<llsCatalog+HeadSize { return 0,ENoCatalog }
+	l.mu.Lock(); defer l.mu.Unlock()
+	fi,err := l.S.Stat()
+	if err!=nil { return 0,err }
+	if fi.Size()<l.page {
+		/* Nothing has been allocated yet, so page 0 is not complete. */
+		err = l.S.Truncate(l.page)
+		if err!=nil { return 0,err }
+	}
+	return llsCatalog,nil
+}
+
+/* Must be called with l.mu held. */
+func (l *LLSBase) freeList() (ids []int64, err error) {
+	for id := l.free; id!=0; {
+		if int64(len(ids))>=l.pages { return nil,&CorruptPageError{id,"cycle in free list"} }
+		ids = append(ids,id)
+		id,err = l.next(id)
+		if err!=nil { return nil,err }
+	}
+	return
+}
+
+/* Links the free pages ids in ascending order. Must be called with l.mu held. */
+func (l *LLSBase) relink(ids []int64) error {
+	sort.Slice(ids,func(i,j int) bool { return ids[i]<ids[j] })
+	for i,id := range ids {
+		next := int64(0)
+		if i+1<len(ids) { next = ids[i+1] }
+		err := l.link(id,next)
+		if err!=nil { return err }
+	}
+	l.free = 0
+	if len(ids)>0 { l.free = ids[0] }
+	return l.writeSuper()
+}
+
+/* Orders the free list, so that the lowest free page is allocated first. */
+func (l *LLSBase) SortFree() error {
+	l.mu.Lock(); defer l.mu.Unlock()
+	ids,err := l.freeList()
+	if err!=nil { return err }
+	return l.relink(ids)
+}
+
+/* Allocates the first free page, if it is below id, otherwise returns 0. */
+func (l *LLSBase) PageAllocBelow(id int64) (int64,error) {
+	l.mu.Lock(); defer l.mu.Unlock()
+	if l.free==0 || l.free>=id { return 0,nil }
+	return l.alloc()
+}
+
+/*
+Removes the free pages at the end of the file from the free list and truncates
+the file. Returns the number of bytes released. The free list is left sorted.
+*/
+func (l *LLSBase) Shrink() (int64,error) {
+	l.mu.Lock(); defer l.mu.Unlock()
+	ids,err := l.freeList()
+	if err!=nil { return 0,err }
+	set := make(map[int64]bool,len(ids))
+	for _,id := range ids { set[id] = true }
+	n := l.pages
+	for n>1 && set[(n-1)*l.page] { n-- }
+	if n==l.pages { return 0,l.relink(ids) }
+	i := 0
+	for _,id := range ids {
+		if id<n*l.page { ids[i] = id; i++ }
+	}
+	old := l.pages
+	l.pages = n
+	err = l.relink(ids[:i])
+	if err!=nil { return 0,err }
+	err = l.S.Truncate(n*l.page)
+	if err!=nil { return 0,err }
+	return (old-n)*l.page,nil
+}
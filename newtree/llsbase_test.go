@@ -0,0 +1,165 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+
+
+package newtree_test
+
+import "github.com/maxymania/gonbase/newtree"
+import "github.com/maxymania/gonbase/mapfile"
+import "context"
+import "errors"
+import "os"
+import "path/filepath"
+import "testing"
+
+/* Creates an empty file store. */
+func llsFile(t testing.TB) *mapfile.FileStore {
+	f,err := os.Create(filepath.Join(t.TempDir(),"lls"))
+	if err!=nil { t.Fatal(err) }
+	t.Cleanup(func() { f.Close() })
+	return &mapfile.FileStore{File:f}
+}
+
+func alloc(t testing.TB, l *newtree.LLSBase) int64 {
+	id,err := l.PageAlloc()
+	if err!=nil { t.Fatal(err) }
+	return id
+}
+
+func fileSize(t testing.TB, s mapfile.LLS) int64 {
+	fi,err := s.Stat()
+	if err!=nil { t.Fatal(err) }
+	return fi.Size()
+}
+
+func TestLLSBase(t *testing.T) {
+	s := llsFile(t)
+	if _,err := newtree.OpenLLS(s,100); err!=newtree.EPageSize { t.Fatal(err) }
+	l,err := newtree.OpenLLS(s,256)
+	if err!=nil { t.Fatal(err) }
+	
+	/* Pages follow the superblock, freed pages are reused first. */
+	for i := int64(1); i<=4; i++ {
+		if id := alloc(t,l); id!=i*256 { t.Fatalf("page %d, want %d",id,i*256) }
+	}
+	if err = l.PageFree(512); err!=nil { t.Fatal(err) }
+	if err = l.PageFree(256); err!=nil { t.Fatal(err) }
+	if id := alloc(t,l); id!=256 { t.Fatalf("page %d, want 256",id) }
+	if id := alloc(t,l); id!=512 { t.Fatalf("page %d, want 512",id) }
+	if id := alloc(t,l); id!=5*256 { t.Fatalf("page %d, want %d",id,5*256) }
+	
+	/* Head slots are carved from a page, freed slots are reused. */
+	h1,err := l.HeadAlloc()
+	if err!=nil { t.Fatal(err) }
+	h2,_ := l.HeadAlloc()
+	if h1!=6*256 || h2!=h1+newtree.HeadSize { t.Fatalf("heads %d and %d",h1,h2) }
+	if err = l.HeadFree(h1); err!=nil { t.Fatal(err) }
+	if h,_ := l.HeadAlloc(); h!=h1 { t.Fatalf("head %d, want %d",h,h1) }
+	head := make([]byte,newtree.HeadSize)
+	copy(head,"head")
+	if err = l.HeadWrite(h2,head); err!=nil { t.Fatal(err) }
+	page := make([]byte,256)
+	copy(page,"page")
+	if err = l.PageWrite(768,page); err!=nil { t.Fatal(err) }
+	
+	/* The state survives reopening. */
+	if err = l.PageFree(1024); err!=nil { t.Fatal(err) }
+	if _,err = newtree.OpenLLS(s,512); err!=newtree.EPageSize { t.Fatal(err) }
+	l,err = newtree.OpenLLS(s,0)
+	if err!=nil { t.Fatal(err) }
+	if l.Page()!=256 { t.Fatalf("page size %d",l.Page()) }
+	if b,err := l.HeadRead(h2); err!=nil || string(b.Bytes()[:4])!="head" { t.Fatal(err) }
+	if b,err := l.PageRead(768); err!=nil || string(b.Bytes()[:4])!="page" { t.Fatal(err) }
+	if h,_ := l.HeadAlloc(); h!=h2+newtree.HeadSize { t.Fatalf("head %d, want %d",h,h2+newtree.HeadSize) }
+	if id := alloc(t,l); id!=1024 { t.Fatalf("page %d, want 1024",id) }
+	
+	s.WriteAt([]byte("x"),20)
+	if _,err = newtree.OpenLLS(s,0); !errors.Is(err,newtree.ECorrupt) { t.Fatal(err) }
+}
+
+func TestLLSBaseShrink(t *testing.T) {
+	s := llsFile(t)
+	l,err := newtree.OpenLLS(s,256)
+	if err!=nil { t.Fatal(err) }
+	for i := 0; i<8; i++ { alloc(t,l) }
+	for _,id := range []int64{8*256,3*256,7*256,5*256} {
+		if err = l.PageFree(id); err!=nil { t.Fatal(err) }
+	}
+	
+	/* The free list is sorted, the lowest free page below the limit comes first. */
+	if err = l.SortFree(); err!=nil { t.Fatal(err) }
+	if id,err := l.PageAllocBelow(3*256); err!=nil || id!=0 { t.Fatal(id,err) }
+	if id,err := l.PageAllocBelow(6*256); err!=nil || id!=3*256 { t.Fatal(id,err) }
+	if id,err := l.PageAllocBelow(5*256); err!=nil || id!=0 { t.Fatal(id,err) }
+	
+	/* Pages 7 and 8 are released, page 5 stays free. */
+	n,err := l.Shrink()
+	if err!=nil || n!=2*256 { t.Fatal(n,err) }
+	if sz := fileSize(t,s); sz!=7*256 { t.Fatalf("file of %d bytes",sz) }
+	if n,err = l.Shrink(); err!=nil || n!=0 { t.Fatal(n,err) }
+	l,err = newtree.OpenLLS(s,0)
+	if err!=nil { t.Fatal(err) }
+	if id := alloc(t,l); id!=5*256 { t.Fatalf("page %d, want %d",id,5*256) }
+	if id := alloc(t,l); id!=7*256 { t.Fatalf("page %d, want %d",id,7*256) }
+}
+
+/* Unless ZeroCopy is set, pages read from a MmapStore are not overwritten in place. */
+func TestLLSBaseZeroCopy(t *testing.T) {
+	m := &mapfile.MmapStore{LLS:llsFile(t)}
+	l,err := newtree.OpenLLS(m,256)
+	if err!=nil { t.Fatal(err) }
+	id := alloc(t,l)
+	if err = m.RefreshMmap(); err!=nil { t.Fatal(err) }
+	page := make([]byte,256)
+	for _,zc := range []bool{false,true} {
+		l.ZeroCopy = zc
+		copy(page,"old")
+		if err = l.PageWrite(id,page); err!=nil { t.Fatal(err) }
+		b,err := l.PageRead(id)
+		if err!=nil { t.Fatal(err) }
+		copy(page,"new")
+		if err = l.PageWrite(id,page); err!=nil { t.Fatal(err) }
+		if got := string(b.Bytes()[:3]); (got=="new")!=zc { t.Fatalf("ZeroCopy=%v: read %q",zc,got) }
+		b.Free()
+	}
+}
+
+/* A Tree, that overwrites pages in place. */
+func TestLLSBaseTree(t *testing.T) {
+	s := llsFile(t)
+	l,err := newtree.OpenLLS(s,256)
+	if err!=nil { t.Fatal(err) }
+	tr := ivTree(l)
+	obj,err := tr.NewRoot()
+	if err!=nil { t.Fatal(err) }
+	insertRange(t,tr,obj,0,300)
+	_,err = tr.Delete(context.Background(),obj,all,func(b []byte) bool { return ivKey(t,b)%3==0 })
+	if err!=nil { t.Fatal(err) }
+	
+	if l,err = newtree.OpenLLS(s,0); err!=nil { t.Fatal(err) }
+	tr = ivTree(l)
+	if got := keys(t,tr,obj,all); len(got)!=200 { t.Fatalf("%d keys",len(got)) }
+	verify(t,tr,obj)
+}
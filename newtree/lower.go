@@ -66,4 +66,5 @@ func (r *WriteAlloc) HeadWrite(id int64,b []byte) error {
 	_,err := r.F.WriteAt(b,id)
 	return err
 }
+func (r *WriteAlloc) Sync() error { return r.F.Sync() }
 //
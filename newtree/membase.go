@@ -0,0 +1,363 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+package newtree
+
+import "github.com/byte-mug/golibs/bufferex"
+import "encoding/binary"
+import "hash/crc32"
+import "context"
+import "runtime"
+import "errors"
+import "bufio"
+import "sort"
+import "sync"
+import "io"
+
+var ENoPage = errors.New("ENoPage")
+
+/*
+An IBase in Go memory, for temporary trees and tests. Page ids are offsets, as
+if the pages were stored in a file, freed ids are reused.
+
+Accesses to pages or heads, that are not allocated, fail with ENoPage. If
+TrackAllocs is set, the call stack of every allocation is recorded and
+reported by .Leaks().
+*/
+type MemBase struct{
+	P int
+	TrackAllocs bool
+	
+	mu     sync.RWMutex
+	next   int64
+	freed  []int64
+	pages  map[int64][]byte
+	heads  map[int64][]byte
+	stacks map[int64]string
+	stats  MemStats
+}
+
+/* Allocation counters of a MemBase. */
+type MemStats struct{
+	PageAllocs, PageFrees uint64
+	HeadAllocs, HeadFrees uint64
+	Pages, Heads int // Currently allocated.
+}
+
+type Leak struct{
+	ID    int64
+	Head  bool
+	Stack string // Only set, if TrackAllocs was set during the allocation.
+}
+
+func NewMemBase(page int) *MemBase {
+	return &MemBase{
+		P:      page,
+		next:   int64(page),
+		pages:  make(map[int64][]byte),
+		heads:  make(map[int64][]byte),
+		stacks: make(map[int64]string),
+	}
+}
+
+func (m *MemBase) Stats() MemStats {
+	m.mu.RLock(); defer m.mu.RUnlock()
+	s := m.stats
+	s.Pages = len(m.pages)
+	s.Heads = len(m.heads)
+	return s
+}
+
+/* Must be called with m.mu held. */
+func (m *MemBase) alloc() (id int64) {
+	if n := len(m.freed); n>0 {
+		id = m.freed[n-1]
+		m.freed = m.freed[:n-1]
+	} else {
+		id = m.next
+		m.next += int64(m.P)
+	}
+	if m.TrackAllocs {
+		buf := make([]byte,4096)
+		m.stacks[id] = string(buf[:runtime.Stack(buf,false)])
+	}
+	return
+}
+
+/* Must be called with m.mu held. */
+func (m *MemBase) release(id int64) {
+	delete(m.stacks,id)
+	m.freed = append(m.freed,id)
+}
+
+func (m *MemBase) Page() int { return m.P }
+func (m *MemBase) PageAlloc() (int64,error) {
+	m.mu.Lock(); defer m.mu.Unlock()
+	return m.pageAlloc(),nil
+}
+
+/* Must be called with m.mu held. */
+func (m *MemBase) pageAlloc() int64 {
+	id := m.alloc()
+	m.pages[id] = make([]byte,m.P)
+	m.stats.PageAllocs++
+	return id
+}
+func (m *MemBase) PageRead(id int64) (bufferex.Binary,error) {
+	m.mu.RLock(); defer m.mu.RUnlock()
+	p,ok := m.pages[id]
+	if !ok { return bufferex.Binary{},ENoPage }
+	b := bufferex.AllocBinary(m.P)
+	copy(b.Bytes(),p)
+	return b,nil
+}
+func (m *MemBase) PageWrite(id int64,b []byte) error {
+	m.mu.Lock(); defer m.mu.Unlock()
+	p,ok := m.pages[id]
+	if !ok { return ENoPage }
+	copy(p,b)
+	return nil
+}
+func (m *MemBase) PageFree(id int64) error {
+	m.mu.Lock(); defer m.mu.Unlock()
+	if _,ok := m.pages[id]; !ok { return ENoPage }
+	delete(m.pages,id)
+	m.release(id)
+	m.stats.PageFrees++
+	return nil
+}
+func (m *MemBase) HeadAlloc() (int64,error) {
+	m.mu.Lock(); defer m.mu.Unlock()
+	id := m.alloc()
+	m.heads[id] = make([]byte,HeadSize)
+	m.stats.HeadAllocs++
+	return id,nil
+}
+func (m *MemBase) HeadRead(id int64) (bufferex.Binary,error) {
+	m.mu.RLock(); defer m.mu.RUnlock()
+	p,ok := m.heads[id]
+	if !ok { return bufferex.Binary{},ENoPage }
+	b := bufferex.AllocBinary(HeadSize)
+	copy(b.Bytes(),p)
+	return b,nil
+}
+func (m *MemBase) HeadWrite(id int64,b []byte) error {
+	m.mu.Lock(); defer m.mu.Unlock()
+	p,ok := m.heads[id]
+	if !ok { return ENoPage }
+	copy(p,b)
+	return nil
+}
+func (m *MemBase) HeadFree(id int64) error {
+	m.mu.Lock(); defer m.mu.Unlock()
+	if _,ok := m.heads[id]; !ok { return ENoPage }
+	delete(m.heads,id)
+	m.release(id)
+	m.stats.HeadFrees++
+	return nil
+}
+
+/* Orders the freed ids, so that the lowest one is allocated first. */
+func (m *MemBase) SortFree() error {
+	m.mu.Lock(); defer m.mu.Unlock()
+	sort.Slice(m.freed,func(i,j int) bool { return m.freed[i]>m.freed[j] })
+	return nil
+}
+
+/* Allocates the next freed id, if it is below id, otherwise returns 0. */
+func (m *MemBase) PageAllocBelow(id int64) (int64,error) {
+	m.mu.Lock(); defer m.mu.Unlock()
+	n := len(m.freed)
+	if n==0 || m.freed[n-1]>=id { return 0,nil }
+	return m.pageAlloc(),nil
+}
+
+/*
+Forgets the freed ids at the end of the id space, as if a file was truncated.
+Returns the number of bytes released.
+*/
+func (m *MemBase) Shrink() (int64,error) {
+	m.mu.Lock(); defer m.mu.Unlock()
+	set := make(map[int64]bool,len(m.freed))
+	for _,id := range m.freed { set[id] = true }
+	old := m.next
+	for m.next>int64(m.P) && set[m.next-int64(m.P)] { m.next -= int64(m.P) }
+	i := 0
+	for _,id := range m.freed {
+		if id<m.next { m.freed[i] = id; i++ }
+	}
+	m.freed = m.freed[:i]
+	sort.Slice(m.freed,func(i,j int) bool { return m.freed[i]>m.freed[j] })
+	return old-m.next,nil
+}
+
+/*
+Returns the head reserved for the Catalog. Its id is 0, which is never
+allocated otherwise.
+*/
+func (m *MemBase) CatalogHead() (int64,error) {
+	m.mu.Lock(); defer m.mu.Unlock()
+	if _,ok := m.heads[0]; !ok { m.heads[0] = make([]byte,HeadSize) }
+	return 0,nil
+}
+
+/*
+Returns all pages and heads, that are allocated, but neither belong to one of
+the trees objs of t nor are one of the heads objs. Pages, that were freed by t
+but are not yet released (see Tree.Reclaim()), are reported as well. The head
+reserved by .CatalogHead() is never reported.
+*/
+func (m *MemBase) Leaks(ctx context.Context, t *Tree, objs ...int64) ([]Leak,error) {
+	seen := make(map[int64]bool)
+	t.cc.writer.Lock()
+	for _,obj := range objs {
+		s := make(map[int64]bool)
+		_,err := t.verify(ctx,obj,s)
+		if err!=nil { t.cc.writer.Unlock(); return nil,err }
+		for id := range s { seen[id] = true }
+		seen[obj] = true
+	}
+	t.cc.writer.Unlock()
+	
+	seen[0] = true
+	
+	m.mu.RLock(); defer m.mu.RUnlock()
+	var leaks []Leak
+	for id := range m.pages {
+		if !seen[id] { leaks = append(leaks,Leak{id,false,m.stacks[id]}) }
+	}
+	for id := range m.heads {
+		if !seen[id] { leaks = append(leaks,Leak{id,true,m.stacks[id]}) }
+	}
+	sort.Slice(leaks,func(i,j int) bool { return leaks[i].ID<leaks[j].ID })
+	return leaks,nil
+}
+
+/* -------------------------------------------------------------------------------- */
+
+const memMagic = "GiSTMEM1"
+
+/*
+Serializes the MemBase. It must not be modified concurrently.
+
+	magic "GiSTMEM1" | uint32 page size | int64 next
+	uint64 n | n * (int64 id | page)
+	uint64 n | n * (int64 id | head)
+	uint64 n | n * int64 freed id
+	uint32 CRC32C of all preceding bytes
+*/
+func (m *MemBase) WriteTo(w io.Writer) (int64,error) {
+	m.mu.RLock(); defer m.mu.RUnlock()
+	cw := &crcWriter{w:bufio.NewWriter(w)}
+	var num [8]byte
+	put := func(v uint64) { binary.LittleEndian.PutUint64(num[:],v); cw.write(num[:]) }
+	cw.write([]byte(memMagic))
+	binary.LittleEndian.PutUint32(num[:],uint32(m.P))
+	cw.write(num[:4])
+	put(uint64(m.next))
+	for _,set := range []map[int64][]byte{m.pages,m.heads} {
+		ids := make([]int64,0,len(set))
+		for id := range set { ids = append(ids,id) }
+		sort.Slice(ids,func(i,j int) bool { return ids[i]<ids[j] })
+		put(uint64(len(ids)))
+		for _,id := range ids {
+			put(uint64(id))
+			cw.write(set[id])
+		}
+	}
+	put(uint64(len(m.freed)))
+	for _,id := range m.freed { put(uint64(id)) }
+	binary.LittleEndian.PutUint32(num[:],cw.sum)
+	cw.write(num[:4])
+	if cw.err==nil { cw.err = cw.w.Flush() }
+	return cw.n,cw.err
+}
+
+/* The greatest page size, ReadMemBase() accepts. */
+const maxMemPage = 1<<24
+
+/*
+Reads a MemBase written by .WriteTo(). A page size, that cannot hold a page
+header and a head, or that exceeds 16 MiB, is rejected with EPageSize, before
+any page is allocated.
+*/
+func ReadMemBase(r io.Reader) (*MemBase,error) {
+	cr := &crcReader{r:bufio.NewReader(r)}
+	var num [8]byte
+	get := func() int64 { cr.read(num[:]); return int64(binary.LittleEndian.Uint64(num[:])) }
+	magic := make([]byte,len(memMagic))
+	cr.read(magic)
+	if cr.err!=nil { return nil,cr.err }
+	if string(magic)!=memMagic { return nil,ECorrupt }
+	cr.read(num[:4])
+	if cr.err!=nil { return nil,cr.err }
+	ps := binary.LittleEndian.Uint32(num[:])
+	if ps<pageHeader+HeadSize || ps>maxMemPage { return nil,EPageSize }
+	m := NewMemBase(int(ps))
+	m.next = get()
+	size := m.P
+	for _,set := range []map[int64][]byte{m.pages,m.heads} {
+		n := get()
+		for i := int64(0); i<n && cr.err==nil; i++ {
+			id := get()
+			p := make([]byte,size)
+			cr.read(p)
+			set[id] = p
+		}
+		size = HeadSize
+	}
+	n := get()
+	for i := int64(0); i<n && cr.err==nil; i++ { m.freed = append(m.freed,get()) }
+	sum := cr.sum
+	cr.read(num[:4])
+	if cr.err!=nil { return nil,cr.err }
+	if binary.LittleEndian.Uint32(num[:])!=sum { return nil,ECorrupt }
+	return m,nil
+}
+
+type crcWriter struct{
+	w   *bufio.Writer
+	sum uint32
+	n   int64
+	err error
+}
+func (c *crcWriter) write(p []byte) {
+	if c.err!=nil { return }
+	var n int
+	n,c.err = c.w.Write(p)
+	c.n += int64(n)
+	c.sum = crc32.Update(c.sum,crcTable,p[:n])
+}
+
+type crcReader struct{
+	r   io.Reader
+	sum uint32
+	err error
+}
+func (c *crcReader) read(p []byte) {
+	if c.err!=nil { return }
+	var n int
+	n,c.err = io.ReadFull(c.r,p)
+	c.sum = crc32.Update(c.sum,crcTable,p[:n])
+}
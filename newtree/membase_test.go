@@ -0,0 +1,61 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+
+
+package newtree_test
+
+import "github.com/maxymania/gonbase/newtree"
+import "bytes"
+import "encoding/binary"
+import "testing"
+
+func TestMemBaseReadWrite(t *testing.T) {
+	mb := newtree.NewMemBase(256)
+	tr := ivTree(mb)
+	obj,_ := tr.NewRoot()
+	insertRange(t,tr,obj,0,500)
+	var buf bytes.Buffer
+	if _,err := mb.WriteTo(&buf); err!=nil { t.Fatal(err) }
+	img := buf.Bytes()
+	
+	mb2,err := newtree.ReadMemBase(bytes.NewReader(img))
+	if err!=nil { t.Fatal(err) }
+	tr2 := ivTree(mb2)
+	if got := keys(t,tr2,obj,all); len(got)!=500 { t.Fatalf("%d keys",len(got)) }
+	verify(t,tr2,obj)
+	
+	/* The page size follows the 8 bytes of magic. */
+	for _,ps := range []uint32{0,1,27,1<<25,1<<32-1} {
+		bad := append([]byte(nil),img...)
+		binary.LittleEndian.PutUint32(bad[8:],ps)
+		if _,err = newtree.ReadMemBase(bytes.NewReader(bad)); err!=newtree.EPageSize { t.Errorf("page size %d: %v",ps,err) }
+	}
+	bad := append([]byte(nil),img...)
+	bad[len(bad)/2] ^= 1
+	if _,err = newtree.ReadMemBase(bytes.NewReader(bad)); err!=newtree.ECorrupt { t.Errorf("flipped bit: %v",err) }
+	for _,n := range []int{0,4,10,100,len(img)-1} {
+		if _,err = newtree.ReadMemBase(bytes.NewReader(img[:n])); err==nil { t.Errorf("truncated to %d bytes: no error",n) }
+	}
+}
@@ -0,0 +1,123 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+package newtree
+
+import "container/heap"
+import "context"
+import "errors"
+import "math"
+
+var ENoDistance = errors.New("ENoDistance")
+
+// Optional extension to TreeOps, required by .NearestSearch().
+//
+// Distance(p,q) must not be greater than the distance of any element, that
+// is covered by p (a lower bound), otherwise the results are not ordered.
+// Elements with a distance of +Inf are skipped, so unknown queries and
+// undecodable keys should have a distance of +Inf.
+type DistanceOps interface{
+	Distance(p []byte, q interface{}) float64
+}
+
+type nnItem struct{
+	dist float64
+	ptr  int64
+	plsn uint64
+	val  []byte
+}
+type nnQueue []nnItem
+func (n nnQueue) Len() int { return len(n) }
+func (n nnQueue) Less(i, j int) bool {
+	if n[i].dist != n[j].dist { return n[i].dist < n[j].dist }
+	/* Report leaf-elements as early as possible. */
+	return n[i].ptr==0 && n[j].ptr!=0
+}
+func (n nnQueue) Swap(i, j int) { n[i],n[j] = n[j],n[i] }
+func (n *nnQueue) Push(x interface{}) { *n = append(*n,x.(nnItem)) }
+func (n *nnQueue) Pop() interface{} {
+	o := *n
+	i := len(o)-1
+	x := o[i]
+	o[i] = nnItem{}
+	*n = o[:i]
+	return x
+}
+
+func (t *Tree) nnExpand(d DistanceOps, pq *nnQueue, p nnItem, ver uint16, q interface{}) error {
+	b,node,lsn,err := t.readPage(p.ptr,ver)
+	defer freeElements(node)
+	defer b.Free()
+	if err!=nil { return err }
+	for _,e := range node {
+		err = t.resolveElement(p.ptr,&e)
+		if err!=nil { return err }
+		dist := d.Distance(e.Val,q)
+		if math.IsInf(dist,1) { continue }
+		it := nnItem{dist:dist,ptr:e.Ptr,plsn:lsn}
+		if e.Ptr==0 { it.val = append([]byte(nil),e.Val...) }
+		heap.Push(pq,it)
+	}
+	for _,sib := range t.movedFrom(p.ptr,p.plsn,lsn) {
+		heap.Push(pq,nnItem{dist:p.dist,ptr:sib,plsn:p.plsn})
+	}
+	return nil
+}
+
+/*
+Reports the k leaf-elements closest to q in increasing distance order. If k<=0,
+all elements with a finite distance are reported. This requires .Ops to
+implement DistanceOps, otherwise ENoDistance is returned.
+*/
+func (t *Tree) NearestSearch(
+	ctx context.Context,
+	obj int64,
+	q interface{},
+	k int,
+	consumer func([]byte)) error {
+	d,ok := t.Ops.(DistanceOps)
+	if !ok { return ENoDistance }
+	defer t.endRead(t.beginRead())
+	rr,lsn,err := t.readRoot(obj)
+	if err!=nil || rr.Ptr==0 { return err }
+	
+	pq := new(nnQueue)
+	err = t.nnExpand(d,pq,nnItem{ptr:rr.Ptr,plsn:lsn},rr.Version,q)
+	if err!=nil { return err }
+	for pq.Len()>0 {
+		err = ctx.Err()
+		if err!=nil { return err }
+		it := heap.Pop(pq).(nnItem)
+		if it.ptr==0 {
+			consumer(it.val)
+			k--
+			if k==0 { break }
+			continue
+		}
+		err = t.nnExpand(d,pq,it,rr.Version,q)
+		if err!=nil { return err }
+	}
+	return nil
+}
+
@@ -0,0 +1,148 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+
+
+package newtree_test
+
+import "github.com/maxymania/gonbase/newtree"
+import "github.com/maxymania/gonbase/ntops"
+import "context"
+import "fmt"
+import "math"
+import "math/big"
+import "sort"
+import "testing"
+
+func TestNearestSearch(t *testing.T) {
+	ctx := context.Background()
+	tr := ivTree(newtree.NewMemBase(256))
+	obj,_ := tr.NewRoot()
+	insertRange(t,tr,obj,0,1000)
+	
+	var got []int64
+	err := tr.NearestSearch(ctx,obj,ntops.IntervalStab[int64]{At:500},5,func(b []byte) { got = append(got,ivKey(t,b)) })
+	if err!=nil { t.Fatal(err) }
+	/* The four intervals k..k+k%7 containing 500, then one at a distance of 1. */
+	dist := func(k int64) int64 {
+		if k>500 { return k-500 }
+		if k+k%7<500 { return 500-k-k%7 }
+		return 0
+	}
+	if len(got)!=5 { t.Fatal(got) }
+	for i,k := range got {
+		if want := int64(i/4); dist(k)!=want { t.Fatalf("%d at %d: distance %d, want %d",k,i,dist(k),want) }
+	}
+	
+	/* No element is near to a query, the TreeOps do not know. */
+	got = nil
+	err = tr.NearestSearch(ctx,obj,"unknown",0,func(b []byte) { got = append(got,ivKey(t,b)) })
+	if err!=nil || len(got)!=0 { t.Fatal(got,err) }
+}
+
+/* Unknown queries and undecodable keys are infinitely far away. */
+func TestDistanceInf(t *testing.T) {
+	bad := []byte{0xc1,0xff,0x00}
+	for _,x := range []struct{
+		ops  newtree.DistanceOps
+		key  []byte
+		q    interface{}
+	}{
+		{ntops.IntervalOps{},ivElem(1),ntops.IntervalStab[int64]{At:1}},
+		{ntops.StrOps{},ntops.EncodePair([]byte("a"),[]byte("b")),&ntops.StrRange{Low:[]byte("a"),High:[]byte("b")}},
+		{ntops.GroupOps{},(&ntops.GroupEntry{GroupID:1,Article:2}).Marshal(),&ntops.GroupQuery{GroupID:1,ArticleLow:0,ArticleHigh:5}},
+	} {
+		if d := x.ops.Distance(x.key,x.q); d!=0 { t.Errorf("%T: distance %v, want 0",x.ops,d) }
+		if d := x.ops.Distance(x.key,"unknown"); !math.IsInf(d,1) { t.Errorf("%T: unknown query: distance %v",x.ops,d) }
+		if d := x.ops.Distance(bad,x.q); !math.IsInf(d,1) { t.Errorf("%T: undecodable key: distance %v",x.ops,d) }
+	}
+}
+
+/* Checks, that got are the n nearest of all, in order of dist. */
+func nearest(t testing.TB, got, all []int64, n int, dist func(int64) float64) {
+	sort.SliceStable(all,func(i,j int) bool { return dist(all[i])<dist(all[j]) })
+	if len(got)!=n { t.Fatalf("%d elements, want %d",len(got),n) }
+	for i,k := range got {
+		if dist(k)!=dist(all[i]) { t.Fatalf("%d at %d: distance %v, want %v",k,i,dist(k),dist(all[i])) }
+	}
+}
+
+func TestNearestSearchGroup(t *testing.T) {
+	tr := &newtree.Tree{IBase:newtree.NewMemBase(256),Ops:ntops.GroupOps{}}
+	obj,_ := tr.NewRoot()
+	var all []int64
+	for i := uint64(0); i<600; i++ {
+		g := &ntops.GroupEntry{GroupID:i%2,Article:i*7%600,Expires:i}
+		if err := tr.Insert(obj,g.Marshal()); err!=nil { t.Fatal(err) }
+		if g.GroupID==1 { all = append(all,int64(g.Article)) }
+	}
+	dist := func(a int64) float64 { return math.Abs(float64(a-301)) }
+	var got []int64
+	err := tr.NearestSearch(context.Background(),obj,&ntops.GroupEntry{GroupID:1,Article:301},9,func(b []byte) {
+		var g ntops.GroupEntry
+		if err := g.Unmarshal(b); err!=nil || g.GroupID!=1 { t.Fatal(g,err) }
+		got = append(got,int64(g.Article))
+	})
+	if err!=nil { t.Fatal(err) }
+	nearest(t,got,all,9,dist)
+}
+
+/* The keys share a prefix longer than 8 bytes. */
+func TestNearestSearchStr(t *testing.T) {
+	tr := &newtree.Tree{IBase:newtree.NewMemBase(256),Ops:ntops.StrOps{}}
+	obj,_ := tr.NewRoot()
+	key := func(i int64) []byte { return []byte(fmt.Sprintf("a/common/prefix/%04d",i)) }
+	var all []int64
+	for i := int64(0); i<500; i++ {
+		k := i*13%500
+		if k==250 { continue }
+		if err := tr.Insert(obj,ntops.EncodePair(key(k),key(k))); err!=nil { t.Fatal(err) }
+		all = append(all,k)
+	}
+	/* The keys as base-256 fractions, so that their distances follow their order. */
+	frac := func(b []byte) *big.Rat {
+		r := new(big.Rat)
+		for i := len(b)-1; i>=0; i-- {
+			r.Add(r,big.NewRat(int64(b[i]),1))
+			r.Quo(r,big.NewRat(256,1))
+		}
+		return r
+	}
+	d := make(map[int64]float64)
+	for _,k := range all {
+		f,_ := new(big.Rat).Sub(frac(key(k)),frac(key(250))).Float64()
+		d[k] = math.Abs(f)
+	}
+	dist := func(k int64) float64 { return d[k] }
+	var got []int64
+	err := tr.NearestSearch(context.Background(),obj,&ntops.StrRange{Low:key(250),High:key(250)},7,func(b []byte) {
+		v,err := ntops.StrCodec{}.Decode(b)
+		if err!=nil { t.Fatal(err) }
+		var k int64
+		fmt.Sscanf(string(v.Key),"a/common/prefix/%d",&k)
+		got = append(got,k)
+	})
+	if err!=nil { t.Fatal(err) }
+	nearest(t,got,all,7,dist)
+}
@@ -25,37 +25,94 @@ package newtree
 
 import "github.com/byte-mug/golibs/bufferex"
 import "context"
+import "sync"
 
+/*
+A Tree may be used by multiple goroutines. Writers are serialized, readers run
+concurrently with the writer (see concur.go). Therefore the IBase must support
+concurrent calls.
+*/
 type Tree struct {
 	IBase
 	Ops TreeOps
+	
+	// The name, .Ops are registered under, see RegisterOps(). It is written
+	// into dumps, see .Dump(). If empty, it is looked up by the type of .Ops.
+	OpsName string
+	
+	// If true, modified pages are written to newly allocated pages instead of
+	// being overwritten, and the old pages are freed, once no reader or Snapshot
+	// can reach them anymore. The new state becomes visible at once, when the
+	// Root is written. See .Snapshot().
+	CopyOnWrite bool
+	
+	// How overflowing nodes are split. If nil, Ops.FirstSplit() is used. If it
+	// implements ReinsertStrategy, .Insert() does forced reinsertion.
+	Split SplitStrategy
+	
+	// The minimum fill of a page, as a fraction of its capacity. If greater
+	// than 0, .Delete() merges underfull pages with their siblings. Elements,
+	// that are reinserted, may be missed by concurrent readers, unless
+	// CopyOnWrite is used.
+	MinFill float64
+	
+	// The key, continuation tokens are authenticated with (HMAC-SHA256), see
+	// Cursor.Token(). If empty, a random key is chosen, so that the tokens are
+	// only accepted by this Tree.
+	TokenKey []byte
+	
+	cc     concurrency
+	tokKey sync.Once
+	rndKey []byte
 }
 
 /* -------------------------------------------------------------------------------- */
 
-func (t *Tree) getPage(id int64) (b bufferex.Binary,e Elements,err error) {
+/* Reads page id of a tree with the Root format version ver. */
+func (t *Tree) getPage(id int64, ver uint16) (b bufferex.Binary,e Elements,err error) {
+	b,e,_,err = t.readNode(id,ver)
+	return
+}
+
+/* Reads and decodes page id. legacy is true, if the page has no header. */
+func (t *Tree) readNode(id int64, ver uint16) (b bufferex.Binary,e Elements,legacy bool,err error) {
+	b,e,legacy,err = t.rawNode(id,ver)
+	if err!=nil { return }
+	err = t.resolve(id,e)
+	return
+}
+/* Like .readNode(), but overflowed values are not resolved. */
+func (t *Tree) rawNode(id int64, ver uint16) (b bufferex.Binary,e Elements,legacy bool,err error) {
 	e = allocElements()
 	b,err = t.PageRead(id)
 	if err!=nil { return }
-	_,err = e.BinDecode(b.Bytes())
+	p,legacy,err := pageOpen(id,b.Bytes(),pageNode,ver)
+	if err!=nil { return }
+	_,err = e.BinDecode(p)
+	if err!=nil { err = &CorruptPageError{id,err.Error()} }
 	return
 }
-func (t *Tree) insertPage(e Elements) (int64,error) {
+func (t *Tree) encodePage(e Elements) (bufferex.Binary,error) {
 	b := bufferex.AllocBinary(t.Page())
-	defer b.Free()
-	_,err := e.BinEncode(b.Bytes())
+	_,err := e.BinEncode(b.Bytes()[pageHeader:])
+	if err!=nil { b.Free(); return b,err }
+	pageSeal(b.Bytes(),pageNode)
+	return b,nil
+}
+func (t *Tree) insertPage(e Elements) (int64,error) {
+	b,err := t.encodePage(e)
 	if err!=nil { return 0,err }
+	defer b.Free()
 	id,err := t.PageAlloc()
 	if err!=nil { return 0,err }
-	err = t.PageWrite(id,b.Bytes())
+	err = t.writeLatched(id,b.Bytes(),nil)
 	return id,err
 }
-func (t *Tree) putPage(id int64, e Elements) error {
-	b := bufferex.AllocBinary(t.Page())
-	defer b.Free()
-	_,err := e.BinEncode(b.Bytes())
+func (t *Tree) putPage(id int64, e Elements, moved []int64) error {
+	b,err := t.encodePage(e)
 	if err!=nil { return err }
-	return t.PageWrite(id,b.Bytes())
+	defer b.Free()
+	return t.writeLatched(id,b.Bytes(),moved)
 }
 func (t *Tree) getRoot(id int64) (rr Root,re error) {
 	b,err := t.HeadRead(id)
@@ -65,48 +122,107 @@ func (t *Tree) getRoot(id int64) (rr Root,re error) {
 	return
 }
 func (t *Tree) putRoot(id int64,rr Root) error {
+	/* An empty tree has no legacy pages. */
+	if rr.Ptr==0 { rr.Version = FormatVersion }
 	b := bufferex.AllocBinary(HeadSize)
 	defer b.Free()
 	err := rr.BinEncode(b.Bytes())
 	if err!=nil { return err }
-	return t.HeadWrite(id,b.Bytes())
+	return t.writeHeadLatched(id,b.Bytes())
 }
 
-func (t *Tree) NewRoot() (int64,error) {
+/*
+Stores node into page id. Elements, that do not fit, are moved into new pages,
+which are written before page id. Returns the elements for the parent page.
+
+In CopyOnWrite-mode, node is stored into a new page and page id is freed.
+*/
+func (t *Tree) storeNode(id int64, node Elements) (r_elems Elements, err error) {
+	var moved []int64
+	cur,rest := t.firstSplit(node)
+	r_elems = Elements{{Ptr:id,Val:t.Ops.Union(cur)}}
+	for len(rest)>0 {
+		var e Element
+		var next Elements
+		next,rest = t.firstSplit(rest)
+		e.Ptr,err = t.insertPage(next)
+		if err!=nil { return }
+		e.Val = t.Ops.Union(next)
+		r_elems = append(r_elems,e)
+		moved = append(moved,e.Ptr)
+	}
+	if t.CopyOnWrite {
+		r_elems[0].Ptr,err = t.insertPage(cur)
+		if err!=nil { return }
+		err = t.freePage(id)
+		return
+	}
+	err = t.putPage(id,cur,moved)
+	return
+}
+
+func (t *Tree) firstSplit(P Elements) (Elements,Elements) {
+	return t.splitAt(P,t.pageCap())
+}
+func (t *Tree) splitAt(P Elements, maxsize int) (Elements,Elements) {
+	if t.Split!=nil { return t.Split.Split(t.Ops,P,maxsize) }
+	return t.Ops.FirstSplit(P,maxsize)
+}
+
+func (t *Tree) NewRoot() (_ int64,err error) {
+	if err = t.beginWrite(); err!=nil { return }
+	defer t.endWrite(&err)
 	id,err := t.HeadAlloc()
 	if err!=nil { return 0,err }
-	err = t.putRoot(id,Root{0,0})
+	err = t.putRoot(id,Root{})
 	return id,err
 }
 
 /* -------------------------------------------------------------------------------- */
 
-func (t *Tree) insert(id int64,nitem []byte) (r_elems Elements, r_err error) {
-	b,node,err := t.getPage(id)
+/* State of an .Insert(), for forced reinsertion. */
+type insertState struct{
+	re      ReinsertStrategy
+	root    int
+	ver     uint16
+	done    map[int]bool
+	pending []pendingElement
+}
+type pendingElement struct{
+	e     Element
+	level int
+}
+
+/*
+Inserts nitem into the node at level at (1 = leaves) below page id, which is
+at level lvl.
+*/
+func (t *Tree) insert(id int64, lvl int, nitem Element, at int, st *insertState) (r_elems Elements, r_err error) {
+	b,node,err := t.getPage(id,st.ver)
 	defer freeElements(node)
 	defer b.Free()
 	if err!=nil { r_err = err; return }
 	
 	r_elems = Elements{{Ptr:id}}
 	
-	if node.IsLeaf() {
-		node = append(node,Element{Val:nitem})
+	if lvl<=at {
+		node = append(node,nitem)
 	} else {
 		sp := -1
 		sc := float64(0)
 		for i,e := range node {
-			c := t.Ops.Penalty(e.Val,nitem)
+			c := t.Ops.Penalty(e.Val,nitem.Val)
 			if (sp < 0) || (sc > c) {
 				sp = i
 				sc = c
 			}
 		}
 		
-		s_elems,err := t.insert(node[sp].Ptr,nitem)
+		s_elems,err := t.insert(node[sp].Ptr,lvl-1,nitem,at,st)
 		if err!=nil { r_err = err; return }
 		if len(s_elems)==0 {
 			r_elems = nil
-			r_err = t.PageFree(id)
+			r_err = t.freePage(id)
 			return
 		}
 		node[sp] = s_elems[0]
@@ -117,55 +233,90 @@ func (t *Tree) insert(id int64,nitem []byte) (r_elems Elements, r_err error) {
 	
 	//meterTime()
 	t.Ops.Sort(node)
-	{
-		cur,rest := t.Ops.FirstSplit(node,t.Page())
-		err = t.putPage(id,cur)
-		if err!=nil { r_err = err; return }
-		r_elems[0].Val = t.Ops.Union(cur)
-		
-		for len(rest)>0 {
-			var e Element
-			cur,rest = t.Ops.FirstSplit(rest,t.Page())
-			e.Ptr,err = t.insertPage(cur)
-			if err!=nil { r_err = err; return }
-			e.Val = t.Ops.Union(cur)
-			r_elems = append(r_elems,e)
+	if st.re!=nil && lvl<st.root && !st.done[lvl] && node.Length()>t.pageCap() {
+		st.done[lvl] = true
+		keep,out := st.re.Reinsert(t.Ops,node,t.pageCap())
+		for _,e := range out {
+			/* e.Val may refer to the page buffer. */
+			e.Val = append([]byte(nil),e.Val...)
+			st.pending = append(st.pending,pendingElement{e,lvl})
 		}
+		node = keep
 	}
+	r_elems,r_err = t.storeNode(id,node)
 	
 	return
 }
 
-func (t *Tree) Insert(obj int64,nitem []byte) error {
+func (t *Tree) newInsertState() *insertState {
+	st := new(insertState)
+	if re,ok := t.Split.(ReinsertStrategy); ok {
+		st.re = re
+		st.done = make(map[int]bool)
+	}
+	return st
+}
+
+/* Inserts nitem at level at into the tree rr, and returns the new Root. */
+func (t *Tree) insertAt(rr Root, nitem Element, at int, st *insertState) (Root,error) {
+	st.root = int(rr.Depth)
+	st.ver = rr.Version
+	elems,err := t.insert(rr.Ptr,int(rr.Depth),nitem,at,st)
+	if err!=nil { return rr,err }
+	
+	if len(elems)==0 {
+		return Root{},nil
+	} else if len(elems) > 1 {
+		id,err := t.insertPage(elems)
+		if err!=nil { return rr,err }
+		rr.Ptr = id
+		rr.Depth++
+		return rr,nil
+	}
+	/* For whatever reason, the pointer may have changed. */
+	rr.Ptr = elems[0].Ptr
+	return rr,nil
+}
+
+/* Inserts the pending elements of st (see ReinsertStrategy) into the tree rr. */
+func (t *Tree) insertPending(rr Root, st *insertState) (_ Root, err error) {
+	for len(st.pending)>0 {
+		p := st.pending[0]
+		st.pending = st.pending[1:]
+		rr,err = t.insertAt(rr,p.e,p.level,st)
+		if err!=nil { break }
+	}
+	return rr,err
+}
+
+func (t *Tree) Insert(obj int64,nitem []byte) (err error) {
+	if err = t.beginWrite(); err!=nil { return }
+	defer t.endWrite(&err)
 	rr,err := t.getRoot(obj)
 	if err!=nil { return err }
 	
+	ne,err := t.leafElement(nitem)
+	if err!=nil { return err }
+	return t.insertRoot(obj,rr,ne)
+}
+
+/* Inserts the leaf-element ne into the tree obj with the Root rr. */
+func (t *Tree) insertRoot(obj int64, rr Root, ne Element) error {
 	if rr.Ptr==0 {
-		id,err := t.insertPage(Elements{{Val:nitem}})
+		id,err := t.insertPage(Elements{ne})
 		if err!=nil { return err }
 		rr.Ptr   = id
 		rr.Depth = 1
+		rr.Version = FormatVersion
 		return t.putRoot(obj,rr)
 	}
 	
-	elems,err := t.insert(rr.Ptr,nitem)
+	st := t.newInsertState()
+	nr,err := t.insertAt(rr,ne,1,st)
+	if err==nil { nr,err = t.insertPending(nr,st) }
 	if err!=nil { return err }
 	
-	if len(elems)==0 {
-		return t.PageFree(rr.Ptr)
-	} else if len(elems) > 1 {
-		id,err := t.insertPage(elems)
-		if err!=nil { return err }
-		rr.Ptr = id
-		rr.Depth++
-		return t.putRoot(obj,rr)
-	}
-	if rr.Ptr!=elems[0].Ptr {
-		/* For whatever reason, the pointer changed. Update it. */
-		rr.Ptr = elems[0].Ptr
-		return t.putRoot(obj,rr)
-	}
-	
+	if nr!=rr { return t.putRoot(obj,nr) }
 	return nil
 }
 
@@ -174,25 +325,33 @@ func (t *Tree) Insert(obj int64,nitem []byte) error {
 func (t *Tree) search(
 	ctx context.Context,
 	id int64,
+	plsn uint64,
+	ver uint16,
 	q interface{},
 	consumer func([]byte)) error {
-	b,node,err := t.getPage(id)
+	b,node,lsn,err := t.readPage(id,ver)
 	defer freeElements(node)
 	defer b.Free()
 	if err!=nil { return err }
 	
 	for _,e := range node {
+		err = t.resolveElement(id,&e)
+		if err!=nil { return err }
 		if t.Ops.Consistent(e.Val,q) {
 			err := ctx.Err()
 			if err!=nil { return err }
 			if e.Ptr == 0 {
 				consumer(e.Val)
 			} else {
-				err = t.search(ctx,e.Ptr,q,consumer)
+				err = t.search(ctx,e.Ptr,lsn,ver,q,consumer)
 				if err!=nil { return err }
 			}
 		}
 	}
+	for _,sib := range t.movedFrom(id,plsn,lsn) {
+		err = t.search(ctx,sib,plsn,ver,q,consumer)
+		if err!=nil { return err }
+	}
 	return nil
 }
 func (t *Tree) Search(
@@ -200,9 +359,10 @@ func (t *Tree) Search(
 	obj int64,
 	q interface{},
 	consumer func([]byte)) error {
-	rr,err := t.getRoot(obj)
-	if err!=nil { return err }
-	return t.search(ctx,rr.Ptr,q,consumer)
+	defer t.endRead(t.beginRead())
+	rr,lsn,err := t.readRoot(obj)
+	if err!=nil || rr.Ptr==0 { return err }
+	return t.search(ctx,rr.Ptr,lsn,rr.Version,q,consumer)
 }
 
 /* -------------------------------------------------------------------------------- */
@@ -210,24 +370,32 @@ func (t *Tree) Search(
 func (t *Tree) gsearch(
 	ctx context.Context,
 	id int64,
+	plsn uint64,
+	ver uint16,
 	q interface{},
 	consume func(b []byte) bool) error {
-	b,node,err := t.getPage(id)
+	b,node,lsn,err := t.readPage(id,ver)
 	defer freeElements(node)
 	defer b.Free()
 	if err!=nil { return err }
 	
 	for _,e := range node {
+		err = t.resolveElement(id,&e)
+		if err!=nil { return err }
 		if t.Ops.Consistent(e.Val,q) {
 			sub := consume(e.Val)
 			if e.Ptr!=0 && sub {
 				err := ctx.Err()
 				if err!=nil { return err }
-				err = t.gsearch(ctx,e.Ptr,q,consume)
+				err = t.gsearch(ctx,e.Ptr,lsn,ver,q,consume)
 				if err!=nil { return err }
 			}
 		}
 	}
+	for _,sib := range t.movedFrom(id,plsn,lsn) {
+		err = t.gsearch(ctx,sib,plsn,ver,q,consume)
+		if err!=nil { return err }
+	}
 	return nil
 }
 func (t *Tree) GSearch(
@@ -235,9 +403,10 @@ func (t *Tree) GSearch(
 	obj int64,
 	q interface{},
 	consume func(b []byte) bool) error {
-	rr,err := t.getRoot(obj)
-	if err!=nil { return err }
-	return t.gsearch(ctx,rr.Ptr,q,consume)
+	defer t.endRead(t.beginRead())
+	rr,lsn,err := t.readRoot(obj)
+	if err!=nil || rr.Ptr==0 { return err }
+	return t.gsearch(ctx,rr.Ptr,lsn,rr.Version,q,consume)
 }
 
 /* -------------------------------------------------------------------------------- */
@@ -245,9 +414,11 @@ func (t *Tree) GSearch(
 func (t *Tree) delete(
 	ctx context.Context,
 	id int64,
+	lvl int,
 	q interface{},
-	chk func([]byte) bool) (r_elems Elements, r_inner int, r_abort, r_err error) {
-	b,onode,err := t.getPage(id)
+	chk func([]byte) bool,
+	cs *condenseState) (r_elems Elements, r_inner int, r_same bool, r_abort, r_err error) {
+	b,onode,err := t.getPage(id,cs.ver)
 	defer freeElements(onode)
 	defer b.Free()
 	if err!=nil { r_err = err; return }
@@ -257,6 +428,7 @@ func (t *Tree) delete(
 	node := allocElements()[:0]
 	defer freeElements(node)
 	
+	changed := false
 	for i,e := range onode {
 		r_abort = ctx.Err()
 		if r_abort!=nil {
@@ -268,65 +440,80 @@ func (t *Tree) delete(
 			continue
 		}
 		if e.Ptr!=0 {
-			elems,_,_,err := t.delete(ctx,e.Ptr,q,chk)
+			elems,_,same,_,err := t.delete(ctx,e.Ptr,lvl-1,q,chk,cs)
 			if err!=nil { r_err = err; return }
-			node = append(node,elems...)
+			if same {
+				node = append(node,e)
+			} else {
+				node = append(node,elems...)
+				changed = true
+			}
 			continue
 		}
 		if !chk(e.Val) {
 			node = append(node,e)
+		} else {
+			changed = true
+			if e.Ovf!=0 {
+				r_err = t.freeOverflow(e.Ovf)
+				if r_err!=nil { return }
+			}
 		}
 	}
 	
+	/* Nothing has been deleted, so don't touch the page. */
+	if !changed {
+		r_same = true
+		return
+	}
+	
+	if len(cs.under)>0 {
+		node,r_err = t.condense(node,lvl,cs)
+		if r_err!=nil { return }
+	}
+	
 	if len(node)==0 {
 		r_elems = nil
-		r_err = t.PageFree(id)
+		r_err = t.freePage(id)
 		return
 	}
 	
 	r_inner = len(node)
 	t.Ops.Sort(node)
-	{
-		cur,rest := t.Ops.FirstSplit(node,t.Page())
-		t.Ops.Sort(cur)
-		err = t.putPage(id,cur)
-		if err!=nil { r_err = err; return }
-		r_elems[0].Val = t.Ops.Union(cur)
-		for len(rest)>0 {
-			var e Element
-			cur,rest = t.Ops.FirstSplit(rest,t.Page())
-			e.Ptr,err = t.insertPage(cur)
-			if err!=nil { r_err = err; return }
-			e.Val = t.Ops.Union(cur)
-			r_elems = append(r_elems,e)
-		}
-	}
+	r_elems,r_err = t.storeNode(id,node)
+	if r_err==nil && len(r_elems)==1 { cs.check(r_elems[0].Ptr,node) }
 	
 	return
 }
 func (t *Tree) walkOneOne(rr Root) (Root,bool,error) {
 	id := rr.Ptr
-	b,onode,err := t.getPage(id)
+	b,onode,err := t.getPage(id,rr.Version)
 	defer freeElements(onode)
 	defer b.Free()
 	if err!=nil { return rr,false,err }
+	more := true
 	switch len(onode) {
 	case 0:
 		rr.Ptr = 0
+		rr.Depth = 0
+		more = false
 	case 1:
+		/* A leaf-root with a single element stays. */
+		if onode[0].Ptr==0 { return rr,false,nil }
 		rr.Ptr = onode[0].Ptr
+		rr.Depth--
 	default:
 		return rr,false,nil
 	}
-	err = t.PageFree(id)
-	return rr,true,err
+	err = t.freePage(id)
+	return rr,more,err
 }
 func (t *Tree) walkOnes(rr Root) (Root,error) {
 	var more bool
 	var err error
 	for {
 		rr,more,err = t.walkOneOne(rr)
-		if !more { break }
+		if err!=nil || !more { break }
 	}
 	return rr,err
 }
@@ -335,6 +522,8 @@ func (t *Tree) Delete(
 	obj int64,
 	q interface{},
 	chk func([]byte) bool) (r_abort, r_err error) {
+	if r_err = t.beginWrite(); r_err!=nil { return }
+	defer t.endWrite(&r_err)
 	rr,err := t.getRoot(obj)
 	if err!=nil { return nil,err }
 	
@@ -342,35 +531,70 @@ func (t *Tree) Delete(
 		return nil,nil
 	}
 	
-	elems,inner,abort,err := t.delete(ctx,rr.Ptr,q,chk)
-	if err!=nil { return abort,err }
+	cs := &condenseState{root:int(rr.Depth),ver:rr.Version}
+	if t.MinFill>0 {
+		cs.min = int(t.MinFill*float64(t.pageCap()))
+		cs.under = make(map[int64]bool)
+	}
+	elems,inner,same,abort,err := t.delete(ctx,rr.Ptr,int(rr.Depth),q,chk,cs)
+	if err!=nil || same { return abort,err }
 	
+	nr := rr
 	if len(elems)==0 {
-		return abort,t.PageFree(rr.Ptr)
+		nr = Root{}
 	} else if len(elems) > 1 {
 		id,err := t.insertPage(elems)
 		if err!=nil { return abort,err }
-		rr.Ptr = id
-		rr.Depth++
-		return abort,t.putRoot(obj,rr)
+		nr.Ptr = id
+		nr.Depth++
+	} else {
+		/* For whatever reason, the pointer may have changed. */
+		nr.Ptr = elems[0].Ptr
 	}
-	if rr.Ptr!=elems[0].Ptr {
-		/* For whatever reason, the pointer changed. Update it. */
-		rr.Ptr = elems[0].Ptr
-		if inner < 2 {
-			rr,err = t.walkOnes(rr)
-			if err!=nil { return abort,err }
-		}
-		return abort,t.putRoot(obj,rr)
+	collapse := len(elems)==1 && inner < 2
+	if len(cs.orphans)>0 {
+		nr,err = t.reinsertOrphans(nr,cs.orphans,rr.Version)
+		if err!=nil { return abort,err }
+		collapse = true
 	}
-	
-	if inner < 2 {
-		rr,err = t.walkOnes(rr)
+	if collapse {
+		nr,err = t.walkOnes(nr)
 		if err!=nil { return abort,err }
-		return abort,t.putRoot(obj,rr)
 	}
+	if nr!=rr { return abort,t.putRoot(obj,nr) }
 	return abort,nil
 }
 
 /* -------------------------------------------------------------------------------- */
 
+/*
+Frees all pages of the tree obj, including its head. The tree must not be used
+anymore, while or after it is dropped.
+*/
+func (t *Tree) Drop(obj int64) (err error) {
+	if err = t.beginWrite(); err!=nil { return }
+	defer t.endWrite(&err)
+	rr,err := t.getRoot(obj)
+	if err!=nil { return err }
+	if rr.Ptr!=0 {
+		err = t.drop(rr.Ptr,rr.Version)
+		if err!=nil { return err }
+	}
+	return t.HeadFree(obj)
+}
+func (t *Tree) drop(id int64, ver uint16) error {
+	/* Only the overflow chains are needed, not the values. */
+	b,node,_,err := t.rawNode(id,ver)
+	defer freeElements(node)
+	defer b.Free()
+	if err!=nil { return err }
+	for _,e := range node {
+		if e.Ptr!=0 {
+			err = t.drop(e.Ptr,ver)
+		} else if e.Ovf!=0 {
+			err = t.freeOverflow(e.Ovf)
+		}
+		if err!=nil { return err }
+	}
+	return t.freePage(id)
+}
@@ -23,6 +23,8 @@ SOFTWARE.
 
 package newtree
 
+import "sync"
+
 type TreeOps interface{
 	Consistent(p []byte, q interface{}) bool
 	
@@ -60,5 +62,58 @@ type _fullSpec_TreeOps interface{
 	Sort(E Elements)
 }
 
+// Optional extension to TreeOps, used by RStarSplit, if the TreeOps do not
+// implement BoxOps. Reports, whether the keys p and q (leaf values or unions)
+// overlap.
+type OverlapOps interface{
+	Overlap(p,q []byte) bool
+}
+
+// Optional extension to TreeOps, required by RStarSplit. The keys (leaf values
+// or unions) are boxes with Axes() dimensions.
+//
+// SortAxis(E,axis,upper) sorts E by the lower (or, if upper is true, the upper)
+// bounds of the keys along axis. Margin(p) is the sum of the edge lengths of p,
+// Area(p) its volume and OverlapArea(p,q) the volume of the intersection of p
+// and q.
+type BoxOps interface{
+	Axes() int
+	SortAxis(E Elements, axis int, upper bool)
+	Margin(p []byte) float64
+	Area(p []byte) float64
+	OverlapArea(p,q []byte) float64
+}
+
+// Optional extension to TreeOps, used by .Verify(). Reports, whether the key p
+// (a union) covers c (a leaf value or union), that is, whether every element
+// covered by c is covered by p. Required, if .Union() is not idempotent.
+type CoverOps interface{
+	Covers(p,c []byte) bool
+}
+
+/* -------------------------------------------------------------------------------- */
 
+var opsRegistry struct{
+	sync.RWMutex
+	m map[string]TreeOps
+}
 
+/*
+Registers ops under name, so that trees in a Catalog can refer to them. It is
+meant to be called from the init function of the package implementing ops.
+It panics, if name is empty or already registered.
+*/
+func RegisterOps(name string, ops TreeOps) {
+	opsRegistry.Lock(); defer opsRegistry.Unlock()
+	if name=="" { panic("newtree: RegisterOps called with an empty name") }
+	if opsRegistry.m==nil { opsRegistry.m = make(map[string]TreeOps) }
+	if _,ok := opsRegistry.m[name]; ok { panic("newtree: RegisterOps called twice for "+name) }
+	opsRegistry.m[name] = ops
+}
+
+// Returns the ops registered under name.
+func LookupOps(name string) (TreeOps,bool) {
+	opsRegistry.RLock(); defer opsRegistry.RUnlock()
+	ops,ok := opsRegistry.m[name]
+	return ops,ok
+}
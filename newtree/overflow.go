@@ -0,0 +1,164 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+package newtree
+
+import "github.com/byte-mug/golibs/bufferex"
+import "bytes"
+import "errors"
+
+/*
+Overflow pages.
+
+Leaf values, that would take more than a quarter of a page, are stored in a
+chain of overflow pages. The leaf keeps a short prefix of the value and a
+pointer to the first page of the chain. Overflow pages are never modified, so
+elements can be moved between pages (by splits or CopyOnWrite) without copying
+the chain. The chain is freed, when its leaf element is deleted.
+
+The payload of an overflow page is:
+
+	int64 next | uint32 n | data[:n]
+
+Only leaf values are moved into overflow pages. The values of inner Elements,
+as returned by TreeOps.Union(), must still fit into a page.
+*/
+const ovfHeader = 12
+
+func (t *Tree) ovfThreshold() int { return t.pageCap()/4 }
+
+/* Creates the leaf element for val, moving val into overflow pages, if it is too large. */
+func (t *Tree) leafElement(val []byte) (e Element, err error) {
+	e.Val = val
+	if e.Length() <= t.ovfThreshold() { return }
+	e.Ovf,err = t.writeOverflow(val)
+	return
+}
+
+/*
+Writes v into a new chain of overflow pages. The chain is written back to
+front, so every page is complete, before it is referenced.
+*/
+func (t *Tree) writeOverflow(v []byte) (id int64, err error) {
+	chunk := t.pageCap()-ovfHeader
+	b := bufferex.AllocBinary(t.Page())
+	defer b.Free()
+	p := b.Bytes()
+	n := (len(v)+chunk-1)/chunk
+	for i := n-1; i>=0; i-- {
+		part := v[i*chunk:]
+		if len(part)>chunk { part = part[:chunk] }
+		for j := range p { p[j] = 0 }
+		frm.PutUint64(p[pageHeader:],uint64(id))
+		frm.PutUint32(p[pageHeader+8:],uint32(len(part)))
+		copy(p[pageHeader+ovfHeader:],part)
+		pageSeal(p,pageOverflow)
+		
+		var nid int64
+		nid,err = t.PageAlloc()
+		if err!=nil { return 0,errors.Join(err,t.freeOverflow(id)) }
+		err = t.PageWrite(nid,p)
+		if err!=nil {
+			/* Like any other page, nid is freed through the writer (see .freePage()). */
+			return 0,errors.Join(err,t.freePage(nid),t.freeOverflow(id))
+		}
+		id = nid
+	}
+	return
+}
+
+/*
+Reads the value stored in the overflow chain starting at page id. If visit is
+not nil, it is called for every page of the chain.
+*/
+func (t *Tree) readOverflow(id int64, visit func(int64)) (v []byte, err error) {
+	var b bufferex.Binary
+	var next int64
+	var part []byte
+	seen := make(map[int64]bool)
+	for id!=0 {
+		if seen[id] { return nil,&CorruptPageError{id,"cycle in overflow chain"} }
+		seen[id] = true
+		if visit!=nil { visit(id) }
+		b,err = t.PageRead(id)
+		if err!=nil { return nil,err }
+		next,part,err = ovfOpen(id,b.Bytes())
+		if err==nil { v = append(v,part...) }
+		b.Free()
+		if err!=nil { return nil,err }
+		id = next
+	}
+	return
+}
+func ovfOpen(id int64, b []byte) (next int64, part []byte, err error) {
+	/* Overflow pages always have a header. */
+	p,_,err := pageOpen(id,b,pageOverflow,FormatVersion)
+	if err!=nil { return }
+	if len(p)<ovfHeader { return 0,nil,&CorruptPageError{id,"invalid overflow page"} }
+	n := frm.Uint32(p[8:])
+	if n==0 || int64(n)>int64(len(p)-ovfHeader) { return 0,nil,&CorruptPageError{id,"invalid overflow page length"} }
+	return int64(frm.Uint64(p)),p[ovfHeader:ovfHeader+n],nil
+}
+
+/* Frees the overflow chain starting at page id (deferred, see .freePage()). */
+func (t *Tree) freeOverflow(id int64) error {
+	for id!=0 {
+		b,err := t.PageRead(id)
+		if err!=nil { return err }
+		next,_,err := ovfOpen(id,b.Bytes())
+		b.Free()
+		if err!=nil { return err }
+		err = t.freePage(id)
+		if err!=nil { return err }
+		id = next
+	}
+	return nil
+}
+
+/*
+Replaces the prefix of the overflowed element e of page id by its full value.
+
+Readers resolve the elements, they visit, one by one, rather than whole pages
+(see .readPage()). Writers need the full values of all leaf-elements of a page
+for .Ops.Sort() and .Ops.Union(), so .getPage() resolves them all.
+*/
+func (t *Tree) resolveElement(id int64, e *Element) error {
+	if e.Ovf==0 { return nil }
+	v,err := t.readOverflow(e.Ovf,nil)
+	if err!=nil { return err }
+	if !bytes.HasPrefix(v,e.Val) {
+		return &CorruptPageError{id,"overflow value does not match its prefix"}
+	}
+	e.Val = v
+	return nil
+}
+
+/* Replaces the prefixes of the overflowed elements of e by their full values. */
+func (t *Tree) resolve(id int64, e Elements) error {
+	for i := range e {
+		err := t.resolveElement(id,&e[i])
+		if err!=nil { return err }
+	}
+	return nil
+}
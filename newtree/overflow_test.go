@@ -0,0 +1,126 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+
+
+package newtree_test
+
+import "github.com/maxymania/gonbase/newtree"
+import "github.com/maxymania/gonbase/ntops"
+import "github.com/byte-mug/golibs/bufferex"
+import "bytes"
+import "context"
+import "errors"
+import "sync/atomic"
+import "testing"
+
+/* The element of key k with a value of n bytes. */
+func bigElem(k int64, n int) []byte {
+	return ntops.EncodeInterval(k,k,bytes.Repeat([]byte{byte(k)},n))
+}
+
+/* Fails the fail'th PageWrite. */
+type failBase struct{
+	*newtree.MemBase
+	fail *int
+}
+func (b failBase) PageWrite(id int64, p []byte) error {
+	*b.fail--
+	if *b.fail==0 { return errCrash }
+	return b.MemBase.PageWrite(id,p)
+}
+
+/* Counts the PageReads. */
+type countBase struct{
+	*newtree.MemBase
+	reads *int64
+}
+func (b countBase) PageRead(id int64) (bufferex.Binary,error) {
+	atomic.AddInt64(b.reads,1)
+	return b.MemBase.PageRead(id)
+}
+
+func TestOverflowWriteFails(t *testing.T) {
+	/* The number of pages of the chain. */
+	tr := ivTree(newtree.NewMemBase(256))
+	obj,_ := tr.NewRoot()
+	if err := tr.Insert(obj,bigElem(1,2000)); err!=nil { t.Fatal(err) }
+	chain := verify(t,tr,obj).Overflow
+	if chain<4 { t.Fatalf("%d overflow pages",chain) }
+	
+	mb := newtree.NewMemBase(256)
+	fail := -1
+	tr = ivTree(failBase{mb,&fail})
+	obj,_ = tr.NewRoot()
+	insertRange(t,tr,obj,0,50)
+	pages := mb.Stats().Pages
+	for i := 1; i<=chain; i++ {
+		fail = i
+		if err := tr.Insert(obj,bigElem(100,2000)); !errors.Is(err,errCrash) { t.Fatalf("write %d: %v",i,err) }
+		fail = -1
+		if err := tr.Reclaim(); err!=nil { t.Fatal(err) }
+		if n := mb.Stats().Pages; n!=pages { t.Fatalf("write %d: %d pages, want %d",i,n,pages) }
+	}
+	if got := keys(t,tr,obj,all); len(got)!=50 { t.Fatalf("%d keys",len(got)) }
+	verify(t,tr,obj)
+}
+
+func TestOverflowLazy(t *testing.T) {
+	var reads int64
+	tr := ivTree(countBase{newtree.NewMemBase(512),&reads})
+	obj,_ := tr.NewRoot()
+	for k := int64(0); k<200; k++ {
+		if err := tr.Insert(obj,bigElem(k,300)); err!=nil { t.Fatal(err) }
+	}
+	st := verify(t,tr,obj)
+	if st.Overflow!=200 { t.Fatalf("%d overflow pages",st.Overflow) }
+	
+	/* The first element takes the pages along its path and its own chain. */
+	atomic.StoreInt64(&reads,0)
+	c,err := tr.Cursor(context.Background(),obj,all)
+	if err!=nil { t.Fatal(err) }
+	if !c.Next() { t.Fatal(c.Err()) }
+	if v := c.Value(); !bytes.Equal(v,bigElem(ivKey(t,v),300)) { t.Fatal("value not resolved") }
+	c.Close()
+	if n := atomic.LoadInt64(&reads); n>int64(st.Depth)+1 { t.Fatalf("%d reads for the first element of a tree of depth %d",n,st.Depth) }
+	
+	var n int
+	err = tr.Search(context.Background(),obj,ntops.IntervalStab[int64]{At:77},func(v []byte) {
+		if !bytes.Equal(v,bigElem(77,300)) { t.Fatal("value not resolved") }
+		n++
+	})
+	if err!=nil || n!=1 { t.Fatal(n,err) }
+	
+	/* The tokens identify overflowed values by their chain, whether resolved or not. */
+	seen := make(map[int64]int)
+	var tok []byte
+	for {
+		tok,err = tr.SearchPage(context.Background(),obj,all,7,tok,func(v []byte) { seen[ivKey(t,v)]++ })
+		if err!=nil { t.Fatal(err) }
+		if tok==nil { break }
+	}
+	for k := int64(0); k<200; k++ {
+		if seen[k]!=1 { t.Fatalf("key %d reported %d times",k,seen[k]) }
+	}
+}
@@ -0,0 +1,166 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+package newtree
+
+import "hash/crc32"
+import "errors"
+import "fmt"
+
+/*
+The current on-disk format version of pages and Roots.
+
+Version 0 (legacy) pages consist of the encoded Elements only. Version 1 pages
+start with a header:
+
+	[0:4]  magic "GiST"
+	[4]    format version
+	[5]    page type
+	[6:8]  reserved, zero
+	[8:12] CRC32C of the whole page, except for these 4 bytes
+	[12:]  payload
+
+All integers are little-endian.
+*/
+const FormatVersion = 1
+
+const pageHeader = 12
+const pageMagic = 0x54536947 // "GiST"
+
+const (
+	pageNode byte = 1
+	pageOverflow byte = 2
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+var ECorrupt = errors.New("ECorrupt")
+var EVersion = errors.New("EVersion")
+
+/*
+Returned, if a page fails its integrity checks. errors.Is(err,ECorrupt) is true.
+*/
+type CorruptPageError struct{
+	Page   int64
+	Reason string
+}
+func (c *CorruptPageError) Error() string { return fmt.Sprintf("newtree: corrupt page %d: %s",c.Page,c.Reason) }
+func (c *CorruptPageError) Unwrap() error { return ECorrupt }
+
+/* The number of bytes of a page, that are available to the payload. */
+func (t *Tree) pageCap() int { return t.Page()-pageHeader }
+
+func pageSum(b []byte) uint32 {
+	return crc32.Update(crc32.Checksum(b[:8],crcTable),crcTable,b[pageHeader:])
+}
+
+/* Writes the header of page b. The payload must already be in place. */
+func pageSeal(b []byte, typ byte) {
+	frm.PutUint32(b,pageMagic)
+	b[4] = FormatVersion
+	b[5] = typ
+	b[6] = 0
+	b[7] = 0
+	frm.PutUint32(b[8:],pageSum(b))
+}
+
+/*
+Verifies the header of page b and returns its payload. ver is the format
+version of the Root, the page belongs to. Only if it is 0, pages without a
+header are accepted as legacy pages, their payload is the whole page.
+*/
+func pageOpen(id int64, b []byte, typ byte, ver uint16) (p []byte, legacy bool, err error) {
+	if len(b)<pageHeader || frm.Uint32(b)!=pageMagic {
+		if ver==0 { return b,true,nil }
+		if len(b)<pageHeader { return nil,false,&CorruptPageError{id,"page too short"} }
+		return nil,false,&CorruptPageError{id,"bad magic"}
+	}
+	if b[4]==0 || b[4]>FormatVersion {
+		return nil,false,&CorruptPageError{id,fmt.Sprintf("unsupported format version %d",b[4])}
+	}
+	if frm.Uint32(b[8:])!=pageSum(b) { return nil,false,&CorruptPageError{id,"checksum mismatch"} }
+	if b[5]!=typ { return nil,false,&CorruptPageError{id,fmt.Sprintf("unexpected page type %d",b[5])} }
+	return b[pageHeader:],false,nil
+}
+
+/* -------------------------------------------------------------------------------- */
+
+/*
+Rewrites all legacy pages of the tree obj in the current format and updates
+the format version of its Root. Legacy pages, that exceed the payload capacity
+of the current format, are split.
+*/
+func (t *Tree) Migrate(obj int64) (err error) {
+	if err = t.beginWrite(); err!=nil { return }
+	defer t.endWrite(&err)
+	rr,err := t.getRoot(obj)
+	if err!=nil { return err }
+	if rr.Version==FormatVersion { return nil }
+	if rr.Ptr!=0 {
+		elems,same,err := t.migrate(rr.Ptr,rr.Version)
+		if err!=nil { return err }
+		if !same && len(elems)>1 {
+			id,err := t.insertPage(elems)
+			if err!=nil { return err }
+			rr.Ptr = id
+			rr.Depth++
+		} else if !same {
+			rr.Ptr = elems[0].Ptr
+		}
+	}
+	rr.Version = FormatVersion
+	return t.putRoot(obj,rr)
+}
+func (t *Tree) migrate(id int64, ver uint16) (r_elems Elements, r_same bool, r_err error) {
+	b,onode,legacy,err := t.readNode(id,ver)
+	defer freeElements(onode)
+	defer b.Free()
+	if err!=nil { r_err = err; return }
+	
+	node := allocElements()[:0]
+	defer freeElements(node)
+	
+	changed := legacy
+	for _,e := range onode {
+		if e.Ptr==0 {
+			node = append(node,e)
+			continue
+		}
+		elems,same,err := t.migrate(e.Ptr,ver)
+		if err!=nil { r_err = err; return }
+		if same {
+			node = append(node,e)
+		} else {
+			node = append(node,elems...)
+			changed = true
+		}
+	}
+	if !changed {
+		r_same = true
+		return
+	}
+	t.Ops.Sort(node)
+	r_elems,r_err = t.storeNode(id,node)
+	return
+}
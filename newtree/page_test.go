@@ -0,0 +1,141 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+
+
+package newtree_test
+
+import "github.com/maxymania/gonbase/newtree"
+import "context"
+import "encoding/binary"
+import "errors"
+import "math/rand"
+import "testing"
+
+/* Returns a copy of page id. */
+func rawPage(t testing.TB, mb *newtree.MemBase, id int64) []byte {
+	b,err := mb.PageRead(id)
+	if err!=nil { t.Fatal(err) }
+	defer b.Free()
+	return append([]byte(nil),b.Bytes()...)
+}
+
+func corruptAt(t testing.TB, tr *newtree.Tree, obj, id int64) {
+	t.Helper()
+	err := tr.Search(context.Background(),obj,all,func([]byte) {})
+	var cp *newtree.CorruptPageError
+	if !errors.As(err,&cp) || cp.Page!=id || !errors.Is(err,newtree.ECorrupt) { t.Fatal(err) }
+	if err = tr.Insert(obj,ivElem(1000)); !errors.Is(err,newtree.ECorrupt) { t.Fatal(err) }
+	if _,err = tr.Verify(context.Background(),obj); !errors.Is(err,newtree.ECorrupt) { t.Fatal(err) }
+}
+
+func TestBadMagic(t *testing.T) {
+	mb := newtree.NewMemBase(512)
+	tr := ivTree(mb)
+	obj,_ := tr.NewRoot()
+	insertRange(t,tr,obj,0,300)
+	rr := rootOf(t,mb,obj)
+	if rr.Version!=newtree.FormatVersion { t.Fatal(rr.Version) }
+	
+	p := rawPage(t,mb,rr.Ptr)
+	copy(p,"XXXX")
+	mb.PageWrite(rr.Ptr,p)
+	
+	/* A page without magic is not a legacy page in a current tree. */
+	corruptAt(t,tr,obj,rr.Ptr)
+}
+
+func TestBadChecksum(t *testing.T) {
+	mb := newtree.NewMemBase(512)
+	tr := ivTree(mb)
+	obj,_ := tr.NewRoot()
+	insertRange(t,tr,obj,0,300)
+	rr := rootOf(t,mb,obj)
+	
+	/* A flipped bit in the payload of the root. */
+	p := rawPage(t,mb,rr.Ptr)
+	p[len(p)/2] ^= 0x10
+	mb.PageWrite(rr.Ptr,p)
+	corruptAt(t,tr,obj,rr.Ptr)
+}
+
+func TestRootHead(t *testing.T) {
+	h := make([]byte,newtree.HeadSize)
+	rr := newtree.Root{Ptr:4096,Depth:3,Version:newtree.FormatVersion}
+	var got newtree.Root
+	for _,v := range []uint16{0,newtree.FormatVersion} {
+		rr.Version = v
+		if err := rr.BinEncode(h); err!=nil { t.Fatal(err) }
+		if err := got.BinDecode(h); err!=nil || got!=rr { t.Fatalf("%+v: %+v, %v",rr,got,err) }
+	}
+	
+	/* A corrupt head fails, rather than being taken for a legacy head. */
+	for i := range h {
+		h2 := append([]byte(nil),h...)
+		h2[i] ^= 4
+		if err := got.BinDecode(h2); err!=newtree.ECorrupt { t.Errorf("byte %d: %+v, %v",i,got,err) }
+	}
+	rr.Version = newtree.FormatVersion+1
+	rr.BinEncode(h)
+	if err := got.BinDecode(h); err!=newtree.EVersion { t.Fatal(err) }
+	
+	/* Legacy heads have random bytes after the Depth. */
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i<1<<17; i++ {
+		binary.LittleEndian.PutUint64(h,4096)
+		binary.LittleEndian.PutUint32(h[8:],3)
+		binary.LittleEndian.PutUint32(h[12:],r.Uint32())
+		if err := got.BinDecode(h); err!=nil || got!=(newtree.Root{Ptr:4096,Depth:3}) { t.Fatalf("%x: %+v, %v",h,got,err) }
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	mb,tr,obj := legacyTree(t)
+	st := verify(t,tr,obj)
+	if st.Legacy!=6 { t.Fatalf("%d legacy pages",st.Legacy) }
+	
+	/* The head of the legacy tree, as written by older versions. */
+	rr := rootOf(t,mb,obj)
+	h := make([]byte,newtree.HeadSize)
+	binary.LittleEndian.PutUint64(h,uint64(rr.Ptr))
+	binary.LittleEndian.PutUint32(h[8:],rr.Depth)
+	copy(h[12:],"junk")
+	mb.HeadWrite(obj,h)
+	if rr = rootOf(t,mb,obj); rr.Version!=0 { t.Fatal(rr.Version) }
+	
+	if err := tr.Migrate(obj); err!=nil { t.Fatal(err) }
+	rr = rootOf(t,mb,obj)
+	if rr.Version!=newtree.FormatVersion { t.Fatal(rr.Version) }
+	/* The full legacy pages do not fit into the current format. */
+	if st = verify(t,tr,obj); st.Legacy!=0 || st.Levels[len(st.Levels)-1].Pages!=10 { t.Fatalf("%+v",st) }
+	if err := tr.Reclaim(); err!=nil { t.Fatal(err) }
+	checkLegacyTree(t,mb,tr,obj)
+	if err := tr.Migrate(obj); err!=nil { t.Fatal(err) }
+	
+	/* The magic check applies after the migration. */
+	p := rawPage(t,mb,rr.Ptr)
+	copy(p,"XXXX")
+	mb.PageWrite(rr.Ptr,p)
+	corruptAt(t,tr,obj,rr.Ptr)
+}
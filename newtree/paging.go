@@ -0,0 +1,509 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+package newtree
+
+import "github.com/byte-mug/golibs/bufferex"
+import "context"
+import "crypto/hmac"
+import "crypto/rand"
+import "crypto/sha256"
+import "bytes"
+import "hash/crc32"
+import "errors"
+import "io"
+
+var EBadToken = errors.New("EBadToken")
+
+const tokenVersion = 3
+const tokenHeader = 11
+const tokenDigest = sha256.Size
+const tokenFrame = 22
+const tokenMAC = sha256.Size
+
+/* Returns the MAC of a token for the tree obj. */
+func (t *Tree) tokenMAC(obj int64, tok []byte) []byte {
+	key := t.TokenKey
+	if len(key)==0 {
+		t.tokKey.Do(func() {
+			t.rndKey = make([]byte,32)
+			if _,err := rand.Read(t.rndKey); err!=nil { panic(err) }
+		})
+		key = t.rndKey
+	}
+	var o [8]byte
+	frm.PutUint64(o[:],uint64(obj))
+	m := hmac.New(sha256.New,key)
+	m.Write(o[:])
+	m.Write(tok)
+	return m.Sum(nil)
+}
+
+/*
+Identifies the element, a frame of a continuation token has visited last: the
+child pointer of an inner element, the overflow chain of an overflowed leaf
+value (which may not be resolved), or the checksum of a leaf value.
+*/
+func elementCheck(e Element) uint32 {
+	if e.Ptr!=0 || e.Ovf!=0 {
+		var p [8]byte
+		frm.PutUint64(p[:],uint64(e.Ptr|e.Ovf))
+		return crc32.Checksum(p[:],crcTable)
+	}
+	return crc32.Checksum(e.Val,crcTable)
+}
+
+/*
+The checksum of the key of an inner element. Unlike the child pointer, it
+survives, if the child is copied, but not, if the subtree is changed.
+*/
+func elementKeyCheck(e Element) uint32 {
+	if e.Ptr==0 { return 0 }
+	return crc32.Checksum(e.Val,crcTable)|1
+}
+
+/* Reports, whether a page has been freed or reused, rather than failed to read. */
+func pageGone(err error) bool {
+	return errors.Is(err,ECorrupt) || err==ENoPage || errors.Is(err,io.EOF) || errors.Is(err,io.ErrUnexpectedEOF)
+}
+
+/*
+Returns a continuation token, that encodes the position of the Cursor, or nil,
+if the Cursor has no more elements to visit. Passed to .ResumeCursor(), the
+search continues after the element last returned by .Next().
+
+The token is an opaque byte string of the form
+
+	byte version | uint32 depth | uint16 n | uint32 len+1 | key | digest
+	n * (int64 page | uint32 pos | uint32 check | uint32 key | int16 parent)
+	HMAC-SHA256
+
+where depth is the depth of the tree, key is the Union of the element last
+returned by .Next() and digest its SHA-256 (len+1 is 0 and both are missing,
+if there is none, or if the key does not fit into a page), every frame is a
+page on the stack of the Cursor, pos is the number of elements of the page,
+that have been visited, and check identifies the last visited element. For
+inner pages, key is the checksum of the key of that element. So the size of
+the token is bounded by the page size and the depth of the tree, even if the
+values are overflowed.
+
+The HMAC covers the tree obj and all preceding bytes and uses the key
+Tree.TokenKey, so a token cannot be forged to point at other pages or be
+resumed on another tree.
+*/
+func (c *Cursor) Token() []byte {
+	if c.err!=nil { return nil }
+	n := len(c.stack)
+	for n>0 {
+		f := &c.stack[n-1]
+		if f.pos<len(f.node) || len(c.t.movedFrom(f.id,f.plsn,f.lsn))>0 { break }
+		n--
+	}
+	if n==0 { return nil }
+	var key []byte
+	if c.val!=nil {
+		key = c.t.Ops.Union(Elements{{Val:c.val}})
+		if len(key)>c.t.pageCap() { key = nil }
+	}
+	size := tokenHeader+n*tokenFrame
+	if key!=nil { size += len(key)+tokenDigest }
+	tok := make([]byte,size,size+tokenMAC)
+	tok[0] = tokenVersion
+	frm.PutUint32(tok[1:],c.depth)
+	frm.PutUint16(tok[5:],uint16(n))
+	p := tok[tokenHeader:]
+	if key!=nil {
+		frm.PutUint32(tok[7:],uint32(len(key)+1))
+		sum := sha256.Sum256(c.val)
+		p = p[copy(p,key):]
+		p = p[copy(p,sum[:]):]
+	}
+	for _,f := range c.stack[:n] {
+		check,key := uint32(0),uint32(0)
+		if f.pos>0 { check,key = elementCheck(f.node[f.pos-1]),elementKeyCheck(f.node[f.pos-1]) }
+		frm.PutUint64(p,uint64(f.id))
+		frm.PutUint32(p[8:],uint32(f.pos))
+		frm.PutUint32(p[12:],check)
+		frm.PutUint32(p[16:],key)
+		frm.PutUint16(p[20:],uint16(int16(f.up)))
+		p = p[tokenFrame:]
+	}
+	return append(tok,c.t.tokenMAC(c.obj,tok)...)
+}
+
+type tokenFrameRec struct{
+	id    int64
+	pos   int
+	check uint32
+	key   uint32
+	up    int
+}
+
+/* Reports, whether e is the last visited element of r. */
+func (r tokenFrameRec) match(e Element) bool {
+	if elementCheck(e)==r.check { return true }
+	return r.key!=0 && elementKeyCheck(e)==r.key
+}
+
+/*
+Returns the depth, the key and digest of the last returned value (or nil) and
+the frames of tok.
+*/
+func (t *Tree) decodeToken(obj int64, tok []byte) (uint32,[]byte,[]byte,[]tokenFrameRec,error) {
+	if len(tok)<tokenHeader+tokenMAC || tok[0]!=tokenVersion { return 0,nil,nil,nil,EBadToken }
+	n := int64(frm.Uint16(tok[5:]))
+	vl := int64(frm.Uint32(tok[7:]))
+	if vl>0 { vl += tokenDigest-1 }
+	if int64(len(tok))!=tokenHeader+vl+n*tokenFrame+tokenMAC { return 0,nil,nil,nil,EBadToken }
+	mac := tok[len(tok)-tokenMAC:]
+	if !hmac.Equal(mac,t.tokenMAC(obj,tok[:len(tok)-tokenMAC])) { return 0,nil,nil,nil,EBadToken }
+	var key,sum []byte
+	if vl>0 {
+		key = tok[tokenHeader:tokenHeader+vl-tokenDigest]
+		sum = tok[tokenHeader+vl-tokenDigest:tokenHeader+vl]
+	}
+	fr := make([]tokenFrameRec,n)
+	p := tok[tokenHeader+vl:]
+	for i := range fr {
+		fr[i].id    = int64(frm.Uint64(p))
+		fr[i].pos   = int(frm.Uint32(p[8:]))
+		fr[i].check = frm.Uint32(p[12:])
+		fr[i].key   = frm.Uint32(p[16:])
+		fr[i].up    = int(int16(frm.Uint16(p[20:])))
+		if fr[i].up < -1 || fr[i].up>=i || (fr[i].up==-1)!=(i==0) { return 0,nil,nil,nil,EBadToken }
+		p = p[tokenFrame:]
+	}
+	return frm.Uint32(tok[1:]),key,sum,fr,nil
+}
+
+/*
+Opens a Cursor, that continues the search with the query q at the position
+encoded in token (see Cursor.Token()). q must be the query, the token was
+created with. If token is nil, the search starts at the beginning. If the
+token was not created for obj by a Tree with the same TokenKey, EBadToken is
+returned.
+
+The element last returned is looked up from the Root, through the keys, that
+cover its key (see CoverOps), by its digest, and the search continues after
+it. So the search
+tolerates concurrent writes between the calls: If the leaves of the tree stay
+in the order of the search, when pages are split (as with IntervalOps, which
+sort the pages and insert in that order), elements, that are present during
+the whole search, are reported exactly once. Otherwise a split may move
+visited elements behind the position, so they are reported again. Elements,
+that are inserted or deleted in the meantime, may or may not be reported. If
+the same value is stored more than once, the search continues after the first
+one.
+
+If the element last returned has been deleted, the pages on the stack of the
+Cursor are read again instead, and the positions within them are found by
+the last visited elements. If a page has been split, freed or reused in the
+meantime, and the last visited element cannot be found, the search restarts
+at the parent element, so elements of that subtree may be reported again.
+*/
+func (t *Tree) ResumeCursor(ctx context.Context, obj int64, q interface{}, token []byte) (*Cursor,error) {
+	var fr []tokenFrameRec
+	var key,sum []byte
+	var depth uint32
+	if token!=nil {
+		var err error
+		depth,key,sum,fr,err = t.decodeToken(obj,token)
+		if err!=nil { return nil,err }
+	}
+	start := t.beginRead()
+	rr,lsn,err := t.readRoot(obj)
+	if err!=nil {
+		t.endRead(start)
+		return nil,err
+	}
+	if len(fr)==0 || rr.Ptr==0 { return t.newCursor(ctx,obj,q,start,rr,lsn) }
+	
+	c := &Cursor{t:t,obj:obj,ctx:ctx,q:q,start:start,depth:rr.Depth,ver:rr.Version,open:true}
+	found := false
+	if key!=nil { found,err = c.seekValue(rr.Ptr,-1,lsn,key,sum) }
+	if err==nil && !found { err = c.resume(fr,depth,rr,lsn) }
+	if err!=nil {
+		c.Close()
+		return nil,err
+	}
+	return c,nil
+}
+
+/*
+Pushes the path from page id to the first leaf-element with the key and the
+SHA-256 digest sum and positions the Cursor after it. Returns false and leaves
+the stack as it was, if it is not found.
+*/
+func (c *Cursor) seekValue(id int64, up int, plsn uint64, key, sum []byte) (bool,error) {
+	err := c.push(id,up,plsn)
+	if err!=nil { return false,err }
+	me := len(c.stack)-1
+	for i := 0; i<len(c.stack[me].node); i++ {
+		err = c.t.resolveElement(id,&c.stack[me].node[i])
+		if err!=nil { c.pop(); return false,err }
+		e := c.stack[me].node[i]
+		c.stack[me].pos = i+1
+		if e.Ptr==0 {
+			if s := sha256.Sum256(e.Val); bytes.Equal(s[:],sum) { return true,nil }
+			continue
+		}
+		if !c.t.Ops.Consistent(e.Val,c.q) || !c.t.covers(e.Val,key) { continue }
+		ok,err := c.seekValue(e.Ptr,me,c.stack[me].lsn,key,sum)
+		if ok || err!=nil { return ok,err }
+	}
+	c.pop()
+	return false,nil
+}
+
+type pathStep struct{
+	id  int64
+	pos int
+}
+
+/*
+Finds the page of the Root frame r within the levels below page from: the
+page r.id, or, as it may have been copied, the page holding the last visited
+element of r. Returns the pages leading to it, with the positions after the
+elements, that point down the path, and the id of the page found.
+*/
+func (t *Tree) locate(from int64, ver uint16, r tokenFrameRec, levels int) ([]pathStep,int64,error) {
+	if levels<=0 { return nil,0,nil }
+	b,node,_,err := t.readPage(from,ver)
+	defer freeElements(node)
+	defer b.Free()
+	if err!=nil { return nil,0,err }
+	for i,e := range node {
+		if e.Ptr==r.id { return []pathStep{{from,i+1}},r.id,nil }
+	}
+	for i,e := range node {
+		if e.Ptr==0 { break }
+		var p []pathStep
+		id := e.Ptr
+		if levels>1 {
+			p,id,err = t.locate(e.Ptr,ver,r,levels-1)
+		} else if r.pos>0 {
+			var eb bufferex.Binary
+			var en Elements
+			eb,en,_,err = t.readPage(e.Ptr,ver)
+			id = 0
+			for _,x := range en {
+				if r.match(x) { id = e.Ptr; break }
+			}
+			freeElements(en)
+			eb.Free()
+		}
+		if err!=nil { return nil,0,err }
+		if id!=0 && (levels==1 || p!=nil) { return append([]pathStep{{from,i+1}},p...),id,nil }
+	}
+	return nil,0,nil
+}
+
+/*
+Finds the element pos of the old Root, after a split of the Root, assuming,
+that the elements of the old Root are in the pages below the new Root, in the
+same order. Returns the path to the page, its id and the position within it.
+*/
+func (t *Tree) locateAt(from int64, ver uint16, pos int) ([]pathStep,int64,int,error) {
+	b,node,_,err := t.readPage(from,ver)
+	defer freeElements(node)
+	defer b.Free()
+	if err!=nil { return nil,0,0,err }
+	for i,e := range node {
+		if e.Ptr==0 { break }
+		eb,en,_,err := t.readPage(e.Ptr,ver)
+		n := len(en)
+		freeElements(en)
+		eb.Free()
+		if err!=nil { return nil,0,0,err }
+		if pos<=n || i==len(node)-1 {
+			if pos>n { pos = n }
+			return []pathStep{{from,i+1}},e.Ptr,pos,nil
+		}
+		pos -= n
+	}
+	return nil,0,0,nil
+}
+
+/*
+Rebuilds the stack from the frames fr, that were taken at a tree depth of
+depth.
+
+The position within a page is found by the last visited element, an inner
+element also by its key, as the child may have been copied. If it is not
+there, it is looked up in the pages following the page in its parent, which a
+split may have moved it into. If it is not found either, an inner page keeps
+its old position, which is verified by the frames above it. Otherwise the frame
+is dropped with all frames above it, and its parent steps back by one element.
+The frames above follow the pointers of their parents.
+
+If the Root has been split since, the old Root page (or its copy) is looked
+up below the new one, otherwise the Root frame is applied to the current Root
+page.
+*/
+func (c *Cursor) resume(fr []tokenFrameRec, depth uint32, rr Root, lsn uint64) error {
+	rootID,rootUp,rootLsn := rr.Ptr,-1,lsn
+	if rr.Depth>depth {
+		path,id,err := c.t.locate(rr.Ptr,rr.Version,fr[0],int(rr.Depth-depth))
+		if err!=nil { return err }
+		if path==nil && rr.Depth==depth+1 {
+			path,id,fr[0].pos,err = c.t.locateAt(rr.Ptr,rr.Version,fr[0].pos)
+			if err!=nil { return err }
+		}
+		for _,p := range path {
+			err = c.push(p.id,rootUp,rootLsn)
+			if err!=nil { return err }
+			c.stack[len(c.stack)-1].pos = p.pos
+			rootUp,rootLsn = len(c.stack)-1,c.stack[len(c.stack)-1].lsn
+		}
+		if len(path)>0 { rootID = id }
+	}
+	
+	/* last[j] is the last frame, whose parent is frame j, or -1. */
+	last := make([]int,len(fr))
+	for i := range last { last[i] = -1 }
+	for i,f := range fr {
+		if f.up>=0 { last[f.up] = i }
+	}
+	/* index maps the frames in fr to the frames on the stack. */
+	index := make([]int,len(fr))
+	guessed := make(map[int]bool)
+	for i,f := range fr {
+		index[i] = -1
+		up,plsn,id := rootUp,rootLsn,rootID
+		if f.up>=0 {
+			up = index[f.up]
+			if up<0 { continue }
+			p := &c.stack[up]
+			plsn,id = p.lsn,f.id
+			/* In CopyOnWrite-mode, the parent points to a copy of the page. */
+			if last[f.up]==i && p.pos>0 { id = p.node[p.pos-1].Ptr }
+		}
+		err := c.push(id,up,plsn)
+		if err!=nil && !pageGone(err) { return err }
+		found := err==nil
+		if found && c.seek(&c.stack[len(c.stack)-1],f) {
+			index[i] = len(c.stack)-1
+			continue
+		}
+		if found { c.pop() }
+		if up>=0 && len(c.stack)==up+1 {
+			ok,err := c.follow(f,guessed[up])
+			if err!=nil { return err }
+			if ok {
+				index[i] = len(c.stack)-1
+				continue
+			}
+		}
+		if found && last[i]>=0 {
+			/* Keep the position of an inner page, the frames above verify it. */
+			err = c.push(id,up,plsn)
+			if err!=nil { return err }
+			top := &c.stack[len(c.stack)-1]
+			top.pos = f.pos
+			if top.pos>len(top.node) { top.pos = len(top.node) }
+			index[i] = len(c.stack)-1
+			guessed[index[i]] = true
+			continue
+		}
+		if up>=0 && len(c.stack)==up+1 {
+			/* Visit the child at the position of the parent again. */
+			p := &c.stack[up]
+			if p.pos>0 && p.node[p.pos-1].Ptr==id { p.pos-- }
+		}
+		break
+	}
+	if len(c.stack)==0 { return c.push(rr.Ptr,-1,lsn) }
+	return nil
+}
+
+/*
+Looks for the last visited element of frame r in the pages following it in
+the parent frame on top of the stack, as a split moves the upper part of a page
+into new pages, that are sorted in after it. If the position of the parent is
+a guess, all of its children are searched. If it is found, the parent
+continues after the page, it was found in.
+*/
+func (c *Cursor) follow(r tokenFrameRec, all bool) (bool,error) {
+	up := len(c.stack)-1
+	if r.pos==0 { return false,nil }
+	j := c.stack[up].pos
+	if all { j = 0 }
+	for ; j<len(c.stack[up].node); j++ {
+		e := c.stack[up].node[j]
+		if e.Ptr==0 { break }
+		err := c.push(e.Ptr,up,c.stack[up].lsn)
+		if err!=nil { return false,err }
+		if c.seek(&c.stack[up+1],tokenFrameRec{pos:-1,check:r.check,key:r.key}) {
+			c.stack[up].pos = j+1
+			return true,nil
+		}
+		c.pop()
+	}
+	return false,nil
+}
+
+/* Sets the position of f within its page. Returns false, if it cannot be found. */
+func (c *Cursor) seek(f *cursorFrame, r tokenFrameRec) bool {
+	if r.pos==0 { return true }
+	if r.pos>0 && r.pos<=len(f.node) && r.match(f.node[r.pos-1]) {
+		f.pos = r.pos
+		return true
+	}
+	for i,e := range f.node {
+		if r.match(e) {
+			f.pos = i+1
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Reports up to n leaf-elements consistent with q, starting at the position
+encoded in token (nil = at the beginning), see .ResumeCursor(). Returns the
+token for the next call, or nil, if there are no more elements.
+*/
+func (t *Tree) SearchPage(
+	ctx context.Context,
+	obj int64,
+	q interface{},
+	n int,
+	token []byte,
+	consumer func([]byte)) ([]byte,error) {
+	c,err := t.ResumeCursor(ctx,obj,q,token)
+	if err!=nil { return nil,err }
+	defer c.Close()
+	for ; n>0 && c.Next(); n-- {
+		consumer(c.Value())
+	}
+	if c.Err()!=nil { return nil,c.Err() }
+	if n>0 { return nil,nil }
+	next := c.Token()
+	/* Do not hand out a token, if nothing is left. */
+	if next!=nil && !c.Next() {
+		if c.Err()!=nil { return nil,c.Err() }
+		return nil,nil
+	}
+	return next,nil
+}
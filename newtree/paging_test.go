@@ -0,0 +1,154 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+package newtree_test
+
+import "github.com/maxymania/gonbase/newtree"
+import "context"
+import "fmt"
+import "reflect"
+import "sort"
+import "testing"
+
+/* Reads the tree obj in pages of n elements. Calls between(i) after page i. */
+func pages(t *testing.T, tr *newtree.Tree, obj int64, n int, between func(int)) []int64 {
+	var r []int64
+	var tok []byte
+	for i := 0; ; i++ {
+		var err error
+		tok,err = tr.SearchPage(context.Background(),obj,all,n,tok,func(b []byte) { r = append(r,ivKey(t,b)) })
+		if err!=nil { t.Fatal(err) }
+		if tok==nil { break }
+		if between!=nil { between(i) }
+	}
+	sort.Slice(r,func(i,j int) bool { return r[i]<r[j] })
+	return r
+}
+
+func TestSearchPage(t *testing.T) {
+	mb := newtree.NewMemBase(256)
+	tr := ivTree(mb)
+	obj,_ := tr.NewRoot()
+	insertRange(t,tr,obj,0,1000)
+	want := keys(t,tr,obj,all)
+	for _,n := range []int{1,7,100,999,1000,5000} {
+		if got := pages(t,tr,obj,n,nil); !reflect.DeepEqual(got,want) {
+			t.Fatalf("n=%d: got %d elements, want %d",n,len(got),len(want))
+		}
+	}
+}
+
+/*
+Inserts between the pages, so that the pages holding the last visited elements
+are split. Every element present from the start must be reported exactly once.
+*/
+func TestSearchPageSplits(t *testing.T) {
+	for _,cow := range []bool{false,true} {
+		t.Run(fmt.Sprint("cow=",cow),func(t *testing.T) {
+			mb := newtree.NewMemBase(256)
+			tr := ivTree(mb)
+			tr.CopyOnWrite = cow
+			obj,_ := tr.NewRoot()
+			for k := int64(0); k<1000; k++ {
+				if err := tr.Insert(obj,ivElem(k*100)); err!=nil { t.Fatal(err) }
+			}
+			want := keys(t,tr,obj,all)
+			next := int64(1)
+			got := pages(t,tr,obj,37,func(i int) {
+				for j := 0; j<40; j++ {
+					/* Spread over the whole key range. */
+					k := (next*7919)%100000
+					if k%100==0 { k++ }
+					next++
+					if err := tr.Insert(obj,ivElem(k)); err!=nil { t.Fatal(err) }
+				}
+			})
+			seen := make(map[int64]int)
+			for _,k := range got { seen[k]++ }
+			for _,k := range want {
+				if seen[k]!=1 { t.Fatalf("key %d reported %d times",k,seen[k]) }
+			}
+			verify(t,tr,obj)
+		})
+	}
+}
+
+func TestTokenForgery(t *testing.T) {
+	ctx := context.Background()
+	mb := newtree.NewMemBase(256)
+	tr := &newtree.Tree{IBase:mb,Ops:ivTree(nil).Ops,TokenKey:[]byte("secret")}
+	obj,_ := tr.NewRoot()
+	other,_ := tr.NewRoot()
+	insertRange(t,tr,obj,0,200)
+	insertRange(t,tr,other,0,200)
+	tok,err := tr.SearchPage(ctx,obj,all,10,nil,func([]byte) {})
+	if err!=nil || tok==nil { t.Fatal(tok,err) }
+	
+	/* Another Tree value with the same key accepts the token. */
+	tr2 := &newtree.Tree{IBase:mb,Ops:ivTree(nil).Ops,TokenKey:[]byte("secret")}
+	if _,err = tr2.SearchPage(ctx,obj,all,10,tok,func([]byte) {}); err!=nil { t.Fatal(err) }
+	
+	bad := func(name string, tr *newtree.Tree, obj int64, tok []byte) {
+		if _,err := tr.SearchPage(ctx,obj,all,10,tok,func([]byte) {}); err!=newtree.EBadToken {
+			t.Errorf("%s: got %v, want EBadToken",name,err)
+		}
+	}
+	for i := range tok {
+		forged := append([]byte(nil),tok...)
+		forged[i] ^= 1
+		bad(fmt.Sprint("byte ",i),tr,obj,forged)
+	}
+	bad("other tree",tr,other,tok)
+	bad("other key",&newtree.Tree{IBase:mb,Ops:ivTree(nil).Ops,TokenKey:[]byte("public")},obj,tok)
+	bad("random key",ivTree(mb),obj,tok)
+	bad("truncated",tr,obj,tok[:len(tok)-1])
+}
+
+/*
+The tokens embed a digest of the last returned value, so they stay small, even
+if the values are overflowed, and tell apart values with the same key.
+*/
+func TestTokenOverflow(t *testing.T) {
+	ctx := context.Background()
+	tr := ivTree(newtree.NewMemBase(256))
+	obj,_ := tr.NewRoot()
+	for k := int64(0); k<100; k++ {
+		for _,n := range []int{3000,10,11} {
+			if err := tr.Insert(obj,bigElem(k,n)); err!=nil { t.Fatal(err) }
+		}
+	}
+	seen := make(map[string]int)
+	var tok []byte
+	for {
+		var err error
+		tok,err = tr.SearchPage(ctx,obj,all,1,tok,func(b []byte) { seen[string(b)]++ })
+		if err!=nil { t.Fatal(err) }
+		if tok==nil { break }
+		if len(tok)>256 { t.Fatalf("token of %d bytes",len(tok)) }
+	}
+	if len(seen)!=300 { t.Fatalf("%d values, want 300",len(seen)) }
+	for v,n := range seen {
+		if n!=1 { t.Fatalf("%d: reported %d times",ivKey(t,[]byte(v)),n) }
+	}
+}
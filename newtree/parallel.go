@@ -0,0 +1,254 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+package newtree
+
+import "github.com/byte-mug/golibs/bufferex"
+import "context"
+import "sync"
+
+/* A page, that is read by a worker of .ParallelSearchOrdered(). */
+type prefetch struct{
+	done chan struct{}
+	id   int64
+	b    bufferex.Binary
+	node Elements
+	lsn  uint64
+	err  error
+}
+func (p *prefetch) free() {
+	<-p.done
+	freeElements(p.node)
+	p.b.Free()
+}
+
+type orderedSearch struct{
+	t        *Tree
+	ver      uint16
+	ctx      context.Context
+	q        interface{}
+	consumer func([]byte)
+	jobs     chan *prefetch
+}
+func (s *orderedSearch) worker(wg *sync.WaitGroup) {
+	defer wg.Done()
+	for p := range s.jobs {
+		p.b,p.node,p.lsn,p.err = s.t.readPage(p.id,s.ver)
+		/* The overflowed values are read ahead as well. */
+		if p.err==nil { p.err = s.t.resolve(p.id,p.node) }
+		close(p.done)
+	}
+}
+func (s *orderedSearch) fetch(id int64) *prefetch {
+	p := &prefetch{done:make(chan struct{}),id:id}
+	s.jobs <- p
+	return p
+}
+
+/*
+Visits the page p like .search() does. The consistent children and moved
+siblings are handed to the workers, before the first of them is visited.
+*/
+func (s *orderedSearch) visit(p *prefetch, plsn uint64) error {
+	<-p.done
+	if p.err!=nil { return p.err }
+	subs := make([]*prefetch,len(p.node))
+	defer func() {
+		for _,c := range subs { if c!=nil { c.free() } }
+	}()
+	use := make([]bool,len(p.node))
+	for i,e := range p.node {
+		use[i] = s.t.Ops.Consistent(e.Val,s.q)
+		if use[i] && e.Ptr!=0 { subs[i] = s.fetch(e.Ptr) }
+	}
+	moved := s.t.movedFrom(p.id,plsn,p.lsn)
+	sibs := make([]*prefetch,len(moved))
+	for i,sib := range moved { sibs[i] = s.fetch(sib) }
+	subs = append(subs,sibs...)
+	
+	for i,e := range p.node {
+		if !use[i] { continue }
+		err := s.ctx.Err()
+		if err!=nil { return err }
+		if e.Ptr == 0 {
+			s.consumer(e.Val)
+			continue
+		}
+		err = s.visit(subs[i],p.lsn)
+		subs[i].free()
+		subs[i] = nil
+		if err!=nil { return err }
+	}
+	for i,c := range sibs {
+		err := s.visit(c,plsn)
+		c.free()
+		subs[len(p.node)+i] = nil
+		if err!=nil { return err }
+	}
+	return nil
+}
+
+type pageRef struct{
+	id   int64
+	plsn uint64
+}
+
+type unorderedSearch struct{
+	t        *Tree
+	ver      uint16
+	ctx      context.Context
+	cancel   context.CancelFunc
+	q        interface{}
+	consumer func([]byte)
+	cmu      sync.Mutex
+	mu       sync.Mutex
+	wake     sync.Cond
+	queue    []pageRef
+	limit    int
+	busy     int
+	err      error
+}
+func (s *unorderedSearch) worker(wg *sync.WaitGroup) {
+	defer wg.Done()
+	s.mu.Lock(); defer s.mu.Unlock()
+	for {
+		for len(s.queue)==0 && s.busy>0 && s.err==nil { s.wake.Wait() }
+		if len(s.queue)==0 || s.err!=nil { return }
+		r := s.queue[len(s.queue)-1]
+		s.queue = s.queue[:len(s.queue)-1]
+		s.busy++
+		s.mu.Unlock()
+		err := s.visit(r.id,r.plsn)
+		s.mu.Lock()
+		s.busy--
+		if err!=nil && s.err==nil {
+			s.err = err
+			s.cancel()
+		}
+		s.wake.Broadcast()
+	}
+}
+
+/* Queues a page for the workers. Returns false, if the queue is full. */
+func (s *unorderedSearch) push(id int64, plsn uint64) bool {
+	s.mu.Lock(); defer s.mu.Unlock()
+	if len(s.queue)>=s.limit { return false }
+	s.queue = append(s.queue,pageRef{id,plsn})
+	s.wake.Signal()
+	return true
+}
+func (s *unorderedSearch) visit(id int64, plsn uint64) error {
+	b,node,lsn,err := s.t.readPage(id,s.ver)
+	defer freeElements(node)
+	defer b.Free()
+	if err!=nil { return err }
+	
+	for _,e := range node {
+		err = s.t.resolveElement(id,&e)
+		if err!=nil { return err }
+		if s.t.Ops.Consistent(e.Val,s.q) {
+			err := s.ctx.Err()
+			if err!=nil { return err }
+			if e.Ptr == 0 {
+				s.cmu.Lock()
+				s.consumer(e.Val)
+				s.cmu.Unlock()
+			} else if !s.push(e.Ptr,lsn) {
+				/* The queue is full: descend on this worker. */
+				err = s.visit(e.Ptr,lsn)
+				if err!=nil { return err }
+			}
+		}
+	}
+	for _,sib := range s.t.movedFrom(id,plsn,lsn) {
+		if s.push(sib,plsn) { continue }
+		err = s.visit(sib,plsn)
+		if err!=nil { return err }
+	}
+	return nil
+}
+
+/*
+Like .Search(), but the subtrees are searched by up to workers goroutines in
+parallel, so that the reads of the pages overlap. The elements are reported in
+no particular order. consumer is called from the workers, but never
+concurrently. Ops.Consistent() must be safe for concurrent use.
+
+At most workers*64 pages are queued, beyond that, a worker descends into the
+subtree itself. If ctx is canceled or a page cannot be read, the workers stop
+and the error is returned.
+*/
+func (t *Tree) ParallelSearch(
+	ctx context.Context,
+	obj int64,
+	q interface{},
+	workers int,
+	consumer func([]byte)) error {
+	if workers<1 { workers = 1 }
+	defer t.endRead(t.beginRead())
+	rr,lsn,err := t.readRoot(obj)
+	if err!=nil || rr.Ptr==0 { return err }
+	
+	s := &unorderedSearch{t:t,ver:rr.Version,q:q,consumer:consumer,limit:workers*64}
+	s.ctx,s.cancel = context.WithCancel(ctx)
+	defer s.cancel()
+	s.wake.L = &s.mu
+	s.queue = append(s.queue,pageRef{rr.Ptr,lsn})
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i<workers; i++ { go s.worker(&wg) }
+	wg.Wait()
+	return s.err
+}
+
+/*
+Like .ParallelSearch(), but the elements are reported in the same order as
+.Search() reports them, and consumer is called on the calling goroutine.
+
+The tree is traversed by the caller, while workers goroutines read the
+children of the pages on its path ahead of time. The pages read ahead are
+bounded by the depth of the tree times the number of elements per page.
+*/
+func (t *Tree) ParallelSearchOrdered(
+	ctx context.Context,
+	obj int64,
+	q interface{},
+	workers int,
+	consumer func([]byte)) error {
+	if workers<1 { workers = 1 }
+	defer t.endRead(t.beginRead())
+	rr,lsn,err := t.readRoot(obj)
+	if err!=nil || rr.Ptr==0 { return err }
+	
+	s := &orderedSearch{t:t,ver:rr.Version,ctx:ctx,q:q,consumer:consumer,jobs:make(chan *prefetch,workers)}
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i<workers; i++ { go s.worker(&wg) }
+	root := s.fetch(rr.Ptr)
+	err = s.visit(root,lsn)
+	root.free()
+	close(s.jobs)
+	wg.Wait()
+	return err
+}
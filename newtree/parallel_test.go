@@ -0,0 +1,149 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+
+
+package newtree_test
+
+import "github.com/maxymania/gonbase/newtree"
+import "github.com/maxymania/gonbase/ntops"
+import "context"
+import "fmt"
+import "sort"
+import "sync"
+import "testing"
+
+/* Returns the keys reported by search in the order, they are reported. */
+func reported(t testing.TB, search func(consumer func([]byte)) error) []int64 {
+	var r []int64
+	if err := search(func(b []byte) { r = append(r,ivKey(t,b)) }); err!=nil { t.Fatal(err) }
+	return r
+}
+
+func TestParallelSearch(t *testing.T) {
+	ctx := context.Background()
+	tr := ivTree(newtree.NewMemBase(256))
+	obj,_ := tr.NewRoot()
+	for k := int64(0); k<3000; k++ {
+		/* Not in key order, so that the order of the pages matters. */
+		if err := tr.Insert(obj,ivElem(k*7919%3000)); err!=nil { t.Fatal(err) }
+	}
+	for _,q := range []interface{}{
+		all,
+		ntops.IntervalStab[int64]{At:1234},
+		ntops.IntervalOverlap[int64]{Low:100,High:900},
+		ntops.IntervalWithin[int64]{Low:2000,High:2100},
+		ntops.IntervalOverlap[int64]{Low:5000,High:6000},
+	} {
+		want := reported(t,func(f func([]byte)) error { return tr.Search(ctx,obj,q,f) })
+		sorted := append([]int64(nil),want...)
+		sort.Slice(sorted,func(i,j int) bool { return sorted[i]<sorted[j] })
+		for _,w := range []int{0,1,4,16} {
+			got := reported(t,func(f func([]byte)) error { return tr.ParallelSearchOrdered(ctx,obj,q,w,f) })
+			if fmt.Sprint(got)!=fmt.Sprint(want) { t.Fatalf("%#v, %d workers: ordered search differs from Search",q,w) }
+			
+			got = reported(t,func(f func([]byte)) error { return tr.ParallelSearch(ctx,obj,q,w,f) })
+			sort.Slice(got,func(i,j int) bool { return got[i]<got[j] })
+			if fmt.Sprint(got)!=fmt.Sprint(sorted) { t.Fatalf("%#v, %d workers: %d keys, want %d",q,w,len(got),len(sorted)) }
+		}
+	}
+	
+	cctx,cancel := context.WithCancel(ctx)
+	cancel()
+	if err := tr.ParallelSearch(cctx,obj,all,4,func([]byte) {}); err!=context.Canceled { t.Fatal(err) }
+	if err := tr.ParallelSearchOrdered(cctx,obj,all,4,func([]byte) {}); err!=context.Canceled { t.Fatal(err) }
+}
+
+/*
+Runs both parallel searches, while a writer inserts and deletes. Keys below
+stable are never deleted and every key is inserted only once, so each search
+must report every stable key exactly once and no key twice. Run with -race.
+*/
+func TestParallelSearchConcurrent(t *testing.T) {
+	for _,cow := range []bool{false,true} {
+		t.Run(fmt.Sprint("cow=",cow),func(t *testing.T) { parallelConcurrent(t,cow) })
+	}
+}
+
+func parallelConcurrent(t *testing.T, cow bool) {
+	const stable, total = 500, 2000
+	ctx := context.Background()
+	tr := ivTree(newtree.NewMemBase(256))
+	tr.CopyOnWrite = cow
+	obj,_ := tr.NewRoot()
+	insertRange(t,tr,obj,0,stable)
+	
+	var writer, readers sync.WaitGroup
+	done := make(chan struct{})
+	errs := make(chan error,8)
+	writer.Add(1)
+	go func() {
+		defer writer.Done()
+		for k := int64(stable); k<total; k++ {
+			if err := tr.Insert(obj,ivElem(k)); err!=nil { errs <- err; return }
+			if k%50!=49 { continue }
+			_,err := tr.Delete(ctx,obj,ntops.IntervalOverlap[int64]{Low:k-49,High:k},func(b []byte) bool {
+				/* Intervals from below k-49 overlap the query as well. */
+				n := ivKey(t,b)
+				return n>=k-49 && n%2==1
+			})
+			if err!=nil { errs <- err; return }
+		}
+	}()
+	for i := 0; i<4; i++ {
+		readers.Add(1)
+		go func(ordered bool) {
+			defer readers.Done()
+			for {
+				select {
+				case <-done: return
+				default:
+				}
+				/* consumer is never called concurrently. */
+				seen := make(map[int64]int)
+				consumer := func(b []byte) { seen[ivKey(t,b)]++ }
+				var err error
+				if ordered {
+					err = tr.ParallelSearchOrdered(ctx,obj,all,4,consumer)
+				} else {
+					err = tr.ParallelSearch(ctx,obj,all,4,consumer)
+				}
+				for k,n := range seen {
+					if err==nil && n>1 { err = fmt.Errorf("key %d seen %d times",k,n) }
+				}
+				for k := int64(0); k<stable && err==nil; k++ {
+					if seen[k]!=1 { err = fmt.Errorf("stable key %d missing",k) }
+				}
+				if err!=nil { errs <- err; return }
+			}
+		}(i%2==0)
+	}
+	
+	writer.Wait()
+	close(done)
+	readers.Wait()
+	close(errs)
+	for err := range errs { t.Fatal(err) }
+	verify(t,tr,obj)
+}
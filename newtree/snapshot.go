@@ -0,0 +1,101 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+package newtree
+
+import "context"
+import "errors"
+
+var ENoCopyOnWrite = errors.New("ENoCopyOnWrite")
+
+/*
+A Snapshot pins the Root of a tree at a point in time. Since a Tree in
+CopyOnWrite-mode never overwrites pages, that are reachable from a Root, the
+Snapshot sees a consistent state of the tree, regardless of any later writes.
+
+Pages, that are freed by writers, are not released as long as a Snapshot,
+that could reach them, exists. Therefore Snapshots should be released as soon
+as possible.
+*/
+type Snapshot struct{
+	t     *Tree
+	obj   int64
+	root  Root
+	lsn   uint64
+	start uint64
+	open  bool
+}
+
+// Creates a Snapshot of the tree obj. Requires .CopyOnWrite to be set.
+func (t *Tree) Snapshot(obj int64) (*Snapshot,error) {
+	if !t.CopyOnWrite { return nil,ENoCopyOnWrite }
+	s := &Snapshot{t:t,obj:obj,start:t.beginRead(),open:true}
+	var err error
+	s.root,s.lsn,err = t.readRoot(obj)
+	if err!=nil {
+		s.Release()
+		return nil,err
+	}
+	return s,nil
+}
+
+func (s *Snapshot) Root() Root { return s.root }
+
+func (s *Snapshot) Search(
+	ctx context.Context,
+	q interface{},
+	consumer func([]byte)) error {
+	if s.root.Ptr==0 { return nil }
+	return s.t.search(ctx,s.root.Ptr,s.lsn,s.root.Version,q,consumer)
+}
+
+func (s *Snapshot) GSearch(
+	ctx context.Context,
+	q interface{},
+	consume func(b []byte) bool) error {
+	if s.root.Ptr==0 { return nil }
+	return s.t.gsearch(ctx,s.root.Ptr,s.lsn,s.root.Version,q,consume)
+}
+
+// The Cursor remains valid, even if the Snapshot is released before it.
+func (s *Snapshot) Cursor(ctx context.Context, q interface{}) (*Cursor,error) {
+	return s.t.newCursor(ctx,s.obj,q,s.t.beginReadAt(s.start),s.root,s.lsn)
+}
+
+// Releases the Snapshot. The pages pinned by it are released by the next writer
+// or by .Reclaim().
+func (s *Snapshot) Release() {
+	if s.open {
+		s.open = false
+		s.t.endRead(s.start)
+	}
+}
+
+// Releases all freed pages, that are no longer reachable by any reader or Snapshot.
+func (t *Tree) Reclaim() (err error) {
+	if err = t.beginWrite(); err!=nil { return }
+	defer t.endWrite(&err)
+	return nil
+}
+
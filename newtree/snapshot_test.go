@@ -0,0 +1,115 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+
+
+package newtree_test
+
+import "github.com/maxymania/gonbase/newtree"
+import "context"
+import "fmt"
+import "sync"
+import "testing"
+
+/* Returns the keys seen by the Snapshot, through Search and Cursor. */
+func snapKeys(t testing.TB, s *newtree.Snapshot) []int64 {
+	var r []int64
+	if err := s.Search(context.Background(),all,func(b []byte) { r = append(r,ivKey(t,b)) }); err!=nil { t.Fatal(err) }
+	c,err := s.Cursor(context.Background(),all)
+	if err!=nil { t.Fatal(err) }
+	defer c.Close()
+	var rc []int64
+	for c.Next() { rc = append(rc,ivKey(t,c.Value())) }
+	if err = c.Err(); err!=nil { t.Fatal(err) }
+	if fmt.Sprint(rc)!=fmt.Sprint(r) { t.Fatalf("Cursor %v, Search %v",rc,r) }
+	return r
+}
+
+func TestSnapshot(t *testing.T) {
+	tr := ivTree(newtree.NewMemBase(256))
+	obj,_ := tr.NewRoot()
+	if _,err := tr.Snapshot(obj); err!=newtree.ENoCopyOnWrite { t.Fatal(err) }
+	
+	mb := newtree.NewMemBase(256)
+	tr = ivTree(mb)
+	tr.CopyOnWrite = true
+	obj,_ = tr.NewRoot()
+	insertRange(t,tr,obj,0,200)
+	want := fmt.Sprint(keys(t,tr,obj,all))
+	s,err := tr.Snapshot(obj)
+	if err!=nil { t.Fatal(err) }
+	
+	/* The writer replaces every key, the Snapshot keeps seeing the old ones. */
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for k := int64(0); k<200; k++ {
+			_,err := tr.Delete(context.Background(),obj,all,func(b []byte) bool { return ivKey(t,b)==k })
+			if err==nil { err = tr.Insert(obj,ivElem(k+1000)) }
+			if err!=nil { t.Error(err); return }
+		}
+	}()
+	for i := 0; i<20; i++ {
+		if got := fmt.Sprint(snapKeys(t,s)); got!=want { t.Fatalf("snapshot sees %s",got) }
+	}
+	wg.Wait()
+	if got := fmt.Sprint(snapKeys(t,s)); got!=want { t.Fatalf("snapshot sees %s",got) }
+	if got := keys(t,tr,obj,all); len(got)!=200 || got[0]!=1000 { t.Fatalf("tree has %d keys, from %d",len(got),got[0]) }
+	verify(t,tr,obj)
+	
+	/* The pages of the old state are pinned, until the Snapshot is released. */
+	if err = tr.Reclaim(); err!=nil { t.Fatal(err) }
+	leaks,err := mb.Leaks(context.Background(),tr,obj)
+	if err!=nil { t.Fatal(err) }
+	if len(leaks)==0 { t.Fatal("no pages are pinned by the Snapshot") }
+	s.Release()
+	s.Release()
+	noLeaks(t,mb,tr,obj)
+}
+
+/* A Cursor of a Snapshot outlives it. */
+func TestSnapshotCursor(t *testing.T) {
+	mb := newtree.NewMemBase(256)
+	tr := ivTree(mb)
+	tr.CopyOnWrite = true
+	obj,_ := tr.NewRoot()
+	insertRange(t,tr,obj,0,100)
+	s,err := tr.Snapshot(obj)
+	if err!=nil { t.Fatal(err) }
+	c,err := s.Cursor(context.Background(),all)
+	if err!=nil { t.Fatal(err) }
+	s.Release()
+	
+	_,err = tr.Delete(context.Background(),obj,all,func([]byte) bool { return true })
+	if err!=nil { t.Fatal(err) }
+	if err = tr.Reclaim(); err!=nil { t.Fatal(err) }
+	n := int64(0)
+	for ; c.Next(); n++ {
+		if k := ivKey(t,c.Value()); k!=n { t.Fatalf("key %d at %d",k,n) }
+	}
+	if err = c.Err(); err!=nil || n!=100 { t.Fatal(n,err) }
+	c.Close()
+	noLeaks(t,mb,tr,obj)
+}
@@ -0,0 +1,340 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+package newtree
+
+import "sort"
+
+/*
+Decides, how an overflowing node is split. Split(ops,P,maxsize) has the same
+contract as TreeOps.FirstSplit(). P is sorted by ops.Sort(), and the returned
+elements must be sorted as well. See Tree.Split.
+*/
+type SplitStrategy interface{
+	Split(ops TreeOps, P Elements, maxsize int) (Elements,Elements)
+}
+
+/*
+Optional extension to SplitStrategy. Before the first split on each level
+(except the root) during an .Insert(), some elements of the overflowing node P
+are removed and inserted again from the root, which often avoids the split.
+
+Returns the elements, that stay in the node, and the ones to reinsert. keep must
+not be empty.
+*/
+type ReinsertStrategy interface{
+	Reinsert(ops TreeOps, P Elements, maxsize int) (keep, out Elements)
+}
+
+/* The union of a and b, where a may be nil. */
+func union2(ops TreeOps, a, b []byte) []byte {
+	if a==nil { return b }
+	return ops.Union(Elements{{Val:a},{Val:b}})
+}
+
+/* The minimum fill of a split (40%, like R*-trees). */
+func minFill(total int) int { return total*2/5 }
+
+/*
+Guttman's quadratic split: the pair of elements, that would waste the most if
+put together (according to ops.Penalty()), seeds the two groups, then the
+element with the strongest preference for one group is assigned next. If a
+group ends up larger than maxsize, its elements are moved over to the other
+group, while they fit.
+
+If P does not fit in two pages, ops.FirstSplit() is used.
+*/
+type QuadraticSplit struct{}
+
+func (QuadraticSplit) Split(ops TreeOps, P Elements, maxsize int) (Elements,Elements) {
+	total := P.Length()
+	if total<=maxsize { return P,nil }
+	if total+4>2*maxsize || len(P)<2 { return ops.FirstSplit(P,maxsize) }
+	
+	s1,s2,worst := 0,1,0.0
+	for i := range P {
+		for j := i+1; j<len(P); j++ {
+			d := ops.Penalty(P[i].Val,P[j].Val)+ops.Penalty(P[j].Val,P[i].Val)
+			if d>worst { s1,s2,worst = i,j,d }
+		}
+	}
+	
+	used := make([]bool,len(P))
+	used[s1],used[s2] = true,true
+	A,B := Elements{P[s1]},Elements{P[s2]}
+	ua,ub := P[s1].Val,P[s2].Val
+	sa,sb := 4+P[s1].Length(),4+P[s2].Length()
+	rest := total-sa-sb+4
+	min := minFill(total)
+	
+	for left := len(P)-2; left>0; left-- {
+		/* If a group needs all remaining elements to reach the minimum fill, it gets them. */
+		if sa+rest<=min || sb+rest<=min {
+			toA := sa+rest<=min
+			for i,e := range P {
+				if used[i] { continue }
+				if toA { A = append(A,e) } else { B = append(B,e) }
+			}
+			break
+		}
+		
+		n,diff,da,db := -1,-1.0,0.0,0.0
+		for i,e := range P {
+			if used[i] { continue }
+			pa,pb := ops.Penalty(ua,e.Val),ops.Penalty(ub,e.Val)
+			d := pa-pb
+			if d<0 { d = -d }
+			if d!=d { d = 0 } /* Both are infinite. */
+			if d>diff { n,diff,da,db = i,d,pa,pb }
+		}
+		e := P[n]
+		used[n] = true
+		rest -= e.Length()
+		
+		toA := da<db || (da==db && sa<sb)
+		if toA && sa+e.Length()>maxsize { toA = false }
+		if !toA && sb+e.Length()>maxsize && sa+e.Length()<=maxsize { toA = true }
+		if toA {
+			A = append(A,e)
+			sa += e.Length()
+			ua = union2(ops,ua,e.Val)
+		} else {
+			B = append(B,e)
+			sb += e.Length()
+			ub = union2(ops,ub,e.Val)
+		}
+	}
+	
+	/* The last elements may not fit into either group. */
+	A,B,sa,sb = capGroup(ops,A,B,sa,sb,maxsize)
+	B,A,sb,sa = capGroup(ops,B,A,sb,sa,maxsize)
+	if sa>maxsize || sb>maxsize { return ops.FirstSplit(P,maxsize) }
+	ops.Sort(A)
+	ops.Sort(B)
+	return A,B
+}
+
+/*
+Moves elements of the group a, while it is larger than maxsize, into the group
+b, as long as they fit, the one, that enlarges b the least, first.
+*/
+func capGroup(ops TreeOps, a, b Elements, sa, sb, maxsize int) (Elements,Elements,int,int) {
+	for sa>maxsize {
+		ub := ops.Union(b)
+		n,best := -1,0.0
+		for i,e := range a {
+			if sb+e.Length()>maxsize { continue }
+			c := ops.Penalty(ub,e.Val)
+			if n<0 || c<best { n,best = i,c }
+		}
+		if n<0 { break }
+		e := a[n]
+		a = append(a[:n],a[n+1:]...)
+		b = append(b,e)
+		sa -= e.Length()
+		sb += e.Length()
+	}
+	return a,b,sa,sb
+}
+
+/* The unions of the first k (pre[k-1]) and of the last n-k (suf[k]) elements of P. */
+func prefixUnions(ops TreeOps, P Elements) (pre, suf [][]byte) {
+	n := len(P)
+	pre = make([][]byte,n)
+	suf = make([][]byte,n)
+	for i := range P {
+		j := n-1-i
+		pre[i],suf[j] = P[i].Val,P[j].Val
+		if i>0 {
+			pre[i] = union2(ops,pre[i-1],P[i].Val)
+			suf[j] = union2(ops,suf[j+1],P[j].Val)
+		}
+	}
+	return
+}
+
+/* The cuts k of P into P[:k] and P[k:], that leave both between min and maxsize bytes. */
+func splitCuts(P Elements, min, maxsize int) (cuts []int) {
+	total := P.Length()
+	sa := 4
+	for k := 1; k<len(P); k++ {
+		sa += P[k-1].Length()
+		sb := total-sa+4
+		if sa<min || sb<min || sa>maxsize || sb>maxsize { continue }
+		cuts = append(cuts,k)
+	}
+	return
+}
+
+/*
+The R*-tree split of Beckmann et al. It requires ops to implement BoxOps.
+
+For every axis, the elements are sorted by their lower and by their upper
+bounds, and the margins of both groups of every cut, that leaves both groups
+filled to 40%, are summed up. Along the axis with the smallest sum, the cut
+with the smallest overlap of the groups is taken, and of those the one with
+the smallest total area.
+
+If ops does not implement BoxOps, it cuts along the order of ops.Sort(): of all
+cuts, that leave both halves filled to 40%, it selects the one, whose halves
+don't overlap (if ops implements OverlapOps), then the one with the smallest
+mutual penalty, then the most even one.
+
+If P does not fit in two pages, ops.FirstSplit() is used.
+*/
+type RStarSplit struct{}
+
+func (RStarSplit) Split(ops TreeOps, P Elements, maxsize int) (Elements,Elements) {
+	total := P.Length()
+	if total<=maxsize { return P,nil }
+	if total+4>2*maxsize || len(P)<2 { return ops.FirstSplit(P,maxsize) }
+	bo,ok := ops.(BoxOps)
+	if !ok { return orderedSplit(ops,P,maxsize) }
+	
+	Q := append(Elements(nil),P...)
+	var best Elements
+	bestK,bestOv,bestArea := -1,0.0,0.0
+	for _,min := range []int{minFill(total),0} {
+		/* ChooseSplitAxis: the smallest sum of the margins. */
+		axis,bestS := -1,0.0
+		for a := 0; a<bo.Axes(); a++ {
+			S,n := 0.0,0
+			for _,upper := range []bool{false,true} {
+				bo.SortAxis(Q,a,upper)
+				pre,suf := prefixUnions(ops,Q)
+				for _,k := range splitCuts(Q,min,maxsize) {
+					S += bo.Margin(pre[k-1])+bo.Margin(suf[k])
+					n++
+				}
+			}
+			if n>0 && (axis<0 || S<bestS) { axis,bestS = a,S }
+		}
+		if axis<0 { continue }
+		
+		/* ChooseSplitIndex: the smallest overlap, then the smallest area. */
+		for _,upper := range []bool{false,true} {
+			bo.SortAxis(Q,axis,upper)
+			pre,suf := prefixUnions(ops,Q)
+			for _,k := range splitCuts(Q,min,maxsize) {
+				o := bo.OverlapArea(pre[k-1],suf[k])
+				ar := bo.Area(pre[k-1])+bo.Area(suf[k])
+				if bestK<0 || o<bestOv || (o==bestOv && ar<bestArea) {
+					best = append(best[:0],Q...)
+					bestK,bestOv,bestArea = k,o,ar
+				}
+			}
+		}
+		break
+	}
+	if bestK<0 { return ops.FirstSplit(P,maxsize) }
+	A,B := best[:bestK:bestK],best[bestK:]
+	ops.Sort(A)
+	ops.Sort(B)
+	return A,B
+}
+
+/* The split of RStarSplit for TreeOps without BoxOps. */
+func orderedSplit(ops TreeOps, P Elements, maxsize int) (Elements,Elements) {
+	total := P.Length()
+	ov,_ := ops.(OverlapOps)
+	pre,suf := prefixUnions(ops,P)
+	
+	best,bestOv,bestCost,bestBal := -1,false,0.0,0
+	for _,min := range []int{minFill(total),0} {
+		sa := 4
+		for k := 1; k<len(P); k++ {
+			sa += P[k-1].Length()
+			sb := total-sa+4
+			if sa<min || sb<min || sa>maxsize || sb>maxsize { continue }
+			o := ov!=nil && ov.Overlap(pre[k-1],suf[k])
+			c := ops.Penalty(pre[k-1],suf[k])+ops.Penalty(suf[k],pre[k-1])
+			bal := sa-sb
+			if bal<0 { bal = -bal }
+			switch {
+			case best<0:
+			case o!=bestOv: if o { continue }
+			case c!=bestCost: if c>bestCost { continue }
+			case bal>=bestBal: continue
+			}
+			best,bestOv,bestCost,bestBal = k,o,c,bal
+		}
+		if best>=0 { break }
+	}
+	if best<0 { return ops.FirstSplit(P,maxsize) }
+	return P[:best],P[best:]
+}
+
+/*
+Forced reinsertion (see ReinsertStrategy) on top of a SplitStrategy. The
+elements, that enlarge the node the most, are reinserted, the closest first.
+
+Readers, that run concurrently with an .Insert(), may miss the reinserted
+elements, unless the Tree uses CopyOnWrite.
+*/
+type ForcedReinsert struct{
+	// The split strategy. If nil, TreeOps.FirstSplit() is used.
+	SplitStrategy
+	
+	// The fraction of the elements to reinsert. If 0, 30% are reinserted.
+	Fraction float64
+}
+
+func (f ForcedReinsert) Split(ops TreeOps, P Elements, maxsize int) (Elements,Elements) {
+	if f.SplitStrategy==nil { return ops.FirstSplit(P,maxsize) }
+	return f.SplitStrategy.Split(ops,P,maxsize)
+}
+func (f ForcedReinsert) Reinsert(ops TreeOps, P Elements, maxsize int) (keep, out Elements) {
+	frac := f.Fraction
+	if frac<=0 { frac = 0.3 }
+	m := int(frac*float64(len(P)))
+	if m<1 { m = 1 }
+	if m>=len(P) { m = len(P)-1 }
+	if m<1 { return P,nil }
+	
+	/* The penalty of adding each element to the union of all others. */
+	n := len(P)
+	pre := make([][]byte,n+1)
+	suf := make([][]byte,n+1)
+	for i := range P {
+		pre[i+1] = union2(ops,pre[i],P[i].Val)
+		suf[n-1-i] = union2(ops,suf[n-i],P[n-1-i].Val)
+	}
+	cost := make([]float64,n)
+	idx := make([]int,n)
+	for i := range P {
+		idx[i] = i
+		others := pre[i]
+		if suf[i+1]!=nil { others = union2(ops,others,suf[i+1]) }
+		cost[i] = ops.Penalty(others,P[i].Val)
+	}
+	sort.SliceStable(idx,func(i,j int) bool { return cost[idx[i]]>cost[idx[j]] })
+	
+	drop := make([]bool,n)
+	for _,i := range idx[:m] { drop[i] = true }
+	for i := m-1; i>=0; i-- { out = append(out,P[idx[i]]) }
+	for i,e := range P {
+		if !drop[i] { keep = append(keep,e) }
+	}
+	return
+}
@@ -0,0 +1,168 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+package newtree_test
+
+import "github.com/maxymania/gonbase/newtree"
+import "github.com/maxymania/gonbase/ntops"
+import "bytes"
+import "context"
+import "fmt"
+import "math/rand"
+import "testing"
+
+/* Hides the optional interfaces of the TreeOps. */
+type plainOps struct{ newtree.TreeOps }
+
+var strategies = []struct{
+	name string
+	s    newtree.SplitStrategy
+	ops  newtree.TreeOps
+}{
+	{"quadratic",newtree.QuadraticSplit{},ntops.IntervalOps{}},
+	{"rstar",newtree.RStarSplit{},ntops.IntervalOps{}},
+	{"rstar-plain",newtree.RStarSplit{},plainOps{ntops.IntervalOps{}}},
+}
+
+/* Random intervals with values of random size, that fit into two pages of maxsize. */
+func randomNode(r *rand.Rand, maxsize int) newtree.Elements {
+	var P newtree.Elements
+	for {
+		lo := r.Int63n(10000)
+		e := newtree.Element{Val:ntops.EncodeInterval(lo,lo+r.Int63n(100),bytes.Repeat([]byte("v"),r.Intn(40)))}
+		if (append(P,e)).Length()+4>2*maxsize { break }
+		P = append(P,e)
+	}
+	ntops.IntervalOps{}.Sort(P)
+	return P
+}
+
+/* Reports, whether P can be cut into two groups, that fit. */
+func twoFit(P newtree.Elements, maxsize int) bool {
+	for k := 1; k<len(P); k++ {
+		if P[:k].Length()<=maxsize && P[k:].Length()<=maxsize { return true }
+	}
+	return false
+}
+
+func TestSplitFits(t *testing.T) {
+	const maxsize = 256
+	for _,st := range strategies {
+		r := rand.New(rand.NewSource(1))
+		for i := 0; i<2000; i++ {
+			P := randomNode(r,maxsize)
+			/*
+			Like Tree.storeNode(): the first group must fit, the rest is split again.
+			If no two groups fit, a third one is needed.
+			*/
+			var groups []newtree.Elements
+			rest := append(newtree.Elements(nil),P...)
+			for len(rest)>0 {
+				var cur newtree.Elements
+				cur,rest = st.s.Split(st.ops,rest,maxsize)
+				if cur.Length()>maxsize { t.Fatalf("%s: group of %d bytes, maxsize %d",st.name,cur.Length(),maxsize) }
+				groups = append(groups,cur)
+			}
+			if len(groups)<2 || len(groups)>3 || (len(groups)==3 && twoFit(P,maxsize)) {
+				t.Fatalf("%s: split %d elements into %d groups",st.name,len(P),len(groups))
+			}
+			seen := make(map[string]int)
+			for _,e := range P { seen[string(e.Val)]++ }
+			for _,g := range groups {
+				for _,e := range g { seen[string(e.Val)]-- }
+			}
+			for _,n := range seen {
+				if n!=0 { t.Fatalf("%s: elements lost or duplicated",st.name) }
+			}
+		}
+	}
+}
+
+/* Two clusters, sorted so that the order of ops.Sort() interleaves them. */
+func TestRStarSplitClusters(t *testing.T) {
+	ops := ntops.IntervalOps{}
+	var P newtree.Elements
+	for i := int64(0); i<8; i++ {
+		P = append(P,newtree.Element{Val:ntops.EncodeInterval(i,i+1000,nil)})
+		P = append(P,newtree.Element{Val:ntops.EncodeInterval(i+10,i+20,nil)})
+	}
+	ops.Sort(P)
+	A,B := newtree.RStarSplit{}.Split(ops,P,P.Length()*2/3)
+	if o := ops.OverlapArea(ops.Union(A),ops.Union(B)); o>ops.Area(ops.Union(A))/2 && o>ops.Area(ops.Union(B))/2 {
+		t.Fatalf("overlap %v between %d and %d elements",o,len(A),len(B))
+	}
+	if a,b := ops.Union(A),ops.Union(B); ops.Area(a)+ops.Area(b)>1100 {
+		t.Fatalf("areas %v and %v",ops.Area(a),ops.Area(b))
+	}
+}
+
+func TestSplitStrategies(t *testing.T) {
+	for _,st := range strategies {
+		t.Run(st.name,func(t *testing.T) {
+			tr := &newtree.Tree{IBase:newtree.NewMemBase(256),Ops:st.ops,Split:st.s}
+			obj,_ := tr.NewRoot()
+			r := rand.New(rand.NewSource(2))
+			for i := 0; i<2000; i++ {
+				lo := r.Int63n(100000)
+				if err := tr.Insert(obj,ntops.EncodeInterval(lo,lo+r.Int63n(50),[]byte(fmt.Sprint(i)))); err!=nil { t.Fatal(err) }
+			}
+			if st := verify(t,tr,obj); st.LeafEntries!=2000 { t.Fatal(st) }
+			if n := len(keys(t,tr,obj,all)); n!=2000 { t.Fatalf("found %d keys",n) }
+		})
+	}
+}
+
+/* Forced reinsertion moves elements between subtrees, none of them may get lost. */
+func TestForcedReinsert(t *testing.T) {
+	for _,fr := range []newtree.ForcedReinsert{{},{SplitStrategy:newtree.RStarSplit{},Fraction:0.5},{SplitStrategy:newtree.QuadraticSplit{},Fraction:0.01}} {
+		for _,cow := range []bool{false,true} {
+			tr := &newtree.Tree{IBase:newtree.NewMemBase(256),Ops:ntops.IntervalOps{},Split:fr,CopyOnWrite:cow}
+			obj,_ := tr.NewRoot()
+			r := rand.New(rand.NewSource(3))
+			for i := 0; i<2000; i++ {
+				lo := r.Int63n(100000)
+				if err := tr.Insert(obj,ntops.EncodeInterval(lo,lo+r.Int63n(50),[]byte(fmt.Sprint(i)))); err!=nil { t.Fatal(err) }
+			}
+			if st := verify(t,tr,obj); st.LeafEntries!=2000 || st.Depth<3 { t.Fatalf("%+v, cow=%v: %v",fr,cow,st) }
+			seen := make([]bool,2000)
+			err := tr.Search(context.Background(),obj,all,func(b []byte) {
+				_,_,v,err := ntops.DecodeInterval[int64](b)
+				if err!=nil { t.Fatal(err) }
+				var i int
+				fmt.Sscan(string(v),&i)
+				if seen[i] { t.Fatalf("value %d found twice",i) }
+				seen[i] = true
+			})
+			if err!=nil { t.Fatal(err) }
+			for i,ok := range seen {
+				if !ok { t.Fatalf("%+v, cow=%v: value %d lost",fr,cow,i) }
+			}
+		}
+	}
+	
+	/* Reinsert splits the node into the kept and the reinserted elements. */
+	P := randomNode(rand.New(rand.NewSource(4)),256)
+	keep,out := newtree.ForcedReinsert{Fraction:0.25}.Reinsert(ntops.IntervalOps{},P,256)
+	if len(out)!=int(0.25*float64(len(P))) || len(keep)+len(out)!=len(P) { t.Fatalf("%d kept and %d out of %d",len(keep),len(out),len(P)) }
+}
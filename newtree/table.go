@@ -0,0 +1,193 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+package newtree
+
+import "bytes"
+import "context"
+import "sync"
+
+/*
+A secondary index of a Table. Every row of the Table, for which Key returns
+an element, has this element in the tree Obj of Tree.
+*/
+type Index struct{
+	Tree *Tree
+	Obj  int64
+	
+	// Returns the element of row in the index, or nil, if row is not indexed.
+	// The element must identify the row (by containing its primary key), so
+	// that no two rows have the same element.
+	Key func(row []byte) []byte
+	
+	// Returns a query of the index, that is consistent with the element key.
+	Query func(key []byte) interface{}
+	
+	// Returns a query of the primary tree and a match function, that select
+	// the row, the element key belongs to.
+	Row func(key []byte) (interface{},func([]byte) bool)
+}
+
+func (x *Index) find(key []byte) (interface{},func([]byte) bool) {
+	return x.Query(key),func(e []byte) bool { return bytes.Equal(e,key) }
+}
+
+/*
+A Table consists of the primary tree Obj of Tree, that holds the rows, and any
+number of secondary Indexes. All Trees must share the same IBase.
+
+Every write to the Table updates the primary tree and all Indexes within one
+Batch (see Batch.Commit()). The writes of a Table are serialized, and all
+writes to its trees must go through the Table, otherwise the Indexes get out
+of sync.
+*/
+type Table struct{
+	Tree    *Tree
+	Obj     int64
+	Indexes []*Index
+	
+	mu      sync.Mutex
+}
+
+func (t *Table) addKeys(b *Batch, row []byte) {
+	for _,x := range t.Indexes {
+		if k := x.Key(row); k!=nil { b.Insert(x.Tree,x.Obj,k) }
+	}
+}
+func (t *Table) removeKeys(b *Batch, row []byte) {
+	for _,x := range t.Indexes {
+		if k := x.Key(row); k!=nil {
+			/* k may refer to the page buffer of row. */
+			q,m := x.find(append([]byte(nil),k...))
+			b.Delete(x.Tree,x.Obj,q,m)
+		}
+	}
+}
+
+/* Inserts row into the primary tree and its elements into the Indexes. */
+func (t *Table) Insert(ctx context.Context, row []byte) error {
+	t.mu.Lock(); defer t.mu.Unlock()
+	var b Batch
+	b.Insert(t.Tree,t.Obj,row)
+	t.addKeys(&b,row)
+	return b.Commit(ctx)
+}
+
+/*
+Inserts row, unless there is a row, that is consistent with q and accepted by
+match, in which case EExists is returned (see Tree.InsertUnique()).
+*/
+func (t *Table) InsertUnique(ctx context.Context, q interface{}, row []byte, match func([]byte) bool) error {
+	t.mu.Lock(); defer t.mu.Unlock()
+	var b Batch
+	b.InsertUnique(t.Tree,t.Obj,q,row,match)
+	t.addKeys(&b,row)
+	return b.Commit(ctx)
+}
+
+/*
+Returns a copy of the first row, that is consistent with q and accepted by match.
+
+This is the row, Tree.Upsert() replaces: Both, the Cursor and .upsert(), walk
+the tree depth-first, in the order of the elements of each page, and the
+writes of the Table are serialized, so the tree can't change in between.
+*/
+func (t *Table) first(ctx context.Context, q interface{}, match func([]byte) bool) ([]byte,error) {
+	c,err := t.Tree.Cursor(ctx,t.Obj,q)
+	if err!=nil { return nil,err }
+	defer c.Close()
+	for c.Next() {
+		if match(c.Value()) { return append([]byte(nil),c.Value()...),nil }
+	}
+	return nil,c.Err()
+}
+
+/*
+Replaces the first row, that is consistent with q and accepted by match, by
+row, or inserts row, if there is no such row (see Tree.Upsert()). The elements
+of the old row, that differ from the new one, are replaced in the Indexes.
+Returns true, if a row has been replaced.
+*/
+func (t *Table) Upsert(ctx context.Context, q interface{}, row []byte, match func([]byte) bool) (bool,error) {
+	t.mu.Lock(); defer t.mu.Unlock()
+	old,err := t.first(ctx,q,match)
+	if err!=nil { return false,err }
+	
+	var b Batch
+	b.Upsert(t.Tree,t.Obj,q,row,match)
+	for _,x := range t.Indexes {
+		var ok []byte
+		if old!=nil { ok = x.Key(old) }
+		nk := x.Key(row)
+		if ok!=nil && nk!=nil && bytes.Equal(ok,nk) { continue }
+		if ok!=nil {
+			q,m := x.find(ok)
+			b.Delete(x.Tree,x.Obj,q,m)
+		}
+		if nk!=nil { b.Insert(x.Tree,x.Obj,nk) }
+	}
+	return old!=nil,b.Commit(ctx)
+}
+
+/*
+Deletes all rows, that are consistent with q and accepted by chk, and their
+elements from the Indexes. Returns the number of deleted rows.
+*/
+func (t *Table) Delete(ctx context.Context, q interface{}, chk func([]byte) bool) (int,error) {
+	t.mu.Lock(); defer t.mu.Unlock()
+	var b Batch
+	n := 0
+	err := t.Tree.Search(ctx,t.Obj,q,func(row []byte) {
+		if !chk(row) { return }
+		n++
+		t.removeKeys(&b,row)
+	})
+	if err!=nil || n==0 { return 0,err }
+	b.Delete(t.Tree,t.Obj,q,chk)
+	err = b.Commit(ctx)
+	if err!=nil { return 0,err }
+	return n,nil
+}
+
+/*
+Searches the Index x with the query q, and reports the rows, the consistent
+elements belong to. Elements, whose row has been changed in the meantime, are
+skipped.
+*/
+func (t *Table) IndexSearch(ctx context.Context, x *Index, q interface{}, consumer func([]byte)) error {
+	c,err := x.Tree.Cursor(ctx,x.Obj,q)
+	if err!=nil { return err }
+	defer c.Close()
+	for c.Next() {
+		k := c.Value()
+		rq,m := x.Row(k)
+		err = t.Tree.Search(ctx,t.Obj,rq,func(row []byte) {
+			if !m(row) { return }
+			if nk := x.Key(row); nk==nil || !bytes.Equal(nk,k) { return }
+			consumer(row)
+		})
+		if err!=nil { return err }
+	}
+	return c.Err()
+}
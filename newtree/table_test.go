@@ -0,0 +1,239 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+
+
+package newtree_test
+
+import "github.com/maxymania/gonbase/newtree"
+import "github.com/maxymania/gonbase/ntops"
+import "context"
+import "encoding/binary"
+import "fmt"
+import "sort"
+import "testing"
+
+/* The row id, with the attribute attr[0] or, if attr is empty, without one. */
+func tableRow(id int64, attr ...int64) []byte {
+	var v []byte
+	if len(attr)>0 { v = binary.BigEndian.AppendUint64(nil,uint64(attr[0])) }
+	return ntops.EncodeInterval(id,id,v)
+}
+
+/* Selects the row id in the primary tree. */
+func rowQuery(id int64) (interface{},func([]byte) bool) {
+	return ntops.IntervalStab[int64]{At:id},func(b []byte) bool {
+		lo,_,_,err := ntops.DecodeInterval[int64](b)
+		return err==nil && lo==id
+	}
+}
+
+/* An Index of the attributes. Its elements are attr..attr with the row id as value. */
+func attrIndex(tr *newtree.Tree, obj int64) *newtree.Index {
+	return &newtree.Index{Tree:tr,Obj:obj,
+		Key: func(row []byte) []byte {
+			id,_,v,err := ntops.DecodeInterval[int64](row)
+			if err!=nil || len(v)!=8 { return nil }
+			a := int64(binary.BigEndian.Uint64(v))
+			return ntops.EncodeInterval(a,a,binary.BigEndian.AppendUint64(nil,uint64(id)))
+		},
+		Query: func(key []byte) interface{} {
+			a,_,_,_ := ntops.DecodeInterval[int64](key)
+			return ntops.IntervalStab[int64]{At:a}
+		},
+		Row: func(key []byte) (interface{},func([]byte) bool) {
+			_,_,v,_ := ntops.DecodeInterval[int64](key)
+			return rowQuery(int64(binary.BigEndian.Uint64(v)))
+		},
+	}
+}
+
+func newTable(t testing.TB) *newtree.Table {
+	base := newtree.NewMemBase(256)
+	rows,idx := ivTree(base),ivTree(base)
+	robj,err := rows.NewRoot()
+	if err!=nil { t.Fatal(err) }
+	iobj,err := idx.NewRoot()
+	if err!=nil { t.Fatal(err) }
+	return &newtree.Table{Tree:rows,Obj:robj,Indexes:[]*newtree.Index{attrIndex(idx,iobj)}}
+}
+
+/* Returns the rows as "id" or "id:attr", sorted by id. */
+func tableRows(t testing.TB, tb *newtree.Table) []string {
+	var r []string
+	err := tb.Tree.Search(context.Background(),tb.Obj,all,func(b []byte) {
+		id,_,v,err := ntops.DecodeInterval[int64](b)
+		if err!=nil { t.Fatal(err) }
+		if len(v)==8 {
+			r = append(r,fmt.Sprintf("%d:%d",id,int64(binary.BigEndian.Uint64(v))))
+		} else {
+			r = append(r,fmt.Sprint(id))
+		}
+	})
+	if err!=nil { t.Fatal(err) }
+	sort.Strings(r)
+	return r
+}
+
+/* Returns the index elements as "id:attr", sorted by id. */
+func indexRows(t testing.TB, tb *newtree.Table) []string {
+	x := tb.Indexes[0]
+	var r []string
+	err := x.Tree.Search(context.Background(),x.Obj,all,func(b []byte) {
+		a,_,v,err := ntops.DecodeInterval[int64](b)
+		if err!=nil { t.Fatal(err) }
+		r = append(r,fmt.Sprintf("%d:%d",int64(binary.BigEndian.Uint64(v)),a))
+	})
+	if err!=nil { t.Fatal(err) }
+	sort.Strings(r)
+	return r
+}
+
+/* Checks, that the index holds exactly the attributes of the rows. */
+func checkIndex(t testing.TB, tb *newtree.Table) {
+	var want []string
+	for _,r := range tableRows(t,tb) {
+		for i := range r {
+			if r[i]==':' { want = append(want,r); break }
+		}
+	}
+	got := indexRows(t,tb)
+	if fmt.Sprint(got)!=fmt.Sprint(want) { t.Fatalf("index %v, want %v",got,want) }
+}
+
+/* Returns the sorted ids of the rows with the attribute a, found by IndexSearch. */
+func byAttr(t testing.TB, tb *newtree.Table, a int64) []int64 {
+	var r []int64
+	err := tb.IndexSearch(context.Background(),tb.Indexes[0],ntops.IntervalStab[int64]{At:a},func(b []byte) {
+		r = append(r,ivKey(t,b))
+	})
+	if err!=nil { t.Fatal(err) }
+	sort.Slice(r,func(i,j int) bool { return r[i]<r[j] })
+	return r
+}
+
+func TestTableInsert(t *testing.T) {
+	ctx := context.Background()
+	tb := newTable(t)
+	for id := int64(0); id<200; id++ {
+		var err error
+		if id%4==3 {
+			err = tb.Insert(ctx,tableRow(id))
+		} else {
+			err = tb.Insert(ctx,tableRow(id,id%10))
+		}
+		if err!=nil { t.Fatal(err) }
+	}
+	if n := len(tableRows(t,tb)); n!=200 { t.Fatalf("%d rows",n) }
+	if n := len(indexRows(t,tb)); n!=150 { t.Fatalf("%d index elements",n) }
+	checkIndex(t,tb)
+	
+	/* Every fourth row (id%4==3) has no attribute. */
+	got := byAttr(t,tb,2)
+	var want []int64
+	for id := int64(2); id<200; id += 10 {
+		if id%4!=3 { want = append(want,id) }
+	}
+	if fmt.Sprint(got)!=fmt.Sprint(want) { t.Fatalf("attr 2: %v, want %v",got,want) }
+	if got = byAttr(t,tb,10); len(got)!=0 { t.Fatalf("attr 10: %v",got) }
+}
+
+func TestTableInsertUnique(t *testing.T) {
+	ctx := context.Background()
+	tb := newTable(t)
+	for id := int64(0); id<50; id++ {
+		q,m := rowQuery(id)
+		if err := tb.InsertUnique(ctx,q,tableRow(id,id%5),m); err!=nil { t.Fatal(err) }
+	}
+	rows,idx := tableRows(t,tb),indexRows(t,tb)
+	
+	/* The Batch is rolled back, so the index element of the new row is not added. */
+	q,m := rowQuery(7)
+	if err := tb.InsertUnique(ctx,q,tableRow(7,99),m); err!=newtree.EExists { t.Fatalf("InsertUnique = %v, want EExists",err) }
+	if fmt.Sprint(tableRows(t,tb))!=fmt.Sprint(rows) { t.Fatal("rows changed by a failed InsertUnique") }
+	if fmt.Sprint(indexRows(t,tb))!=fmt.Sprint(idx) { t.Fatal("index changed by a failed InsertUnique") }
+	if got := byAttr(t,tb,99); len(got)!=0 { t.Fatalf("attr 99: %v",got) }
+	
+	q,m = rowQuery(50)
+	if err := tb.InsertUnique(ctx,q,tableRow(50,99),m); err!=nil { t.Fatal(err) }
+	if got := byAttr(t,tb,99); fmt.Sprint(got)!="[50]" { t.Fatalf("attr 99: %v",got) }
+	checkIndex(t,tb)
+}
+
+func TestTableUpsert(t *testing.T) {
+	ctx := context.Background()
+	tb := newTable(t)
+	for id := int64(0); id<100; id++ {
+		if err := tb.Insert(ctx,tableRow(id,id%10)); err!=nil { t.Fatal(err) }
+	}
+	if err := tb.Insert(ctx,tableRow(100)); err!=nil { t.Fatal(err) }
+	
+	for _,x := range []struct{
+		name string
+		id   int64
+		row  []byte
+		rep  bool
+		attr map[int64]string
+	}{
+		{"unchanged",13,tableRow(13,3),true,map[int64]string{3:"[3 13 23 33 43 53 63 73 83 93]"}},
+		{"changed",13,tableRow(13,7),true,map[int64]string{3:"[3 23 33 43 53 63 73 83 93]",7:"[7 13 17 27 37 47 57 67 77 87 97]"}},
+		{"added",100,tableRow(100,7),true,map[int64]string{7:"[7 13 17 27 37 47 57 67 77 87 97 100]"}},
+		{"removed",17,tableRow(17),true,map[int64]string{7:"[7 13 27 37 47 57 67 77 87 97 100]"}},
+		{"inserted",101,tableRow(101,3),false,map[int64]string{3:"[3 23 33 43 53 63 73 83 93 101]"}},
+	} {
+		q,m := rowQuery(x.id)
+		rep,err := tb.Upsert(ctx,q,x.row,m)
+		if err!=nil { t.Fatalf("%s: %v",x.name,err) }
+		if rep!=x.rep { t.Fatalf("%s: replaced = %v",x.name,rep) }
+		for a,want := range x.attr {
+			if got := fmt.Sprint(byAttr(t,tb,a)); got!=want { t.Fatalf("%s: attr %d: %s, want %s",x.name,a,got,want) }
+		}
+		checkIndex(t,tb)
+	}
+	if n := len(tableRows(t,tb)); n!=102 { t.Fatalf("%d rows",n) }
+}
+
+func TestTableDelete(t *testing.T) {
+	ctx := context.Background()
+	tb := newTable(t)
+	for id := int64(0); id<200; id++ {
+		if err := tb.Insert(ctx,tableRow(id,id%10)); err!=nil { t.Fatal(err) }
+	}
+	/* Deletes the even rows from 50 to 149. */
+	n,err := tb.Delete(ctx,ntops.IntervalOverlap[int64]{Low:50,High:149},func(b []byte) bool { return ivKey(t,b)%2==0 })
+	if err!=nil { t.Fatal(err) }
+	if n!=50 { t.Fatalf("deleted %d rows, want 50",n) }
+	if n := len(tableRows(t,tb)); n!=150 { t.Fatalf("%d rows",n) }
+	checkIndex(t,tb)
+	
+	got := byAttr(t,tb,4)
+	var want []int64
+	for id := int64(4); id<200; id += 10 {
+		if id<50 || id>=150 { want = append(want,id) }
+	}
+	if fmt.Sprint(got)!=fmt.Sprint(want) { t.Fatalf("attr 4: %v, want %v",got,want) }
+	
+	n,err = tb.Delete(ctx,ntops.IntervalOverlap[int64]{Low:300,High:400},func([]byte) bool { return true })
+	if err!=nil || n!=0 { t.Fatalf("Delete = %d, %v",n,err) }
+}
@@ -0,0 +1,110 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+package newtree
+
+import "context"
+import "iter"
+
+/*
+Converts the values of a TypedTree into leaf values and back, and queries of
+type Q into the queries, that the TreeOps of the tree understand.
+*/
+type Codec[V, Q any] interface{
+	Encode(v V) ([]byte,error)
+	
+	// Decodes a leaf value. b must not be retained, it is only valid during the call.
+	Decode(b []byte) (V,error)
+	
+	Query(q Q) interface{}
+}
+
+/*
+A typed view on the tree Obj in T. The Codec must match the TreeOps of T.
+*/
+type TypedTree[V, Q any] struct{
+	T     *Tree
+	Obj   int64
+	Codec Codec[V,Q]
+}
+
+func NewTypedTree[V, Q any](t *Tree, obj int64, c Codec[V,Q]) *TypedTree[V,Q] {
+	return &TypedTree[V,Q]{t,obj,c}
+}
+
+func (t *TypedTree[V,Q]) Insert(v V) error {
+	b,err := t.Codec.Encode(v)
+	if err!=nil { return err }
+	return t.T.Insert(t.Obj,b)
+}
+
+/*
+Returns the values matching q. The search runs, while the sequence is iterated,
+and stops, when the loop is left. If the search fails, or a value can't be
+decoded, the error is yielded last, with the zero V.
+
+	for v,err := range tt.Search(ctx,q) {
+		if err!=nil { ... }
+		...
+	}
+*/
+func (t *TypedTree[V,Q]) Search(ctx context.Context, q Q) iter.Seq2[V,error] {
+	return func(yield func(V,error) bool) {
+		sctx,cancel := context.WithCancel(ctx)
+		defer cancel()
+		stopped := false
+		var derr error
+		err := t.T.Search(sctx,t.Obj,t.Codec.Query(q),func(b []byte) {
+			if stopped { return }
+			v,e := t.Codec.Decode(b)
+			if e!=nil {
+				derr = e
+			} else if yield(v,nil) {
+				return
+			}
+			stopped = true
+			cancel()
+		})
+		if derr!=nil {
+			err = derr
+		} else if stopped {
+			return
+		}
+		if err!=nil {
+			var v V
+			yield(v,err)
+		}
+	}
+}
+
+/*
+Deletes the values matching q, for which pred returns true. Values, that can't
+be decoded, are kept.
+*/
+func (t *TypedTree[V,Q]) Delete(ctx context.Context, q Q, pred func(V) bool) (r_abort, r_err error) {
+	return t.T.Delete(ctx,t.Obj,t.Codec.Query(q),func(b []byte) bool {
+		v,err := t.Codec.Decode(b)
+		return err==nil && pred(v)
+	})
+}
@@ -0,0 +1,99 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+
+
+package newtree_test
+
+import "github.com/maxymania/gonbase/newtree"
+import "github.com/maxymania/gonbase/ntops"
+import "context"
+import "fmt"
+import "reflect"
+import "sort"
+import "testing"
+
+func TestGroupCodec(t *testing.T) {
+	var c ntops.GroupCodec
+	v := ntops.GroupEntry{GroupID:3,Article:1<<40,Expires:99,Value:[]byte("value")}
+	b,err := c.Encode(v)
+	if err!=nil { t.Fatal(err) }
+	if w,err := c.Decode(b); err!=nil || !reflect.DeepEqual(w,v) { t.Fatal(w,err) }
+	if _,err := c.Decode(ntops.GroupOps{}.Union(newtree.Elements{{Val:b}})); err!=ntops.EIsSumary { t.Fatal(err) }
+	
+	tr := &newtree.Tree{IBase:newtree.NewMemBase(256),Ops:ntops.GroupOps{}}
+	obj,_ := tr.NewRoot()
+	gt := ntops.NewGroupTree(tr,obj)
+	for i := uint64(0); i<300; i++ {
+		if err := gt.Insert(ntops.GroupEntry{GroupID:i%3,Article:i,Value:[]byte(fmt.Sprint(i))}); err!=nil { t.Fatal(err) }
+	}
+	var got []uint64
+	for v,err := range gt.Search(context.Background(),&ntops.GroupQuery{GroupID:1,ArticleLow:10,ArticleHigh:40}) {
+		if err!=nil { t.Fatal(err) }
+		if v.GroupID!=1 || string(v.Value)!=fmt.Sprint(v.Article) { t.Fatal(v) }
+		got = append(got,v.Article)
+	}
+	sort.Slice(got,func(i,j int) bool { return got[i]<got[j] })
+	if fmt.Sprint(got)!="[10 13 16 19 22 25 28 31 34 37 40]" { t.Fatal(got) }
+	
+	/* Leaving the loop stops the search. */
+	n := 0
+	for _,err := range gt.Search(context.Background(),&ntops.GroupExpired{Timestamp:0}) {
+		if err!=nil { t.Fatal(err) }
+		if n++; n==5 { break }
+	}
+	
+	/* The error of the search is yielded last. */
+	ctx,cancel := context.WithCancel(context.Background())
+	cancel()
+	var errs []error
+	for _,err := range gt.Search(ctx,&ntops.GroupExpired{Timestamp:0}) { errs = append(errs,err) }
+	if len(errs)==0 || errs[len(errs)-1]!=context.Canceled { t.Fatal(errs) }
+}
+
+func TestStrCodec(t *testing.T) {
+	var c ntops.StrCodec
+	v := ntops.StrPair{Key:[]byte("key"),Value:[]byte("value")}
+	b,err := c.Encode(v)
+	if err!=nil { t.Fatal(err) }
+	if w,err := c.Decode(b); err!=nil || !reflect.DeepEqual(w,v) { t.Fatal(w,err) }
+	if _,err := c.Decode([]byte{0xc1}); err==nil { t.Fatal("decoded garbage") }
+	
+	tr := &newtree.Tree{IBase:newtree.NewMemBase(256),Ops:ntops.StrOps{}}
+	obj,_ := tr.NewRoot()
+	st := ntops.NewStrTree(tr,obj)
+	for i := 0; i<300; i++ {
+		k := fmt.Sprintf("k%03d",i)
+		if err := st.Insert(ntops.StrPair{Key:[]byte(k),Value:[]byte(k+"~")}); err!=nil { t.Fatal(err) }
+	}
+	verify(t,tr,obj)
+	var got []string
+	for v,err := range st.Search(context.Background(),ntops.StrRange{Low:[]byte("k010"),High:[]byte("k019")}) {
+		if err!=nil { t.Fatal(err) }
+		if string(v.Value)!=string(v.Key)+"~" { t.Fatal(v) }
+		got = append(got,string(v.Key))
+	}
+	sort.Strings(got)
+	if fmt.Sprint(got)!="[k010 k011 k012 k013 k014 k015 k016 k017 k018 k019]" { t.Fatal(got) }
+}
@@ -0,0 +1,139 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+package newtree
+
+import "errors"
+
+var EExists = errors.New("EExists")
+
+/*
+Looks for the first leaf-element below page id, that is consistent with q and
+accepted by match. If ne is not nil, the element is replaced by *ne, and the
+elements for the parent page are returned, with the keys updated along the
+path. Otherwise the tree is not modified.
+
+Once the leaf with *ne has been written, ne.Ovf is cleared, as its chain is
+then owned by the tree.
+*/
+func (t *Tree) upsert(id int64, ver uint16, q interface{}, match func([]byte) bool, ne *Element) (r_elems Elements, r_found bool, r_err error) {
+	b,node,err := t.getPage(id,ver)
+	defer freeElements(node)
+	defer b.Free()
+	if err!=nil { r_err = err; return }
+	
+	for i,e := range node {
+		if !t.Ops.Consistent(e.Val,q) { continue }
+		if e.Ptr!=0 {
+			elems,found,err := t.upsert(e.Ptr,ver,q,match,ne)
+			if err!=nil { r_err = err; return }
+			if !found { continue }
+			r_found = true
+			if ne==nil { return }
+			node[i] = elems[0]
+			node = append(node,elems[1:]...)
+		} else {
+			if !match(e.Val) { continue }
+			r_found = true
+			if ne==nil { return }
+			node[i] = *ne
+			t.Ops.Sort(node)
+			r_elems,r_err = t.storeNode(id,node)
+			if r_err!=nil { return }
+			ne.Ovf = 0
+			/* The old chain is freed, once the leaf does not refer to it. */
+			if e.Ovf!=0 { r_err = t.freeOverflow(e.Ovf) }
+			return
+		}
+		t.Ops.Sort(node)
+		r_elems,r_err = t.storeNode(id,node)
+		return
+	}
+	return
+}
+
+/* Replaces the first match of q and match in the tree obj by *ne, see .upsert(). */
+func (t *Tree) upsertRoot(obj int64, rr Root, q interface{}, match func([]byte) bool, ne *Element) (bool,error) {
+	if rr.Ptr==0 { return false,nil }
+	elems,found,err := t.upsert(rr.Ptr,rr.Version,q,match,ne)
+	if err!=nil || !found { return found,err }
+	
+	nr := rr
+	if len(elems) > 1 {
+		id,err := t.insertPage(elems)
+		if err!=nil { return true,err }
+		nr.Ptr = id
+		nr.Depth++
+	} else {
+		nr.Ptr = elems[0].Ptr
+	}
+	if nr!=rr { return true,t.putRoot(obj,nr) }
+	return true,nil
+}
+
+/*
+Replaces the first leaf-element, that is consistent with q and accepted by
+match, by newVal, or inserts newVal, if there is no such element. Returns
+true, if an element has been replaced.
+
+The replacement stays in the leaf of the old element, and the keys along the
+path are updated, so that they cover newVal. q should be consistent with the
+keys of both, the old element and newVal.
+*/
+func (t *Tree) Upsert(obj int64, q interface{}, newVal []byte, match func([]byte) bool) (replaced bool, err error) {
+	if err = t.beginWrite(); err!=nil { return }
+	defer t.endWrite(&err)
+	rr,err := t.getRoot(obj)
+	if err!=nil { return false,err }
+	
+	ne,err := t.leafElement(newVal)
+	if err!=nil { return false,err }
+	replaced,err = t.upsertRoot(obj,rr,q,match,&ne)
+	if err!=nil && ne.Ovf!=0 {
+		/* The chain has not become part of the tree. */
+		err = errors.Join(err,t.freeOverflow(ne.Ovf))
+	}
+	if err!=nil || replaced { return }
+	return false,t.insertRoot(obj,rr,ne)
+}
+
+/*
+Inserts nitem, unless there is a leaf-element, that is consistent with q and
+accepted by match, in which case EExists is returned.
+*/
+func (t *Tree) InsertUnique(obj int64, q interface{}, nitem []byte, match func([]byte) bool) (err error) {
+	if err = t.beginWrite(); err!=nil { return }
+	defer t.endWrite(&err)
+	rr,err := t.getRoot(obj)
+	if err!=nil { return err }
+	
+	if rr.Ptr!=0 {
+		_,found,err := t.upsert(rr.Ptr,rr.Version,q,match,nil)
+		if err!=nil { return err }
+		if found { return EExists }
+	}
+	ne,err := t.leafElement(nitem)
+	if err!=nil { return err }
+	return t.insertRoot(obj,rr,ne)
+}
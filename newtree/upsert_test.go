@@ -0,0 +1,126 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+
+
+package newtree_test
+
+import "github.com/maxymania/gonbase/newtree"
+import "github.com/maxymania/gonbase/ntops"
+import "bytes"
+import "context"
+import "errors"
+import "testing"
+
+/* Matches the elements of key k. */
+func isKey(t testing.TB, k int64) func([]byte) bool {
+	return func(b []byte) bool { return ivKey(t,b)==k }
+}
+
+/* Returns the values of the elements of key k. */
+func values(t testing.TB, tr *newtree.Tree, obj, k int64) (r [][]byte) {
+	err := tr.Search(context.Background(),obj,ntops.IntervalStab[int64]{At:k},func(b []byte) {
+		if ivKey(t,b)!=k { return }
+		_,_,v,err := ntops.DecodeInterval[int64](b)
+		if err!=nil { t.Fatal(err) }
+		r = append(r,append([]byte(nil),v...))
+	})
+	if err!=nil { t.Fatal(err) }
+	return
+}
+
+func TestUpsert(t *testing.T) {
+	for _,cow := range []bool{false,true} {
+		mb := newtree.NewMemBase(256)
+		tr := ivTree(mb)
+		tr.CopyOnWrite = cow
+		obj,_ := tr.NewRoot()
+		insertRange(t,tr,obj,0,300)
+		
+		/* The new interval reaches beyond all keys, the unions must follow. */
+		q := ntops.IntervalStab[int64]{At:150}
+		ok,err := tr.Upsert(obj,q,ntops.EncodeInterval[int64](150,5000,[]byte("new")),isKey(t,150))
+		if err!=nil || !ok { t.Fatal(ok,err) }
+		verify(t,tr,obj)
+		if got := keys(t,tr,obj,ntops.IntervalStab[int64]{At:4000}); len(got)!=1 || got[0]!=150 { t.Fatalf("cow=%v: %v",cow,got) }
+		
+		/* Small to overflowed, overflowed to overflowed, and back. */
+		for _,n := range []int{2000,1000,5} {
+			v := bigElem(150,n)
+			if ok,err = tr.Upsert(obj,q,v,isKey(t,150)); err!=nil || !ok { t.Fatal(ok,err) }
+			verify(t,tr,obj)
+			vs := values(t,tr,obj,150)
+			if len(vs)!=1 || !bytes.Equal(vs[0],bytes.Repeat([]byte{150},n)) { t.Fatalf("cow=%v: %d values after upsert of %d bytes",cow,len(vs),n) }
+		}
+		
+		/* Without a match, the element is inserted. */
+		if ok,err = tr.Upsert(obj,ntops.IntervalStab[int64]{At:1000},bigElem(1000,2000),isKey(t,1000)); err!=nil || ok { t.Fatal(ok,err) }
+		if got := keys(t,tr,obj,all); len(got)!=301 { t.Fatalf("cow=%v: %d keys",cow,len(got)) }
+		verify(t,tr,obj)
+		noLeaks(t,mb,tr,obj)
+	}
+}
+
+func TestInsertUnique(t *testing.T) {
+	mb := newtree.NewMemBase(256)
+	tr := ivTree(mb)
+	obj,_ := tr.NewRoot()
+	for k := int64(0); k<300; k++ {
+		if err := tr.InsertUnique(obj,ntops.IntervalStab[int64]{At:k},ivElem(k),isKey(t,k)); err!=nil { t.Fatal(err) }
+	}
+	for k := int64(0); k<300; k += 7 {
+		err := tr.InsertUnique(obj,ntops.IntervalStab[int64]{At:k},bigElem(k,2000),isKey(t,k))
+		if err!=newtree.EExists { t.Fatal(k,err) }
+	}
+	if got := keys(t,tr,obj,all); len(got)!=300 { t.Fatalf("%d keys",len(got)) }
+	verify(t,tr,obj)
+	noLeaks(t,mb,tr,obj)
+}
+
+/* A failed Upsert frees the chain of the new value, but not the old one. */
+func TestUpsertFails(t *testing.T) {
+	tr := ivTree(newtree.NewMemBase(256))
+	obj,_ := tr.NewRoot()
+	if err := tr.Insert(obj,bigElem(1,2000)); err!=nil { t.Fatal(err) }
+	chain := verify(t,tr,obj).Overflow
+	
+	mb := newtree.NewMemBase(256)
+	fail := -1
+	tr = ivTree(failBase{mb,&fail})
+	obj,_ = tr.NewRoot()
+	insertRange(t,tr,obj,0,50)
+	if err := tr.Insert(obj,bigElem(100,1000)); err!=nil { t.Fatal(err) }
+	pages := mb.Stats().Pages
+	
+	/* The write of the leaf follows the chain. */
+	fail = chain+1
+	q := ntops.IntervalStab[int64]{At:100}
+	if _,err := tr.Upsert(obj,q,bigElem(100,2000),isKey(t,100)); !errors.Is(err,errCrash) { t.Fatal(err) }
+	fail = -1
+	if err := tr.Reclaim(); err!=nil { t.Fatal(err) }
+	if n := mb.Stats().Pages; n!=pages { t.Fatalf("%d pages, want %d",n,pages) }
+	if vs := values(t,tr,obj,100); len(vs)!=1 || len(vs[0])!=1000 { t.Fatalf("%d values",len(vs)) }
+	verify(t,tr,obj)
+	noLeaks(t,mb,tr,obj)
+}
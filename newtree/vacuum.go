@@ -0,0 +1,283 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+package newtree
+
+import "context"
+import "errors"
+import "sort"
+
+var ENoVacuum = errors.New("ENoVacuum")
+
+/*
+An IBase, whose storage can be compacted, see Tree.Vacuum().
+*/
+type VacuumBase interface{
+	IBase
+	// Orders the free pages, so that PageAlloc() returns the lowest one first.
+	SortFree() error
+	// Allocates the lowest free page, if it is below id, otherwise returns 0.
+	PageAllocBelow(id int64) (int64,error)
+	// Releases the free pages at the end of the storage. Returns the number
+	// of bytes released.
+	Shrink() (int64,error)
+}
+
+type vacuum struct{
+	t    *Tree
+	ver  uint16 // The format version of the current tree.
+	live []int64
+	move map[int64]int64
+	old  []int64
+}
+
+/* Collects all pages of the subtree at page id, including overflow pages. */
+func (v *vacuum) collect(ctx context.Context, id int64) error {
+	err := ctx.Err()
+	if err!=nil { return err }
+	b,node,_,err := v.t.rawNode(id,v.ver)
+	defer freeElements(node)
+	defer b.Free()
+	if err!=nil { return err }
+	v.live = append(v.live,id)
+	for _,e := range node {
+		if e.Ptr!=0 {
+			err = v.collect(ctx,e.Ptr)
+		} else if e.Ovf!=0 {
+			_,err = v.t.readOverflow(e.Ovf,func(p int64) { v.live = append(v.live,p) })
+		}
+		if err!=nil { return err }
+	}
+	return nil
+}
+
+/*
+Rewrites the subtree at page id, moving its pages as planned in v.move.
+Returns the new id of the page, or, if it had to be split, the elements of the
+pages, it was split into. The old pages are freed by the caller, once the new
+ones are reachable from the Root.
+
+A legacy page may not fit into the current format, it is split like a write
+would do it, which requires .Ops. Once ctx is done, no further pages are
+moved, but the pages moved so far are still linked in.
+*/
+func (v *vacuum) node(ctx context.Context, id int64) (int64,Elements,error) {
+	if ctx.Err()!=nil { return id,nil,nil }
+	b,node,legacy,err := v.t.rawNode(id,v.ver)
+	defer freeElements(node)
+	defer b.Free()
+	if err!=nil { return 0,nil,err }
+	changed := false
+	var extra Elements
+	for i := range node {
+		var n int64
+		var split Elements
+		e := &node[i]
+		switch {
+		case e.Ptr!=0:
+			n,split,err = v.node(ctx,e.Ptr)
+			if split!=nil {
+				*e = split[0]
+				extra = append(extra,split[1:]...)
+				changed = true
+			} else if n!=e.Ptr { e.Ptr = n; changed = true }
+		case e.Ovf!=0:
+			n,err = v.chain(ctx,e.Ovf)
+			if n!=e.Ovf { e.Ovf = n; changed = true }
+		}
+		if err!=nil { return 0,nil,err }
+	}
+	if len(extra)>0 || (legacy && node.Length()>v.t.pageCap()) {
+		if v.t.Ops==nil { return 0,nil,EVersion }
+		node = append(node,extra...)
+		err = v.t.resolve(id,node)
+		if err!=nil { return 0,nil,err }
+		v.t.Ops.Sort(node)
+		split,err := v.t.storeNode(id,node)
+		if err!=nil { return 0,nil,err }
+		if len(split)==1 { return split[0].Ptr,nil,nil }
+		return 0,split,nil
+	}
+	nid,ok := v.move[id]
+	if !ok {
+		if !changed { return id,nil,nil }
+		if !v.t.CopyOnWrite { return id,nil,v.t.putPage(id,node,nil) }
+		nid,err = v.t.insertPage(node)
+		if err!=nil { return 0,nil,err }
+		v.old = append(v.old,id)
+		return nid,nil,nil
+	}
+	err = v.t.putPage(nid,node,nil)
+	if err!=nil { return 0,nil,err }
+	delete(v.move,id)
+	v.old = append(v.old,id)
+	return nid,nil,nil
+}
+
+/*
+Rewrites the overflow chain at page id. As overflow pages are never modified,
+every page in front of a moved page is copied as well.
+*/
+func (v *vacuum) chain(ctx context.Context, id int64) (int64,error) {
+	if ctx.Err()!=nil { return id,nil }
+	var pages [][]byte
+	var ids []int64
+	for p := id; p!=0; {
+		b,err := v.t.PageRead(p)
+		if err!=nil { return 0,err }
+		next,_,err := ovfOpen(p,b.Bytes())
+		if err==nil {
+			pages = append(pages,append([]byte(nil),b.Bytes()...))
+			ids = append(ids,p)
+		}
+		b.Free()
+		if err!=nil { return 0,err }
+		p = next
+	}
+	next := int64(0)
+	changed := false
+	for i := len(ids)-1; i>=0; i-- {
+		nid,ok := v.move[ids[i]]
+		if !ok && !changed { next = ids[i]; continue }
+		if !ok {
+			var err error
+			nid,err = v.t.PageAlloc()
+			if err!=nil { return 0,err }
+		}
+		p := pages[i]
+		frm.PutUint64(p[pageHeader:],uint64(next))
+		pageSeal(p,pageOverflow)
+		err := v.t.PageWrite(nid,p)
+		if err!=nil { return 0,err }
+		delete(v.move,ids[i])
+		v.old = append(v.old,ids[i])
+		next = nid
+		changed = true
+	}
+	return next,nil
+}
+
+/*
+Moves the pages of the trees objs into the lowest free pages, then releases
+the free pages at the end of the storage. Returns the number of bytes
+released. The IBase must be a VacuumBase, otherwise ENoVacuum is returned.
+
+The pages are moved highest first, as long as there is a free page below
+them. Moved pages are written to their new place, before their parent (or the
+Root) is updated, so readers can run concurrently. In CopyOnWrite-mode, the
+ancestors of a moved page are copied as well.
+
+Only the trees objs are compacted, and they must not be written by another
+Tree concurrently. Pages of other trees, pages holding heads, and pages, that
+are still pinned by readers or Snapshots (see .Reclaim()), stay in place, and
+may prevent the storage from shrinking. A subsequent call may release more.
+
+The context is checked while the trees are scanned and rewritten. If it is
+done, no further pages are moved and its error is returned, the trees remain
+consistent.
+
+Legacy pages (see .Migrate()), that do not fit into the current format, are
+split, which requires .Ops. Otherwise EVersion is returned.
+*/
+func (t *Tree) Vacuum(ctx context.Context, objs ...int64) (int64,error) {
+	vb,ok := t.IBase.(VacuumBase)
+	if !ok { return 0,ENoVacuum }
+	err := t.relocate(ctx,vb,objs)
+	if err!=nil { return 0,err }
+	return vb.Shrink()
+}
+
+/*
+Compacts base offline, see Tree.Vacuum(). base must not be used by any Tree
+during the call. objs are the heads of the trees to be compacted, regardless
+of their TreeOps. For a Catalog, these are the head returned by CatalogHead()
+and the Root of every CatalogEntry. Trees with legacy pages may need to be
+migrated first (see Tree.Migrate()).
+*/
+func Vacuum(ctx context.Context, base IBase, objs ...int64) (int64,error) {
+	t := &Tree{IBase:base}
+	return t.Vacuum(ctx,objs...)
+}
+
+func (t *Tree) relocate(ctx context.Context, vb VacuumBase, objs []int64) (err error) {
+	if err = t.beginWrite(); err!=nil { return }
+	defer t.endWrite(&err)
+	
+	v := &vacuum{t:t,move:make(map[int64]int64)}
+	defer func() {
+		/* Free the planned pages, that were not used. */
+		if _,ok := t.IBase.(AtomicBase); ok && err!=nil { return }
+		for _,nid := range v.move {
+			e := t.PageFree(nid)
+			if err==nil { err = e }
+		}
+	}()
+	
+	roots := make([]Root,len(objs))
+	for i,obj := range objs {
+		roots[i],err = t.getRoot(obj)
+		if err!=nil { return }
+		if roots[i].Ptr==0 { continue }
+		v.ver = roots[i].Version
+		err = v.collect(ctx,roots[i].Ptr)
+		if err!=nil { return }
+	}
+	
+	err = vb.SortFree()
+	if err!=nil { return }
+	sort.Slice(v.live,func(i,j int) bool { return v.live[i]>v.live[j] })
+	for _,id := range v.live {
+		var nid int64
+		nid,err = vb.PageAllocBelow(id)
+		if err!=nil { return }
+		if nid==0 { break }
+		v.move[id] = nid
+	}
+	
+	for i,obj := range objs {
+		if len(v.move)==0 { break }
+		if err = ctx.Err(); err!=nil { return }
+		rr := roots[i]
+		if rr.Ptr==0 { continue }
+		v.ver = rr.Version
+		var split Elements
+		rr.Ptr,split,err = v.node(ctx,rr.Ptr)
+		if err!=nil { return }
+		if split!=nil {
+			rr.Ptr,err = t.insertPage(split)
+			if err!=nil { return }
+			rr.Depth++
+		}
+		if rr.Ptr!=roots[i].Ptr {
+			err = t.putRoot(obj,rr)
+			if err!=nil { return }
+		}
+		for _,id := range v.old {
+			err = t.freePage(id)
+			if err!=nil { return }
+		}
+		v.old = v.old[:0]
+	}
+	return ctx.Err()
+}
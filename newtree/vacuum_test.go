@@ -0,0 +1,129 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+
+
+package newtree_test
+
+import "github.com/maxymania/gonbase/newtree"
+import "github.com/maxymania/gonbase/ntops"
+import "context"
+import "testing"
+
+/* A context, that is canceled after n calls of .Err(). */
+type countCtx struct{
+	context.Context
+	n int
+}
+func (c *countCtx) Err() error {
+	if c.n<=0 { return context.Canceled }
+	c.n--
+	return nil
+}
+
+/* Writes the legacy page P (without a header) to a new page. */
+func legacyPage(t testing.TB, mb *newtree.MemBase, P newtree.Elements) int64 {
+	p := make([]byte,mb.Page())
+	if _,err := P.BinEncode(p); err!=nil { t.Fatal(err) }
+	id,err := mb.PageAlloc()
+	if err!=nil { t.Fatal(err) }
+	if err = mb.PageWrite(id,p); err!=nil { t.Fatal(err) }
+	return id
+}
+
+/*
+Builds a legacy tree of 5 leaves with 7 keys each, which fill their pages
+completely, so that they do not fit into the current format. It is built
+above 20 free pages, so that .Vacuum() moves all its pages.
+*/
+func legacyTree(t testing.TB) (*newtree.MemBase,*newtree.Tree,int64) {
+	mb := newtree.NewMemBase(256)
+	tr := ivTree(mb)
+	obj,err := tr.NewRoot()
+	if err!=nil { t.Fatal(err) }
+	var gap []int64
+	for i := 0; i<20; i++ {
+		id,_ := mb.PageAlloc()
+		gap = append(gap,id)
+	}
+	var root newtree.Elements
+	for l := int64(0); l<5; l++ {
+		var leaf newtree.Elements
+		for k := l*7; k<l*7+7; k++ {
+			leaf = append(leaf,newtree.Element{Val:ntops.EncodeInterval(k,k,[]byte("legacy!"))})
+		}
+		if leaf.Length()!=mb.Page() { t.Fatalf("leaf of %d bytes",leaf.Length()) }
+		root = append(root,newtree.Element{Ptr:legacyPage(t,mb,leaf),Val:tr.Ops.Union(leaf)})
+	}
+	rr := newtree.Root{Ptr:legacyPage(t,mb,root),Depth:2}
+	h := make([]byte,newtree.HeadSize)
+	if err = rr.BinEncode(h); err!=nil { t.Fatal(err) }
+	if err = mb.HeadWrite(obj,h); err!=nil { t.Fatal(err) }
+	for _,id := range gap { mb.PageFree(id) }
+	return mb,tr,obj
+}
+
+func checkLegacyTree(t testing.TB, mb *newtree.MemBase, tr *newtree.Tree, obj int64) {
+	got := keys(t,tr,obj,all)
+	if len(got)!=35 { t.Fatalf("%d keys",len(got)) }
+	for i,k := range got {
+		if k!=int64(i) { t.Fatalf("key %d at %d",k,i) }
+	}
+	verify(t,tr,obj)
+	leaks,err := mb.Leaks(context.Background(),tr,obj)
+	if err!=nil { t.Fatal(err) }
+	if len(leaks)>0 { t.Fatalf("%d leaked pages",len(leaks)) }
+}
+
+/* The legacy pages are moved into the current format, which splits them. */
+func TestVacuumLegacy(t *testing.T) {
+	for _,cow := range []bool{false,true} {
+		mb,tr,obj := legacyTree(t)
+		tr.CopyOnWrite = cow
+		checkLegacyTree(t,mb,tr,obj)
+		if st := verify(t,tr,obj); st.Legacy!=6 { t.Fatalf("%d legacy pages",st.Legacy) }
+		
+		old := rootOf(t,mb,obj)
+		if _,err := tr.Vacuum(context.Background(),obj); err!=nil { t.Fatal(err) }
+		checkLegacyTree(t,mb,tr,obj)
+		if st := verify(t,tr,obj); st.Legacy!=0 || st.Levels[len(st.Levels)-1].Pages!=10 { t.Fatalf("cow=%v: %v",cow,st) }
+		if rr := rootOf(t,mb,obj); rr.Ptr>=old.Ptr { t.Fatalf("cow=%v: root not moved from %d",cow,old.Ptr) }
+	}
+	/* Without the TreeOps, the pages can't be split. */
+	mb,tr,obj := legacyTree(t)
+	if _,err := newtree.Vacuum(context.Background(),mb,obj); err!=newtree.EVersion { t.Fatal(err) }
+	checkLegacyTree(t,mb,tr,obj)
+}
+
+/* The tree remains intact, wherever Vacuum is canceled. */
+func TestVacuumCancel(t *testing.T) {
+	for n := 0; ; n++ {
+		mb,tr,obj := legacyTree(t)
+		_,err := tr.Vacuum(&countCtx{context.Background(),n},obj)
+		if err!=nil && err!=context.Canceled { t.Fatal(n,err) }
+		checkLegacyTree(t,mb,tr,obj)
+		if err==nil { break }
+		if n>1000 { t.Fatal("Vacuum is never done") }
+	}
+}
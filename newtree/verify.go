@@ -0,0 +1,221 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+package newtree
+
+import "context"
+import "errors"
+import "bytes"
+import "fmt"
+
+/* Statistics of one level of a tree. */
+type LevelStats struct{
+	Pages    int
+	Elements int
+	Bytes    int64 // Used bytes, including the page headers.
+	MinBytes int64 // Used bytes of the least filled page.
+}
+
+// The average fill of the pages of the level, relative to pageSize.
+func (l LevelStats) Fill(pageSize int) float64 {
+	if l.Pages==0 { return 0 }
+	return float64(l.Bytes)/float64(int64(l.Pages)*int64(pageSize))
+}
+
+/* Statistics of a tree, as gathered by .Verify(). */
+type Stats struct{
+	PageSize    int
+	Depth       int
+	Levels      []LevelStats // Levels[0] is the level of the root page.
+	Pages       int
+	Legacy      int // Pages without a header. See .Migrate().
+	Overflow    int // Overflow pages, not included in Pages and Levels.
+	LeafEntries int
+	Bytes       int64
+}
+
+// The average fill of all pages, relative to the page size.
+func (s *Stats) Fill() float64 {
+	return LevelStats{Pages:s.Pages,Bytes:s.Bytes}.Fill(s.PageSize)
+}
+func (s *Stats) String() string {
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf,"depth %d, %d pages (%d legacy, %d overflow), %d leaf entries, %d bytes, fill %.1f%%\n",
+		s.Depth,s.Pages,s.Legacy,s.Overflow,s.LeafEntries,s.Bytes,s.Fill()*100)
+	for i,l := range s.Levels {
+		fmt.Fprintf(buf,"level %d: %d pages, %d elements, %d bytes, fill %.1f%%\n",
+			i,l.Pages,l.Elements,l.Bytes,l.Fill(s.PageSize)*100)
+	}
+	return buf.String()
+}
+
+type Problem struct{
+	Page   int64
+	Reason string
+}
+func (p Problem) String() string { return fmt.Sprintf("page %d: %s",p.Page,p.Reason) }
+
+/*
+Returned by .Verify(), if the tree is damaged. errors.Is(err,ECorrupt) is true.
+*/
+type VerifyError struct{
+	Problems []Problem
+}
+func (v *VerifyError) Error() string {
+	return fmt.Sprintf("newtree: %d problems found, first: %v",len(v.Problems),v.Problems[0])
+}
+func (v *VerifyError) Unwrap() error { return ECorrupt }
+
+type verifier struct{
+	t     *Tree
+	ver   uint16
+	ctx   context.Context
+	st    *Stats
+	seen  map[int64]bool
+	probs []Problem
+}
+func (v *verifier) problem(id int64, format string, args ...interface{}) {
+	v.probs = append(v.probs,Problem{id,fmt.Sprintf(format,args...)})
+}
+
+/* Counts the pages of an overflow chain. The chain was already read by .readNode(). */
+func (v *verifier) overflow(id int64) {
+	v.t.readOverflow(id,func(p int64){
+		if v.seen[p] { v.problem(p,"reachable twice") }
+		v.seen[p] = true
+		v.st.Overflow++
+	})
+}
+
+/* Verifies page id at level lv and returns its Union, or nil, if it is unusable. */
+func (v *verifier) page(id int64, lv int) ([]byte,error) {
+	if err := v.ctx.Err(); err!=nil { return nil,err }
+	if v.seen[id] {
+		v.problem(id,"reachable twice")
+		return nil,nil
+	}
+	v.seen[id] = true
+	
+	b,node,legacy,err := v.t.readNode(id,v.ver)
+	defer freeElements(node)
+	defer b.Free()
+	if err!=nil {
+		if errors.Is(err,ECorrupt) {
+			v.problem(id,"%v",err)
+			return nil,nil
+		}
+		return nil,err
+	}
+	
+	for len(v.st.Levels)<=lv { v.st.Levels = append(v.st.Levels,LevelStats{}) }
+	used := int64(node.Length())
+	if legacy {
+		v.st.Legacy++
+	} else {
+		used += pageHeader
+	}
+	v.st.Levels[lv].Pages++
+	v.st.Levels[lv].Elements += len(node)
+	v.st.Levels[lv].Bytes += used
+	if v.st.Levels[lv].Pages==1 || used<v.st.Levels[lv].MinBytes { v.st.Levels[lv].MinBytes = used }
+	v.st.Pages++
+	v.st.Bytes += used
+	
+	if len(node)==0 {
+		v.problem(id,"empty page")
+		return nil,nil
+	}
+	leaf := lv+1 >= v.st.Depth
+	for _,e := range node {
+		if leaf {
+			if e.Ptr!=0 {
+				v.problem(id,"pointer to page %d at leaf level %d",e.Ptr,lv)
+			} else {
+				v.st.LeafEntries++
+				if e.Ovf!=0 { v.overflow(e.Ovf) }
+			}
+			continue
+		}
+		if e.Ptr==0 {
+			v.problem(id,"leaf element at level %d, Root.Depth is %d",lv,v.st.Depth)
+			continue
+		}
+		cu,err := v.page(e.Ptr,lv+1)
+		if err!=nil { return nil,err }
+		if cu==nil { continue }
+		
+		if !v.t.covers(e.Val,cu) {
+			v.problem(id,"element does not cover page %d",e.Ptr)
+		}
+	}
+	return append([]byte(nil),v.t.Ops.Union(node)...),nil
+}
+
+/*
+Reports, whether the key p covers c. Without CoverOps, p covers c, if it is
+equal to c, or if merging c into p does not change it.
+*/
+func (t *Tree) covers(p, c []byte) bool {
+	if co,ok := t.Ops.(CoverOps); ok { return co.Covers(p,c) }
+	if bytes.Equal(p,c) { return true }
+	a := t.Ops.Union(Elements{{Val:p}})
+	return bytes.Equal(a,t.Ops.Union(Elements{{Val:p},{Val:c}}))
+}
+
+/*
+Checks the consistency of the tree obj and gathers statistics about it.
+
+Verify checks, that all pages can be read and pass their checksums, that the
+Val of every inner Element covers the Union of its child page (see CoverOps),
+that all leaves are at Root.Depth and that no page is reachable twice. Every
+problem found is reported in a *VerifyError. Other errors (I/O, ctx) abort
+the check.
+
+Writers are blocked, while Verify runs.
+*/
+func (t *Tree) Verify(ctx context.Context, obj int64) (*Stats,error) {
+	t.cc.writer.Lock()
+	defer t.cc.writer.Unlock()
+	return t.verify(ctx,obj,make(map[int64]bool))
+}
+
+/* Must be called with t.cc.writer held. Adds all pages of the tree obj to seen. */
+func (t *Tree) verify(ctx context.Context, obj int64, seen map[int64]bool) (*Stats,error) {
+	rr,err := t.getRoot(obj)
+	if err!=nil { return nil,err }
+	v := &verifier{
+		t:    t,
+		ver:  rr.Version,
+		ctx:  ctx,
+		st:   &Stats{PageSize:t.Page(),Depth:int(rr.Depth)},
+		seen: seen,
+	}
+	if rr.Ptr!=0 {
+		if rr.Depth==0 { v.problem(obj,"Root.Depth is 0") }
+		_,err = v.page(rr.Ptr,0)
+		if err!=nil { return nil,err }
+	}
+	if len(v.probs)>0 { return v.st,&VerifyError{v.probs} }
+	return v.st,nil
+}
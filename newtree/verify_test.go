@@ -0,0 +1,65 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+package newtree_test
+
+import "github.com/maxymania/gonbase/newtree"
+import "github.com/maxymania/gonbase/ntops"
+import "context"
+import "testing"
+
+/* GroupOps sums up the Counts in .Union(), so they need CoverOps. */
+func TestVerifyGroupOps(t *testing.T) {
+	tr := &newtree.Tree{IBase:newtree.NewMemBase(256),Ops:ntops.GroupOps{}}
+	obj,_ := tr.NewRoot()
+	for i := uint64(0); i<500; i++ {
+		g := &ntops.GroupEntry{GroupID:i%3,Article:i,Expires:i*7%100,Value:[]byte("v")}
+		if err := tr.Insert(obj,g.Marshal()); err!=nil { t.Fatal(err) }
+	}
+	st := verify(t,tr,obj)
+	if st.LeafEntries!=500 || st.Depth<2 { t.Fatal(st) }
+	
+	/* Deletes may leave keys, that are wider than their pages. */
+	_,err := tr.Delete(context.Background(),obj,&ntops.GroupQuery{GroupID:1,ArticleLow:0,ArticleHigh:250},func(b []byte) bool { return true })
+	if err!=nil { t.Fatal(err) }
+	if st = verify(t,tr,obj); st.LeafEntries>=500 { t.Fatal(st) }
+}
+
+func TestGroupOpsCovers(t *testing.T) {
+	ops := ntops.GroupOps{}
+	a := (&ntops.GroupEntry{GroupID:1,Article:10,Expires:5}).Marshal()
+	b := (&ntops.GroupEntry{GroupID:1,Article:20,Expires:9}).Marshal()
+	c := (&ntops.GroupEntry{GroupID:2,Article:15,Expires:7}).Marshal()
+	u := ops.Union(newtree.Elements{{Val:a},{Val:b}})
+	for _,x := range []struct{ p,c []byte; want bool }{
+		{u,a,true},{u,b,true},{u,u,true},{u,c,false},{a,u,false},
+		{ops.Union(newtree.Elements{{Val:u},{Val:c}}),u,true},
+	} {
+		if ops.Covers(x.p,x.c)!=x.want { t.Errorf("Covers = %v, want %v",!x.want,x.want) }
+	}
+	/* The Union is not idempotent, so it cannot tell. */
+	if string(ops.Union(newtree.Elements{{Val:u}}))==string(ops.Union(newtree.Elements{{Val:u},{Val:a}})) {
+		t.Error("Union of u and a equals u")
+	}
+}
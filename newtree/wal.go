@@ -0,0 +1,529 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+package newtree
+
+import "github.com/byte-mug/golibs/bufferex"
+import "encoding/binary"
+import "hash/crc32"
+import "runtime"
+import "bytes"
+import "sync"
+import "io"
+
+/*
+The log-file of a WALBase. *os.File and file.File satisfy this interface.
+*/
+type LogFile interface{
+	io.ReaderAt
+	io.WriterAt
+	Truncate(size int64) error
+	Sync() error
+}
+
+const walMagic = 0x4c41574e // "NWAL"
+
+const (
+	walPage byte = iota+1
+	walHead
+	walPageFree
+	walHeadFree
+	walPageAlloc
+	walHeadAlloc
+)
+
+/*
+Record header: magic, payload-length, sequence number, CRC of the former.
+The payload is followed by its CRC.
+*/
+const walHeader = 20
+
+type walEntry struct{
+	kind byte
+	id   int64
+	data []byte
+}
+
+/* Pages and heads may share ids, so entries are keyed by both. */
+type walKey struct{
+	kind byte
+	id   int64
+}
+
+/* Returns the key of the page or head, that e refers to. */
+func (e walEntry) key() walKey {
+	switch e.kind {
+	case walPageFree,walPageAlloc: return walKey{walPage,e.id}
+	case walHeadFree,walHeadAlloc: return walKey{walHead,e.id}
+	}
+	return walKey{e.kind,e.id}
+}
+
+/* Returns the id of the calling goroutine. */
+func goid() (id uint64) {
+	var buf [32]byte
+	s := bytes.TrimPrefix(buf[:runtime.Stack(buf[:],false)],[]byte("goroutine "))
+	for _,c := range s {
+		if c<'0' || c>'9' { break }
+		id = id*10+uint64(c-'0')
+	}
+	return
+}
+
+/*
+A write-ahead log under an IBase. It makes the writing operations of a Tree
+atomic and crash-safe.
+
+During an operation, page- and head-writes are kept in memory, and frees are
+deferred. On commit, the page- and head-images and the frees of the operation
+are appended to the log as one record, the log is synced, and then the writes
+and the frees are applied to the underlying IBase. OpenWAL() replays all
+complete records and checkpoints the log.
+
+Frees are logged, but not replayed: a crash may leak pages, but it never frees
+a page twice, and a replay never writes an image into a freed page. Allocations
+are performed directly on the underlying IBase, and each one is logged in a
+record of its own, before it is returned. OpenWAL() releases the pages and heads
+allocated by an operation, that has not been committed or rolled back. Only a
+crash between an allocation and its record leaks the allocated page. The
+consistency of the allocator itself is not covered by the log.
+
+An operation belongs to the goroutine, that began it. Writes and frees of other
+goroutines wait for it to end and are performed in operations of their own.
+
+The underlying IBase should implement Sync() error (like WriteAlloc does),
+otherwise its writes are assumed to be durable once they returned.
+*/
+type WALBase struct{
+	IBase
+	
+	// If greater than 0, the log is checkpointed automatically, once it grows
+	// beyond this size.
+	MaxLog int64
+	
+	log    LogFile
+	op     sync.Mutex
+	mu     sync.Mutex
+	active bool
+	owner  uint64
+	failed error
+	
+	pending map[walKey]*walEntry
+	ids     []walKey
+	frees   []walEntry
+	allocs  []walEntry
+	logged  bool
+	
+	end int64
+	seq uint64
+}
+
+/*
+Opens a WALBase on top of base, replays the log and checkpoints it.
+*/
+func OpenWAL(base IBase, log LogFile) (*WALBase,error) {
+	w := &WALBase{IBase:base,log:log}
+	err := w.replay()
+	if err!=nil { return nil,err }
+	err = w.checkpoint()
+	if err!=nil { return nil,err }
+	return w,nil
+}
+
+func (w *WALBase) replay() error {
+	var hdr [walHeader]byte
+	var off int64
+	var seq uint64
+	last := make(map[walKey]walEntry)
+	/* The allocations of the operation, that has not ended yet. */
+	var open []walEntry
+	for {
+		if k,_ := w.log.ReadAt(hdr[:],off); k<walHeader { break }
+		if binary.LittleEndian.Uint32(hdr[0:])!=walMagic { break }
+		if binary.LittleEndian.Uint32(hdr[16:])!=crc32.Checksum(hdr[:16],crcTable) { break }
+		n := int64(binary.LittleEndian.Uint32(hdr[4:]))
+		s := binary.LittleEndian.Uint64(hdr[8:])
+		if off>0 && s!=seq+1 { break }
+		buf := make([]byte,n+4)
+		if k,_ := w.log.ReadAt(buf,off+walHeader); int64(k)<n+4 { break }
+		if binary.LittleEndian.Uint32(buf[n:])!=crc32.Checksum(buf[:n],crcTable) { break }
+		ents,ok := walDecode(buf[:n])
+		if !ok { break }
+		for _,e := range ents {
+			if e.kind==walPageAlloc || e.kind==walHeadAlloc {
+				open = append(open,e)
+			} else {
+				last[e.key()] = e
+			}
+		}
+		/* A record without allocations ends the operation. */
+		if len(ents)==0 || (ents[0].kind!=walPageAlloc && ents[0].kind!=walHeadAlloc) { open = nil }
+		off += walHeader+n+4
+		seq = s
+	}
+	w.seq = seq
+	for _,e := range last {
+		var err error
+		switch e.kind {
+		case walPage: err = w.IBase.PageWrite(e.id,e.data)
+		case walHead: err = w.IBase.HeadWrite(e.id,e.data)
+		}
+		if err!=nil { return err }
+	}
+	if len(open)==0 { return nil }
+	
+	/* Ends the operation first, so that the allocations are never released twice. */
+	w.end = off
+	err := w.append(w.seal(make([]byte,walHeader)))
+	if err!=nil { return err }
+	for _,e := range open {
+		var err error
+		if e.kind==walPageAlloc {
+			err = w.IBase.PageFree(e.id)
+		} else {
+			err = w.IBase.HeadFree(e.id)
+		}
+		if err!=nil { return err }
+	}
+	return nil
+}
+
+func walDecode(p []byte) (ents []walEntry, ok bool) {
+	for len(p)>0 {
+		if len(p)<9 { return }
+		e := walEntry{kind:p[0],id:int64(binary.LittleEndian.Uint64(p[1:]))}
+		p = p[9:]
+		switch e.kind {
+		case walPage,walHead:
+			if len(p)<4 { return }
+			n := int(binary.LittleEndian.Uint32(p))
+			p = p[4:]
+			if len(p)<n { return }
+			e.data = p[:n]
+			p = p[n:]
+		case walPageFree,walHeadFree,walPageAlloc,walHeadAlloc:
+		default: return
+		}
+		ents = append(ents,e)
+	}
+	return ents,true
+}
+
+func (w *WALBase) encode() []byte {
+	rec := make([]byte,walHeader,4096)
+	var num [13]byte
+	for _,k := range w.ids {
+		e := w.pending[k]
+		if e==nil { continue }
+		num[0] = e.kind
+		binary.LittleEndian.PutUint64(num[1:],uint64(e.id))
+		binary.LittleEndian.PutUint32(num[9:],uint32(len(e.data)))
+		rec = append(append(rec,num[:]...),e.data...)
+	}
+	for _,e := range w.frees {
+		num[0] = e.kind
+		binary.LittleEndian.PutUint64(num[1:],uint64(e.id))
+		rec = append(rec,num[:9]...)
+	}
+	return w.seal(rec)
+}
+
+/* Fills in the header of the record rec and appends the CRC of its payload. */
+func (w *WALBase) seal(rec []byte) []byte {
+	var num [4]byte
+	n := len(rec)-walHeader
+	binary.LittleEndian.PutUint32(rec[0:],walMagic)
+	binary.LittleEndian.PutUint32(rec[4:],uint32(n))
+	binary.LittleEndian.PutUint64(rec[8:],w.seq+1)
+	binary.LittleEndian.PutUint32(rec[16:],crc32.Checksum(rec[:16],crcTable))
+	binary.LittleEndian.PutUint32(num[:],crc32.Checksum(rec[walHeader:],crcTable))
+	return append(rec,num[:]...)
+}
+
+/* Appends the record rec to the log. */
+func (w *WALBase) append(rec []byte) error {
+	_,err := w.log.WriteAt(rec,w.end)
+	if err!=nil { return err }
+	err = w.log.Sync()
+	if err!=nil { return err }
+	w.end += int64(len(rec))
+	w.seq++
+	return nil
+}
+
+func (w *WALBase) syncBase() error {
+	if s,ok := w.IBase.(interface{ Sync() error }); ok { return s.Sync() }
+	return nil
+}
+
+func (w *WALBase) checkpoint() error {
+	err := w.syncBase()
+	if err!=nil { return err }
+	err = w.log.Truncate(0)
+	if err!=nil { return err }
+	w.end = 0
+	return w.log.Sync()
+}
+
+/*
+Makes all committed operations durable in the underlying IBase and truncates
+the log.
+*/
+func (w *WALBase) Checkpoint() error {
+	w.op.Lock(); defer w.op.Unlock()
+	if w.failed!=nil { return w.failed }
+	return w.checkpoint()
+}
+
+func (w *WALBase) OpBegin() error {
+	w.op.Lock()
+	w.mu.Lock(); defer w.mu.Unlock()
+	if w.failed!=nil {
+		w.op.Unlock()
+		return w.failed
+	}
+	w.active = true
+	w.owner = goid()
+	return nil
+}
+
+/*
+Ends the current operation. If committing fails, the WALBase refuses all
+further operations and must be reopened with OpenWAL(). The same holds, if
+an allocation or the end of a rolled back operation could not be logged.
+*/
+func (w *WALBase) OpEnd(commit bool) (err error) {
+	defer w.op.Unlock()
+	failed := w.failed
+	if failed!=nil {
+		/* The logged allocations are released by OpenWAL(). */
+		err = failed
+	} else if commit {
+		err = w.commit()
+		failed = err
+	} else {
+		if w.logged {
+			/* Ends the operation in the log first, so that a replay does not free the allocations again. */
+			w.mu.Lock()
+			w.pending = nil
+			w.ids = nil
+			w.frees = nil
+			w.mu.Unlock()
+			err = w.commit()
+			failed = err
+		}
+		if err==nil { err = w.release() }
+	}
+	w.mu.Lock()
+	w.failed = failed
+	w.active = false
+	w.pending = nil
+	w.ids = nil
+	w.frees = nil
+	w.allocs = nil
+	w.logged = false
+	w.mu.Unlock()
+	if err==nil && w.MaxLog>0 && w.end>=w.MaxLog { err = w.checkpoint() }
+	return
+}
+
+/* Frees the allocations of the current operation. */
+func (w *WALBase) release() (err error) {
+	for _,e := range w.allocs {
+		var e2 error
+		if e.kind==walPageAlloc {
+			e2 = w.IBase.PageFree(e.id)
+		} else {
+			e2 = w.IBase.HeadFree(e.id)
+		}
+		if err==nil { err = e2 }
+	}
+	return
+}
+
+func (w *WALBase) commit() error {
+	if len(w.ids)==0 && len(w.frees)==0 && !w.logged { return nil }
+	err := w.append(w.encode())
+	if err!=nil { return err }
+	
+	/* Concurrent readers are served from w.pending, until it is cleared. */
+	for _,k := range w.ids {
+		e := w.pending[k]
+		if e==nil { continue }
+		if e.kind==walPage {
+			err = w.IBase.PageWrite(e.id,e.data)
+		} else {
+			err = w.IBase.HeadWrite(e.id,e.data)
+		}
+		if err!=nil { return err }
+	}
+	for _,e := range w.frees {
+		if e.kind==walPageFree {
+			err = w.IBase.PageFree(e.id)
+		} else {
+			err = w.IBase.HeadFree(e.id)
+		}
+		if err!=nil { return err }
+	}
+	return nil
+}
+
+/* Reports, whether the calling goroutine is inside an operation. */
+func (w *WALBase) inside() bool {
+	w.mu.Lock(); defer w.mu.Unlock()
+	return w.active && w.owner==goid()
+}
+
+/*
+Performs f inside the current operation of the calling goroutine, or, if there
+is none, inside an operation of its own.
+*/
+func (w *WALBase) within(f func() error) error {
+	if w.inside() { return f() }
+	err := w.OpBegin()
+	if err!=nil { return err }
+	err = f()
+	e2 := w.OpEnd(err==nil)
+	if err==nil { err = e2 }
+	return err
+}
+
+func (w *WALBase) write(kind byte, id int64, b []byte) error {
+	return w.within(func() error {
+		w.mu.Lock(); defer w.mu.Unlock()
+		if w.pending==nil { w.pending = make(map[walKey]*walEntry) }
+		k := walKey{kind,id}
+		e := w.pending[k]
+		if e==nil {
+			e = &walEntry{kind:kind,id:id}
+			w.pending[k] = e
+			w.ids = append(w.ids,k)
+		}
+		e.data = append(e.data[:0],b...)
+		return nil
+	})
+}
+func (w *WALBase) free(kind byte, id int64) error {
+	return w.within(func() error {
+		w.mu.Lock(); defer w.mu.Unlock()
+		e := walEntry{kind:kind,id:id}
+		delete(w.pending,e.key())
+		w.frees = append(w.frees,e)
+		return nil
+	})
+}
+func (w *WALBase) image(kind byte, id int64) (b bufferex.Binary, ok bool) {
+	w.mu.Lock(); defer w.mu.Unlock()
+	e := w.pending[walKey{kind,id}]
+	if e==nil { return }
+	b = bufferex.AllocBinary(len(e.data))
+	copy(b.Bytes(),e.data)
+	return b,true
+}
+
+/*
+Records the allocation of id by the current operation, if the calling goroutine
+is inside one. The allocation is made durable, before it is logged, so that a
+replay never frees a page, that is not allocated.
+*/
+func (w *WALBase) allocated(kind byte, id int64) error {
+	if !w.inside() { return nil }
+	e := walEntry{kind:kind,id:id}
+	err := w.syncBase()
+	if err==nil {
+		var num [9]byte
+		num[0] = kind
+		binary.LittleEndian.PutUint64(num[1:],uint64(id))
+		err = w.append(w.seal(append(make([]byte,walHeader,walHeader+9),num[:]...)))
+	}
+	w.mu.Lock(); defer w.mu.Unlock()
+	if err!=nil {
+		/* The log is in an unknown state, the allocation is leaked. */
+		w.failed = err
+		return err
+	}
+	w.allocs = append(w.allocs,e)
+	w.logged = true
+	return nil
+}
+
+func (w *WALBase) PageAlloc() (int64,error) {
+	if w.inside() && w.failed!=nil { return 0,w.failed }
+	id,err := w.IBase.PageAlloc()
+	if err!=nil { return 0,err }
+	return id,w.allocated(walPageAlloc,id)
+}
+func (w *WALBase) PageRead(id int64) (bufferex.Binary,error) {
+	if b,ok := w.image(walPage,id); ok { return b,nil }
+	return w.IBase.PageRead(id)
+}
+func (w *WALBase) PageWrite(id int64,b []byte) error { return w.write(walPage,id,b) }
+func (w *WALBase) PageFree(id int64) error { return w.free(walPageFree,id) }
+func (w *WALBase) HeadAlloc() (int64,error) {
+	if w.inside() && w.failed!=nil { return 0,w.failed }
+	id,err := w.IBase.HeadAlloc()
+	if err!=nil { return 0,err }
+	return id,w.allocated(walHeadAlloc,id)
+}
+func (w *WALBase) HeadRead(id int64) (bufferex.Binary,error) {
+	if b,ok := w.image(walHead,id); ok { return b,nil }
+	return w.IBase.HeadRead(id)
+}
+func (w *WALBase) HeadWrite(id int64,b []byte) error { return w.write(walHead,id,b) }
+func (w *WALBase) HeadFree(id int64) error { return w.free(walHeadFree,id) }
+
+var _ AtomicBase = (*WALBase)(nil)
+
+/* Returns the head reserved by the underlying IBase, see CatalogBase. */
+func (w *WALBase) CatalogHead() (int64,error) {
+	if cb,ok := w.IBase.(CatalogBase); ok { return cb.CatalogHead() }
+	return 0,ENoCatalog
+}
+
+/* Passed through to the underlying IBase, see VacuumBase. */
+func (w *WALBase) SortFree() error {
+	if vb,ok := w.IBase.(VacuumBase); ok { return vb.SortFree() }
+	return ENoVacuum
+}
+func (w *WALBase) PageAllocBelow(id int64) (int64,error) {
+	vb,ok := w.IBase.(VacuumBase)
+	if !ok { return 0,ENoVacuum }
+	id,err := vb.PageAllocBelow(id)
+	if err!=nil || id==0 { return id,err }
+	return id,w.allocated(walPageAlloc,id)
+}
+
+/*
+Checkpoints the log, so that no record refers to the released pages, and
+shrinks the underlying IBase.
+*/
+func (w *WALBase) Shrink() (int64,error) {
+	vb,ok := w.IBase.(VacuumBase)
+	if !ok { return 0,ENoVacuum }
+	w.op.Lock(); defer w.op.Unlock()
+	if w.failed!=nil { return 0,w.failed }
+	err := w.checkpoint()
+	if err!=nil { return 0,err }
+	return vb.Shrink()
+}
@@ -0,0 +1,300 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+package newtree_test
+
+import "github.com/maxymania/gonbase/newtree"
+import "github.com/maxymania/gonbase/ntops"
+import "github.com/byte-mug/golibs/bufferex"
+import "bytes"
+import "context"
+import "errors"
+import "io"
+import "reflect"
+import "sync"
+import "testing"
+import "time"
+
+var errCrash = errors.New("errCrash")
+
+/*
+Counts the writes to an IBase and a LogFile. Once .at writes happened, the
+next write fails (a log write is torn in half) and so does every write after
+it, as if the process had crashed.
+*/
+type crasher struct{
+	mu sync.Mutex
+	at int
+	n  int
+}
+
+/* Returns false, if the write must fail. */
+func (c *crasher) tick() bool {
+	if c==nil { return true }
+	c.mu.Lock(); defer c.mu.Unlock()
+	c.n++
+	return c.at<0 || c.n<=c.at
+}
+
+type crashBase struct{
+	*newtree.MemBase
+	c *crasher
+}
+
+func (b crashBase) PageWrite(id int64, p []byte) error {
+	if !b.c.tick() { return errCrash }
+	return b.MemBase.PageWrite(id,p)
+}
+func (b crashBase) PageFree(id int64) error {
+	if !b.c.tick() { return errCrash }
+	return b.MemBase.PageFree(id)
+}
+func (b crashBase) HeadWrite(id int64, p []byte) error {
+	if !b.c.tick() { return errCrash }
+	return b.MemBase.HeadWrite(id,p)
+}
+func (b crashBase) HeadFree(id int64) error {
+	if !b.c.tick() { return errCrash }
+	return b.MemBase.HeadFree(id)
+}
+
+/* An in-memory LogFile. */
+type memLog struct{
+	mu sync.Mutex
+	b  []byte
+	c  *crasher
+}
+
+func (l *memLog) ReadAt(p []byte, off int64) (int,error) {
+	l.mu.Lock(); defer l.mu.Unlock()
+	if off>=int64(len(l.b)) { return 0,io.EOF }
+	n := copy(p,l.b[off:])
+	if n<len(p) { return n,io.EOF }
+	return n,nil
+}
+func (l *memLog) WriteAt(p []byte, off int64) (int,error) {
+	torn := !l.c.tick()
+	if torn { p = p[:len(p)/2] }
+	l.mu.Lock(); defer l.mu.Unlock()
+	if end := off+int64(len(p)); end>int64(len(l.b)) {
+		l.b = append(l.b,make([]byte,end-int64(len(l.b)))...)
+	}
+	copy(l.b[off:],p)
+	if torn { return len(p),errCrash }
+	return len(p),nil
+}
+func (l *memLog) Truncate(size int64) error {
+	if !l.c.tick() { return errCrash }
+	l.mu.Lock(); defer l.mu.Unlock()
+	l.b = l.b[:size]
+	return nil
+}
+func (l *memLog) Sync() error { return nil }
+
+/*
+The workload of TestWALCrash: inserts, that split pages, and deletes, that
+free them. Returns the number of operations, that completed, and the tree.
+*/
+func walWorkload(w *newtree.WALBase, ops int) (done int, obj int64) {
+	ctx := context.Background()
+	tr := ivTree(w)
+	obj,err := tr.NewRoot()
+	/* The head of a failed NewRoot is released by OpenWAL. */
+	if err!=nil { return 0,0 }
+	for done = 0; done<ops; done++ {
+		k := int64(done)
+		if k%5==4 {
+			/* Deletes the last four keys but one. */
+			_,err = tr.Delete(ctx,obj,ntops.IntervalOverlap[int64]{Low:k-4,High:k},func(b []byte) bool {
+				v,_,_,_ := ntops.DecodeInterval[int64](b)
+				return v>=k-4 && v<k-1
+			})
+		} else {
+			err = tr.Insert(obj,ivElem(k))
+		}
+		if err!=nil { return }
+	}
+	return
+}
+
+/* The keys after the first n operations of walWorkload. */
+func walKeys(n int) (r []int64) {
+	for k := int64(0); k<int64(n); k++ {
+		if k%5==4 {
+			r = r[:len(r)-4]
+			r = append(r,k-1)
+		} else {
+			r = append(r,k)
+		}
+	}
+	return
+}
+
+/*
+Crashes the WALBase at every write to the underlying IBase or the log,
+reopens it and checks, that the tree is intact and contains the keys of
+either all completed operations or of one more.
+*/
+func TestWALCrash(t *testing.T) {
+	const ops = 200
+	
+	/* Counts the writes of a run without crash. */
+	c := &crasher{at:-1}
+	w,err := newtree.OpenWAL(crashBase{newtree.NewMemBase(256),c},&memLog{c:c})
+	if err!=nil { t.Fatal(err) }
+	w.MaxLog = 4096
+	if done,_ := walWorkload(w,ops); done!=ops { t.Fatal("workload failed without crash") }
+	writes := c.n
+	
+	for at := 0; at<writes; at++ {
+		mb := newtree.NewMemBase(256)
+		c := &crasher{at:at}
+		log := &memLog{c:c}
+		done,obj := 0,int64(0)
+		w,err := newtree.OpenWAL(crashBase{mb,c},log)
+		if err==nil {
+			w.MaxLog = 4096
+			done,obj = walWorkload(w,ops)
+			if done==ops { t.Fatalf("crash at %d: no write failed",at) }
+		}
+		
+		log.c = nil
+		w,err = newtree.OpenWAL(mb,log)
+		if err!=nil { t.Fatalf("crash at %d: %v",at,err) }
+		if obj==0 { continue } /* NewRoot did not complete. */
+		tr := ivTree(w)
+		if _,err = tr.Verify(context.Background(),obj); err!=nil { t.Fatalf("crash at %d: %v",at,err) }
+		got := keys(t,tr,obj,all)
+		if !reflect.DeepEqual(got,walKeys(done)) && !reflect.DeepEqual(got,walKeys(done+1)) {
+			t.Fatalf("crash at %d after %d operations: got %v",at,done,got)
+		}
+		
+		leaks,err := mb.Leaks(context.Background(),tr,obj)
+		if err!=nil { t.Fatal(err) }
+		/* Only an allocation, whose record was torn, may leak. */
+		if len(leaks)>1 { t.Fatalf("crash at %d: %d leaked pages",at,len(leaks)) }
+		
+		/* The reopened tree accepts writes. */
+		if err = tr.Insert(obj,ivElem(1000)); err!=nil { t.Fatalf("crash at %d: %v",at,err) }
+		verify(t,tr,obj)
+	}
+}
+
+/* The allocations of an operation, that is never ended, are released. */
+func TestWALAllocs(t *testing.T) {
+	mb := newtree.NewMemBase(256)
+	log := &memLog{}
+	w,err := newtree.OpenWAL(mb,log)
+	if err!=nil { t.Fatal(err) }
+	pages := mb.Stats().Pages
+	
+	/* A rolled back operation frees its allocations once. */
+	if err = w.OpBegin(); err!=nil { t.Fatal(err) }
+	if _,err = w.PageAlloc(); err!=nil { t.Fatal(err) }
+	if _,err = w.HeadAlloc(); err!=nil { t.Fatal(err) }
+	if err = w.OpEnd(false); err!=nil { t.Fatal(err) }
+	if w,err = newtree.OpenWAL(mb,log); err!=nil { t.Fatal(err) }
+	if n := mb.Stats().Pages; n!=pages { t.Fatalf("%d pages, want %d",n,pages) }
+	
+	/* A crash leaves the operation open. */
+	if err = w.OpBegin(); err!=nil { t.Fatal(err) }
+	for i := 0; i<3; i++ {
+		if _,err = w.PageAlloc(); err!=nil { t.Fatal(err) }
+	}
+	if _,err = w.HeadAlloc(); err!=nil { t.Fatal(err) }
+	
+	/* The replay crashes, before the log is checkpointed. */
+	log.c = &crasher{at:1}
+	if _,err = newtree.OpenWAL(mb,log); err!=errCrash { t.Fatal(err) }
+	log.c = nil
+	if _,err = newtree.OpenWAL(mb,log); err!=nil { t.Fatal(err) }
+	leaks,err := mb.Leaks(context.Background(),ivTree(mb))
+	if err!=nil { t.Fatal(err) }
+	if len(leaks)>0 { t.Fatalf("%d leaked pages",len(leaks)) }
+}
+
+/* Writes of other goroutines are not folded into an operation. */
+func TestWALOwner(t *testing.T) {
+	mb := newtree.NewMemBase(256)
+	w,err := newtree.OpenWAL(mb,&memLog{})
+	if err!=nil { t.Fatal(err) }
+	id,_ := mb.PageAlloc()
+	
+	if err = w.OpBegin(); err!=nil { t.Fatal(err) }
+	done := make(chan error)
+	go func() { done <- w.PageWrite(id,[]byte("other")) }()
+	select {
+	case err = <-done: t.Fatalf("write returned within a foreign operation: %v",err)
+	case <-time.After(50*time.Millisecond):
+	}
+	if err = w.OpEnd(false); err!=nil { t.Fatal(err) }
+	if err = <-done; err!=nil { t.Fatal(err) }
+	b,err := mb.PageRead(id)
+	if err!=nil { t.Fatal(err) }
+	defer b.Free()
+	if string(b.Bytes()[:5])!="other" { t.Fatal("the write was rolled back with the foreign operation") }
+}
+
+/* Heads from an id space of their own. */
+type sepBase struct{
+	*newtree.MemBase
+	heads *newtree.MemBase
+}
+
+func (b sepBase) HeadAlloc() (int64,error) { return b.heads.HeadAlloc() }
+func (b sepBase) HeadRead(id int64) (bufferex.Binary,error) { return b.heads.HeadRead(id) }
+func (b sepBase) HeadWrite(id int64, p []byte) error { return b.heads.HeadWrite(id,p) }
+func (b sepBase) HeadFree(id int64) error { return b.heads.HeadFree(id) }
+
+/* Pages and heads, that share ids, are logged apart. */
+func TestWALSharedIds(t *testing.T) {
+	base := sepBase{newtree.NewMemBase(256),newtree.NewMemBase(256)}
+	id,_ := base.PageAlloc()
+	if h,_ := base.HeadAlloc(); h!=id { t.Fatalf("head %d, page %d",h,id) }
+	log := &memLog{}
+	w,err := newtree.OpenWAL(base,log)
+	if err!=nil { t.Fatal(err) }
+	
+	check := func(b newtree.IBase, stage string) {
+		p,err := b.PageRead(id)
+		if err!=nil { t.Fatal(err) }
+		h,err := b.HeadRead(id)
+		if err!=nil { t.Fatal(err) }
+		if p.Bytes()[0]!='p' || h.Bytes()[0]!='h' { t.Fatalf("%s: page %q, head %q",stage,p.Bytes()[0],h.Bytes()[0]) }
+		p.Free()
+		h.Free()
+	}
+	if err = w.OpBegin(); err!=nil { t.Fatal(err) }
+	if err = w.PageWrite(id,bytes.Repeat([]byte("p"),256)); err!=nil { t.Fatal(err) }
+	if err = w.HeadWrite(id,bytes.Repeat([]byte("h"),newtree.HeadSize)); err!=nil { t.Fatal(err) }
+	check(w,"pending")
+	if err = w.OpEnd(true); err!=nil { t.Fatal(err) }
+	check(base,"commit")
+	
+	/* Forgets the writes, so that only the replay restores them. */
+	base.MemBase.PageWrite(id,make([]byte,256))
+	base.heads.HeadWrite(id,make([]byte,newtree.HeadSize))
+	if _,err = newtree.OpenWAL(base,log); err!=nil { t.Fatal(err) }
+	check(base,"replay")
+}
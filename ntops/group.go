@@ -73,7 +73,7 @@ type groupSumary struct{
 	Count       uint64
 }
 func (g *groupSumary) DecodeMsgpack(src *msgpack.Decoder) error {
-	var err1,err2,err3,err4,err5,err6 error
+	var err1,err2,err3,err4,err5,err6,err7 error
 	
 	g.GroupLow   ,err1 = src.DecodeUint64()
 	g.GroupHigh  ,err2 = src.DecodeUint64()
@@ -81,10 +81,12 @@ func (g *groupSumary) DecodeMsgpack(src *msgpack.Decoder) error {
 	g.ArticleHigh,err4 = src.DecodeUint64()
 	g.ExpiresLow ,err5 = src.DecodeUint64()
 	g.ExpiresHigh,err6 = src.DecodeUint64()
+	g.Count      ,err7 = src.DecodeUint64()
 	
 	if err1==nil { err1 = err2 }
 	if err3==nil { err3 = err4 }
 	if err5==nil { err5 = err6 }
+	if err5==nil { err5 = err7 }
 	
 	if err1==nil { err1 = err3 }
 	if err1==nil { return err5 }
@@ -213,9 +215,38 @@ func (g *groupGeneral) consistent(q interface{}) bool {
 	return true
 }
 
+func udistance(low,high,v uint64) float64 {
+	if v < low  { return float64(low-v) }
+	if v > high { return float64(v-high) }
+	return 0
+}
+func (g *groupGeneral) distance(q interface{}) float64 {
+	switch v := q.(type) {
+	case *GroupEntry:
+		if g.GS.GroupLow > v.GroupID || g.GS.GroupHigh < v.GroupID { return math.Inf(1) }
+		return udistance(g.GS.ArticleLow,g.GS.ArticleHigh,v.Article)
+	case *GroupExpired:
+		return udistance(g.GS.ExpiresLow,g.GS.ExpiresHigh,v.Timestamp)
+	case *GroupQuery:
+		if g.GS.GroupLow > v.GroupID || g.GS.GroupHigh < v.GroupID { return math.Inf(1) }
+		if v.ArticleHigh >= v.ArticleLow {
+			if g.GS.ArticleLow  > v.ArticleHigh { return float64(g.GS.ArticleLow-v.ArticleHigh) }
+			if g.GS.ArticleHigh < v.ArticleLow  { return float64(v.ArticleLow-g.GS.ArticleHigh) }
+		}
+		return 0
+	}
+	return math.Inf(1)
+}
+
 type GroupOps struct{}
 
 var GroupOpsImpl newtree.TreeOps = GroupOps{}
+var _ newtree.DistanceOps = GroupOps{}
+var _ newtree.OverlapOps = GroupOps{}
+var _ newtree.AggregateOps = GroupOps{}
+var _ newtree.CoverOps = GroupOps{}
+
+func init() { newtree.RegisterOps("ntops.GroupOps",GroupOpsImpl) }
 
 func (GroupOps) Consistent(p []byte, q interface{}) bool {
 	k1 := groupGeneral_alloc()
@@ -224,6 +255,76 @@ func (GroupOps) Consistent(p []byte, q interface{}) bool {
 	return k1.consistent(q)
 }
 
+/*
+Implements newtree.DistanceOps.
+
+	*GroupEntry   -> distance in article numbers, within the same group.
+	*GroupQuery   -> distance to the article range, within the same group.
+	*GroupExpired -> distance in expiry time to .Timestamp.
+
+Other queries and undecodable keys have a distance of +Inf.
+*/
+func (GroupOps) Distance(p []byte, q interface{}) float64 {
+	k1 := groupGeneral_alloc()
+	defer k1.free()
+	if err := msgpack.Unmarshal(p,k1); err!=nil { return math.Inf(1) }
+	return k1.distance(q)
+}
+/*
+The aggregate of a set of GroupEntries, as returned by Tree.Aggregate() on a
+tree using GroupOps.
+*/
+type GroupAggregate struct{
+	Count uint64
+	ArticleLow, ArticleHigh uint64
+	ExpiresLow, ExpiresHigh uint64
+}
+
+func (g *groupGeneral) contains(q interface{}) bool {
+	switch v := q.(type) {
+	case *GroupEntry:
+		return g.GS.GroupLow==v.GroupID && g.GS.GroupHigh==v.GroupID &&
+			g.GS.ArticleLow==v.Article && g.GS.ArticleHigh==v.Article
+	case *GroupExpired:
+		return g.GS.ExpiresHigh <= v.Timestamp
+	case *GroupQuery:
+		if g.GS.GroupLow!=v.GroupID || g.GS.GroupHigh!=v.GroupID { return false }
+		if v.ArticleHigh >= v.ArticleLow {
+			return v.ArticleLow <= g.GS.ArticleLow && g.GS.ArticleHigh <= v.ArticleHigh
+		}
+	}
+	return true
+}
+
+// Implements newtree.AggregateOps.
+func (GroupOps) Contains(p []byte, q interface{}) bool {
+	k1 := groupGeneral_alloc()
+	defer k1.free()
+	if err := msgpack.Unmarshal(p,k1); err!=nil { return false }
+	return k1.contains(q)
+}
+// Implements newtree.AggregateOps. Returns a *GroupAggregate, or nil for
+// undecodable keys.
+func (GroupOps) Summary(p []byte) interface{} {
+	k1 := groupGeneral_alloc()
+	defer k1.free()
+	if err := msgpack.Unmarshal(p,k1); err!=nil { return nil }
+	return &GroupAggregate{k1.GS.Count,k1.GS.ArticleLow,k1.GS.ArticleHigh,k1.GS.ExpiresLow,k1.GS.ExpiresHigh}
+}
+// Implements newtree.AggregateOps.
+func (GroupOps) Merge(a, b interface{}) interface{} {
+	x,_ := a.(*GroupAggregate)
+	y,_ := b.(*GroupAggregate)
+	if x==nil { return b }
+	if y==nil { return a }
+	r := *x
+	r.Count += y.Count
+	if r.ArticleLow  > y.ArticleLow  { r.ArticleLow  = y.ArticleLow  }
+	if r.ArticleHigh < y.ArticleHigh { r.ArticleHigh = y.ArticleHigh }
+	if r.ExpiresLow  > y.ExpiresLow  { r.ExpiresLow  = y.ExpiresLow  }
+	if r.ExpiresHigh < y.ExpiresHigh { r.ExpiresHigh = y.ExpiresHigh }
+	return &r
+}
 func (GroupOps) Union(P newtree.Elements) []byte {
 	k1 := groupGeneral_alloc()
 	k2 := groupGeneral_alloc()
@@ -242,6 +343,34 @@ func (GroupOps) Union(P newtree.Elements) []byte {
 	return data
 }
 
+// Implements newtree.OverlapOps. p and q overlap, if they do in all three dimensions.
+func (GroupOps) Overlap(p,q []byte) bool {
+	k1 := groupGeneral_alloc()
+	k2 := groupGeneral_alloc()
+	defer k1.free()
+	defer k2.free()
+	if err := msgpack.Unmarshal(p,k1); err!=nil { return true }
+	if err := msgpack.Unmarshal(q,k2); err!=nil { return true }
+	a,b := &k1.GS,&k2.GS
+	if a.GroupLow   > b.GroupHigh   || b.GroupLow   > a.GroupHigh   { return false }
+	if a.ArticleLow > b.ArticleHigh || b.ArticleLow > a.ArticleHigh { return false }
+	if a.ExpiresLow > b.ExpiresHigh || b.ExpiresLow > a.ExpiresHigh { return false }
+	return true
+}
+/*
+Implements newtree.CoverOps. p covers c, if its ranges contain those of c and
+its Count is not smaller, as .Union() sums up the Counts.
+*/
+func (GroupOps) Covers(p,c []byte) bool {
+	k1 := groupGeneral_alloc()
+	k2 := groupGeneral_alloc()
+	defer k1.free()
+	defer k2.free()
+	if err := msgpack.Unmarshal(p,k1); err!=nil { return false }
+	if err := msgpack.Unmarshal(c,k2); err!=nil { return false }
+	grp,art,exp := k1.penalty(k2)
+	return grp==0 && art==0 && exp==0 && k1.GS.Count>=k2.GS.Count
+}
 func (GroupOps) Penalty(E1,E2 []byte) (F float64) {
 	k1 := groupGeneral_alloc()
 	k2 := groupGeneral_alloc()
@@ -0,0 +1,292 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+package ntops
+
+import "github.com/maxymania/gonbase/newtree"
+import "encoding/binary"
+import "errors"
+import "math"
+import "sort"
+
+var EIntervalKey = errors.New("EIntervalKey")
+
+/* The integer types of interval bounds. */
+type Integer interface{
+	~int64 | ~uint64
+}
+
+/* Maps v onto an uint64, preserving the order. */
+func ivOrdinal[T Integer](v T) uint64 {
+	var z T
+	if z-1 < z { return uint64(v)^(1<<63) }
+	return uint64(v)
+}
+func ivValue[T Integer](u uint64) T {
+	var z T
+	if z-1 < z { return T(u^(1<<63)) }
+	return T(u)
+}
+
+const (
+	ivLeaf  = 0
+	ivUnion = 1
+	ivLeafSize  = 17
+	ivUnionSize = 33
+)
+
+/*
+A decoded key. Leaf-keys are encoded as
+
+	byte 0 | uint64 low | uint64 high | value
+
+and the keys of inner elements as
+
+	byte 1 | uint64 low | uint64 high | uint64 maxLow | uint64 minHigh
+
+where low and high cover all intervals of the subtree, maxLow is the greatest
+lower bound and minHigh the least upper bound of them. All numbers are
+big-endian ordinals (see ivOrdinal()), so that their byte order is the order
+of the numbers.
+*/
+type ivKey struct{
+	low, high, maxLow, minHigh uint64
+}
+
+func (k *ivKey) decode(p []byte) bool {
+	if len(p)<ivLeafSize { return false }
+	k.low  = binary.BigEndian.Uint64(p[1:])
+	k.high = binary.BigEndian.Uint64(p[9:])
+	switch p[0] {
+	case ivLeaf:
+		k.maxLow,k.minHigh = k.low,k.high
+	case ivUnion:
+		if len(p)!=ivUnionSize { return false }
+		k.maxLow  = binary.BigEndian.Uint64(p[17:])
+		k.minHigh = binary.BigEndian.Uint64(p[25:])
+	default:
+		return false
+	}
+	return true
+}
+func (k *ivKey) merge(o *ivKey) {
+	if k.low     > o.low     { k.low     = o.low     }
+	if k.high    < o.high    { k.high    = o.high    }
+	if k.maxLow  < o.maxLow  { k.maxLow  = o.maxLow  }
+	if k.minHigh > o.minHigh { k.minHigh = o.minHigh }
+}
+
+/*
+Encodes the interval from low to high (inclusive) with the attached value.
+low must not be greater than high.
+*/
+func EncodeInterval[T Integer](low, high T, value []byte) []byte {
+	p := make([]byte,ivLeafSize+len(value))
+	p[0] = ivLeaf
+	binary.BigEndian.PutUint64(p[1:],ivOrdinal(low))
+	binary.BigEndian.PutUint64(p[9:],ivOrdinal(high))
+	copy(p[ivLeafSize:],value)
+	return p
+}
+
+/*
+Decodes an interval encoded by EncodeInterval() with the same T. value refers
+to p.
+*/
+func DecodeInterval[T Integer](p []byte) (low, high T, value []byte, err error) {
+	if len(p)<ivLeafSize || p[0]!=ivLeaf { err = EIntervalKey; return }
+	low  = ivValue[T](binary.BigEndian.Uint64(p[1:]))
+	high = ivValue[T](binary.BigEndian.Uint64(p[9:]))
+	value = p[ivLeafSize:]
+	return
+}
+
+/* A query understood by IntervalOps. T must be the type, the tree was built with. */
+type IntervalQueryer interface{
+	intervalQuery() ivQuery
+}
+
+const (
+	ivStab = iota
+	ivOverlap
+	ivWithin
+	ivContains
+)
+
+type ivQuery struct{
+	kind      int
+	low, high uint64
+}
+
+/* Matches the intervals containing At. */
+type IntervalStab[T Integer] struct{
+	At T
+}
+/* Matches the intervals overlapping the interval from Low to High. */
+type IntervalOverlap[T Integer] struct{
+	Low, High T
+}
+/* Matches the intervals contained in the interval from Low to High. */
+type IntervalWithin[T Integer] struct{
+	Low, High T
+}
+/* Matches the intervals containing the interval from Low to High. */
+type IntervalContains[T Integer] struct{
+	Low, High T
+}
+
+func (q IntervalStab[T]) intervalQuery() ivQuery { return ivQuery{ivStab,ivOrdinal(q.At),ivOrdinal(q.At)} }
+func (q IntervalOverlap[T]) intervalQuery() ivQuery { return ivQuery{ivOverlap,ivOrdinal(q.Low),ivOrdinal(q.High)} }
+func (q IntervalWithin[T]) intervalQuery() ivQuery { return ivQuery{ivWithin,ivOrdinal(q.Low),ivOrdinal(q.High)} }
+func (q IntervalContains[T]) intervalQuery() ivQuery { return ivQuery{ivContains,ivOrdinal(q.Low),ivOrdinal(q.High)} }
+
+/*
+Reports, whether k may cover a matching interval. For leaf-keys, the result
+is exact.
+*/
+func (k *ivKey) consistent(q ivQuery) bool {
+	switch q.kind {
+	case ivStab,ivOverlap:
+		return k.low<=q.high && q.low<=k.high
+	case ivWithin:
+		return q.low<=k.maxLow && k.minHigh<=q.high && k.low<=q.high && q.low<=k.high
+	case ivContains:
+		return k.low<=q.low && q.high<=k.high
+	}
+	return false
+}
+func (k *ivKey) distance(q ivQuery) float64 {
+	if k.high<q.low { return float64(q.low-k.high) }
+	if q.high<k.low { return float64(k.low-q.high) }
+	return 0
+}
+
+/*
+TreeOps for intervals of int64 or uint64 (see EncodeInterval()). Queries are
+IntervalStab, IntervalOverlap, IntervalWithin and IntervalContains.
+
+Keys, that are neither encoded by EncodeInterval() nor returned by .Union(),
+are invalid. As TreeOps can't return errors, .Union() panics with EIntervalKey
+on them, so they never get into a tree. They match no query and have an
+infinite distance.
+*/
+type IntervalOps struct{}
+
+var IntervalOpsImpl newtree.TreeOps = IntervalOps{}
+var _ newtree.DistanceOps = IntervalOps{}
+var _ newtree.OverlapOps = IntervalOps{}
+var _ newtree.BoxOps = IntervalOps{}
+
+func init() { newtree.RegisterOps("ntops.IntervalOps",IntervalOpsImpl) }
+
+func (IntervalOps) Consistent(p []byte, q interface{}) bool {
+	var k ivKey
+	if !k.decode(p) { return false }
+	if v,ok := q.(IntervalQueryer); ok { return k.consistent(v.intervalQuery()) }
+	return false
+}
+// Implements newtree.DistanceOps. The distance is the gap between the intervals.
+func (IntervalOps) Distance(p []byte, q interface{}) float64 {
+	var k ivKey
+	if !k.decode(p) { return math.Inf(1) }
+	if v,ok := q.(IntervalQueryer); ok { return k.distance(v.intervalQuery()) }
+	return math.Inf(1)
+}
+// Implements newtree.OverlapOps.
+func (IntervalOps) Overlap(p,q []byte) bool {
+	var k1,k2 ivKey
+	if !k1.decode(p) || !k2.decode(q) { return true }
+	return k1.low<=k2.high && k2.low<=k1.high
+}
+func (IntervalOps) Union(P newtree.Elements) []byte {
+	var k1,k2 ivKey
+	for i,p := range P {
+		if !k2.decode(p.Val) { panic(EIntervalKey) }
+		if i==0 {
+			k1 = k2
+		} else {
+			k1.merge(&k2)
+		}
+	}
+	u := make([]byte,ivUnionSize)
+	u[0] = ivUnion
+	binary.BigEndian.PutUint64(u[1:],k1.low)
+	binary.BigEndian.PutUint64(u[9:],k1.high)
+	binary.BigEndian.PutUint64(u[17:],k1.maxLow)
+	binary.BigEndian.PutUint64(u[25:],k1.minHigh)
+	return u
+}
+/* The growth of the range of E1, if E2 is added to it. */
+func (IntervalOps) Penalty(E1,E2 []byte) float64 {
+	var k1,k2 ivKey
+	if !k1.decode(E1) || !k2.decode(E2) { return math.Inf(1) }
+	F := float64(0)
+	if k2.low  < k1.low  { F += float64(k1.low-k2.low) }
+	if k2.high > k1.high { F += float64(k2.high-k1.high) }
+	return F
+}
+func (s IntervalOps) FirstSplit(P newtree.Elements,maxsize int) (newtree.Elements,newtree.Elements) {
+	return firstSplitSorted(P,maxsize)
+}
+func (IntervalOps) Sort(E newtree.Elements) {
+	var k1,k2 ivKey
+	sort.Slice(E,func(i,j int) bool {
+		if !k1.decode(E[i].Val) || !k2.decode(E[j].Val) { return false }
+		if k1.low!=k2.low { return k1.low<k2.low }
+		return k1.high<k2.high
+	})
+}
+
+/* The length of the range of p. */
+func ivLength(p []byte) float64 {
+	var k ivKey
+	if !k.decode(p) { return math.Inf(1) }
+	return float64(k.high-k.low)
+}
+
+// Implements newtree.BoxOps. Intervals have a single axis.
+func (IntervalOps) Axes() int { return 1 }
+// Implements newtree.BoxOps.
+func (IntervalOps) SortAxis(E newtree.Elements, axis int, upper bool) {
+	var k1,k2 ivKey
+	sort.Slice(E,func(i,j int) bool {
+		if !k1.decode(E[i].Val) || !k2.decode(E[j].Val) { return false }
+		if upper && k1.high!=k2.high { return k1.high<k2.high }
+		if k1.low!=k2.low { return k1.low<k2.low }
+		return k1.high<k2.high
+	})
+}
+// Implements newtree.BoxOps. In one dimension, the margin is the length.
+func (IntervalOps) Margin(p []byte) float64 { return ivLength(p) }
+// Implements newtree.BoxOps. In one dimension, the area is the length.
+func (IntervalOps) Area(p []byte) float64 { return ivLength(p) }
+// Implements newtree.BoxOps.
+func (IntervalOps) OverlapArea(p,q []byte) float64 {
+	var k1,k2 ivKey
+	if !k1.decode(p) || !k2.decode(q) { return math.Inf(1) }
+	if k1.low<k2.low { k1.low = k2.low }
+	if k1.high>k2.high { k1.high = k2.high }
+	if k1.low>k1.high { return 0 }
+	return float64(k1.high-k1.low)
+}
@@ -29,6 +29,7 @@ import "bytes"
 import "sort"
 import "sync"
 import "fmt"
+import "math"
 
 func strcpy(d *[]byte,s []byte) {
 	*d = append((*d)[:0],s...)
@@ -81,9 +82,39 @@ func (s *strKey) set(o *strKey) {
 	strcpy(&s.High,o.High)
 }
 
+/* Maps the first 8 bytes onto a number, preserving the order. */
+func strOrdinal(b []byte) float64 {
+	var u uint64
+	for i := 0; i<8; i++ {
+		u <<= 8
+		if i<len(b) { u |= uint64(b[i]) }
+	}
+	return float64(u)
+}
+/*
+The distance from a to b, where a is lower: the first 8 bytes after their
+common prefix are mapped onto numbers, and the difference is scaled down by the
+length of the prefix. So the distances follow the order of the keys, until the
+common prefix exceeds about 120 bytes, where the scale underflows to 0.
+*/
+func strDistance(a, b []byte) float64 {
+	c := 0
+	for c<len(a) && c<len(b) && a[c]==b[c] { c++ }
+	return math.Ldexp(strOrdinal(b[c:])-strOrdinal(a[c:]),-8*c)
+}
+func (s *strKey) distance(q *StrRange) float64 {
+	if bytes.Compare(s.High,q.Low)<0 { return strDistance(s.High,q.Low) }
+	if bytes.Compare(q.High,s.Low)<0 { return strDistance(q.High,s.Low) }
+	return 0
+}
+
 type StrOps struct{}
 
 var StrOpsImpl newtree.TreeOps = StrOps{}
+var _ newtree.DistanceOps = StrOps{}
+var _ newtree.OverlapOps = StrOps{}
+
+func init() { newtree.RegisterOps("ntops.StrOps",StrOpsImpl) }
 
 func (s StrOps) Consistent(p []byte, q interface{}) bool {
 	k := strKeyNew()
@@ -99,6 +130,34 @@ func (s StrOps) Consistent(p []byte, q interface{}) bool {
 	}
 	return false
 }
+// Implements newtree.DistanceOps. The distance is derived from the 8 bytes after
+// the common prefix of the keys.
+func (s StrOps) Distance(p []byte, q interface{}) float64 {
+	k := strKeyNew()
+	defer k.free()
+	err := msgpack.Unmarshal(p,k)
+	if err!=nil { return math.Inf(1) }
+	k.decode()
+	switch v := q.(type) {
+	case *StrRange:
+		return k.distance(v)
+	case StrRange:
+		return k.distance(&v)
+	}
+	return math.Inf(1)
+}
+// Implements newtree.OverlapOps.
+func (s StrOps) Overlap(p,q []byte) bool {
+	k1 := strKeyNew()
+	k2 := strKeyNew()
+	defer k1.free()
+	defer k2.free()
+	if err := msgpack.Unmarshal(p,k1); err!=nil { return true }
+	if err := msgpack.Unmarshal(q,k2); err!=nil { return true }
+	k1.decode()
+	k2.decode()
+	return k1.matchRange(&StrRange{k2.Low,k2.High})
+}
 func (s StrOps) Union(P newtree.Elements) []byte {
 	k1 := strKeyNew()
 	k2 := strKeyNew()
@@ -0,0 +1,109 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+package ntops
+
+import "github.com/maxymania/gonbase/newtree"
+import "github.com/vmihailenco/msgpack"
+import "context"
+
+/*
+A query understood by GroupOps: *GroupEntry, *GroupQuery or *GroupExpired.
+It can't be implemented outside of this package.
+*/
+type GroupQueryer interface{
+	groupQuery()
+}
+func (*GroupEntry) groupQuery() {}
+func (*GroupQuery) groupQuery() {}
+func (*GroupExpired) groupQuery() {}
+
+/* A newtree.Codec for trees using GroupOps. */
+type GroupCodec struct{}
+
+func (GroupCodec) Encode(v GroupEntry) ([]byte,error) { return v.Marshal(),nil }
+func (GroupCodec) Decode(b []byte) (v GroupEntry, err error) {
+	err = v.Unmarshal(b)
+	return
+}
+func (GroupCodec) Query(q GroupQueryer) interface{} { return q }
+
+func NewGroupTree(t *newtree.Tree, obj int64) *newtree.TypedTree[GroupEntry,GroupQueryer] {
+	return newtree.NewTypedTree[GroupEntry,GroupQueryer](t,obj,GroupCodec{})
+}
+
+/*
+Returns the aggregate of the GroupEntries in the tree obj matching q (see
+Tree.Aggregate()). If nothing matches, the Count is 0.
+*/
+func AggregateGroups(ctx context.Context, t *newtree.Tree, obj int64, q GroupQueryer) (GroupAggregate,error) {
+	a,err := t.Aggregate(ctx,obj,q)
+	if err!=nil || a==nil { return GroupAggregate{},err }
+	return *a.(*GroupAggregate),nil
+}
+
+/*
+A key-value pair stored in a tree using StrOps. See EncodePair(). Note, that
+StrOps treats the pair as the range from Key to Value, so a StrRange matches
+every pair, whose range overlaps it.
+*/
+type StrPair struct{
+	Key, Value []byte
+}
+
+/* A newtree.Codec for trees using StrOps. */
+type StrCodec struct{}
+
+func (StrCodec) Encode(v StrPair) ([]byte,error) { return EncodePair(v.Key,v.Value),nil }
+func (StrCodec) Decode(b []byte) (StrPair,error) {
+	var k strKey
+	err := msgpack.Unmarshal(b,&k)
+	return StrPair{k.Low,k.High},err
+}
+func (StrCodec) Query(q StrRange) interface{} { return &q }
+
+func NewStrTree(t *newtree.Tree, obj int64) *newtree.TypedTree[StrPair,StrRange] {
+	return newtree.NewTypedTree[StrPair,StrRange](t,obj,StrCodec{})
+}
+
+/* An interval stored in a tree using IntervalOps. See EncodeInterval(). */
+type Interval[T Integer] struct{
+	Low, High T
+	Value []byte
+}
+
+/* A newtree.Codec for trees using IntervalOps. */
+type IntervalCodec[T Integer] struct{}
+
+func (IntervalCodec[T]) Encode(v Interval[T]) ([]byte,error) { return EncodeInterval(v.Low,v.High,v.Value),nil }
+func (IntervalCodec[T]) Decode(b []byte) (v Interval[T], err error) {
+	v.Low,v.High,v.Value,err = DecodeInterval[T](b)
+	v.Value = append([]byte(nil),v.Value...)
+	return
+}
+func (IntervalCodec[T]) Query(q IntervalQueryer) interface{} { return q }
+
+func NewIntervalTree[T Integer](t *newtree.Tree, obj int64) *newtree.TypedTree[Interval[T],IntervalQueryer] {
+	return newtree.NewTypedTree[Interval[T],IntervalQueryer](t,obj,IntervalCodec[T]{})
+}